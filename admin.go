@@ -0,0 +1,243 @@
+package authorizer
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// AdminConfig enables session administration API under /saml/admin/
+type AdminConfig struct {
+	// Token authenticates scripts with Authorization: Bearer header
+	Token string `yaml:"token"`
+	// TokenFile with token, alternative to Token
+	TokenFile string `yaml:"tokenfile"`
+	// Users is a policy expression selecting signed-in administrators
+	Users string `yaml:"users"`
+}
+
+func (c *AdminConfig) validate() []string {
+	var errs []string
+	if c.Token == "" && c.TokenFile == "" && c.Users == "" {
+		errs = append(errs, "token, tokenfile or users is required")
+	}
+	if c.Token != "" && c.TokenFile != "" {
+		errs = append(errs, "token: only one of token and tokenfile can be set")
+	}
+	if c.Token != "" && len(c.Token) < minSecretLength {
+		errs = append(errs, fmt.Sprintf("token: must be at least %d bytes", minSecretLength))
+	}
+	if c.Users != "" {
+		if _, err := parseExpr(c.Users); err != nil {
+			errs = append(errs, fmt.Sprintf("users: %v", err))
+		}
+	}
+	return errs
+}
+
+// Admin decides who can use administration API
+type Admin struct {
+	token []byte
+	users expr
+}
+
+// NewAdmin reads token and returns Admin for config
+func NewAdmin(c AdminConfig) (*Admin, error) {
+	if errs := c.validate(); len(errs) > 0 {
+		return nil, errors.New(strings.Join(errs, "; "))
+	}
+
+	a := &Admin{token: []byte(c.Token)}
+	if c.TokenFile != "" {
+		data, err := os.ReadFile(c.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("tokenfile: %w", err)
+		}
+		a.token = []byte(strings.TrimRight(string(data), "\r\n"))
+		if len(a.token) < minSecretLength {
+			return nil, fmt.Errorf("tokenfile: token must be at least %d bytes", minSecretLength)
+		}
+	}
+	if c.Users != "" {
+		a.users, _ = parseExpr(c.Users)
+	}
+	return a, nil
+}
+
+// authenticateAdmin returns name of administrator making request
+func (s *AuthService) authenticateAdmin(a *Admin, r *http.Request) (string, bool) {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token := []byte(strings.TrimPrefix(auth, "Bearer "))
+		if len(a.token) > 0 && subtle.ConstantTimeCompare(token, a.token) == 1 {
+			return "token", true
+		}
+		return "", false
+	}
+	if a.users == nil {
+		return "", false
+	}
+	session, err := s.SP.GetSession(r)
+	if err != nil {
+		return "", false
+	}
+	attributes, err := s.sessionAttributes(r, session)
+	if err != nil || !a.users.eval(newEnv(r, r.URL, attributes)) {
+		return "", false
+	}
+	nameID, _, _ := sessionInfo(session)
+	return nameID, true
+}
+
+// Admin handler serves session administration API:
+//
+//	GET    /saml/admin/sessions?nameid=N&attribute=name=value
+//	DELETE /saml/admin/sessions/ID
+//	GET    /saml/admin/revocations
+//	POST   /saml/admin/revocations {"nameid": "N", "before": "RFC3339"}
+//
+// Changing requests from signed-in administrators must be JSON so they
+// can not be forged by cross-site forms.
+func (s *AuthService) Admin(w http.ResponseWriter, r *http.Request) {
+	a := s.Settings().Admin
+	if a == nil || s.Revoker == nil {
+		s.httpError(w, r, http.StatusNotFound)
+		return
+	}
+	admin, ok := s.authenticateAdmin(a, r)
+	if !ok {
+		s.httpError(w, r, http.StatusUnauthorized)
+		return
+	}
+
+	path := strings.TrimPrefix("/"+s.endpoint(r), "/admin")
+	switch {
+	case path == "/sessions" && r.Method == http.MethodGet:
+		s.listSessions(w, r)
+	case strings.HasPrefix(path, "/sessions/") && r.Method == http.MethodDelete:
+		s.revokeSession(w, r, admin, strings.TrimPrefix(path, "/sessions/"))
+	case path == "/revocations" && r.Method == http.MethodGet:
+		list, err := s.Revoker.Revocations(r.Context())
+		if err != nil {
+			s.adminError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		s.writeJSON(w, r, http.StatusOK, list)
+	case path == "/revocations" && r.Method == http.MethodPost:
+		s.revoke(w, r, admin)
+	case path == "/sessions" || strings.HasPrefix(path, "/sessions/") || path == "/revocations":
+		s.httpError(w, r, http.StatusMethodNotAllowed)
+	default:
+		s.httpError(w, r, http.StatusNotFound)
+	}
+}
+
+func (s *AuthService) listSessions(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filters := map[string]string{}
+	for _, f := range query["attribute"] {
+		i := strings.IndexByte(f, '=')
+		if i <= 0 {
+			s.adminError(w, r, http.StatusBadRequest, fmt.Errorf("attribute %q must be name=value", f))
+			return
+		}
+		filters[s.Settings().Aliases.Canonical(f[:i])] = f[i+1:]
+	}
+
+	sessions, err := s.Revoker.Sessions(r.Context())
+	if errors.Is(err, errNoSessionStore) {
+		s.adminError(w, r, http.StatusNotImplemented, err)
+		return
+	}
+	if err != nil {
+		s.adminError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := []*ServerSession{}
+	for _, session := range sessions {
+		if nameID := query.Get("nameid"); nameID != "" && session.NameID != nameID {
+			continue
+		}
+		attributes := s.Settings().Aliases.normalize(session.Attributes)
+		match := true
+		for name, value := range filters {
+			match = match && contains(attributes[name], value)
+		}
+		if match {
+			res = append(res, session)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].CreatedAt.Before(res[j].CreatedAt) })
+	s.writeJSON(w, r, http.StatusOK, res)
+}
+
+func (s *AuthService) revokeSession(w http.ResponseWriter, r *http.Request, admin, id string) {
+	err := s.Revoker.RevokeSession(r.Context(), id)
+	switch {
+	case errors.Is(err, errNoSessionStore):
+		s.adminError(w, r, http.StatusNotImplemented, err)
+		return
+	case errors.Is(err, ErrSessionNotFound):
+		s.httpError(w, r, http.StatusNotFound)
+		return
+	case err != nil:
+		s.adminError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	s.Log.Info("session revoked", zap.String("admin", admin), zap.String("session", id))
+	s.httpStatus(w, r, http.StatusNoContent)
+}
+
+func (s *AuthService) revoke(w http.ResponseWriter, r *http.Request, admin string) {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		s.httpError(w, r, http.StatusUnsupportedMediaType)
+		return
+	}
+	var req struct {
+		NameID string     `json:"nameid"`
+		Before *time.Time `json:"before"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		s.adminError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if req.NameID == "" && req.Before == nil {
+		s.adminError(w, r, http.StatusBadRequest, errors.New("nameid or before is required"))
+		return
+	}
+	before := time.Now()
+	if req.Before != nil {
+		before = *req.Before
+	}
+
+	rev, err := s.Revoker.Revoke(r.Context(), req.NameID, before)
+	if err != nil {
+		s.adminError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	s.Log.Info("sessions revoked",
+		zap.String("admin", admin),
+		zap.String("nameId", rev.NameID),
+		zap.Time("before", rev.Before),
+	)
+	s.writeJSON(w, r, http.StatusCreated, rev)
+}
+
+func (s *AuthService) adminError(w http.ResponseWriter, r *http.Request, code int, err error) {
+	s.Log.Info("admin error", zap.String("requestUrl", r.URL.String()), zap.Error(err))
+	s.writeJSON(w, r, code, map[string]string{"error": err.Error()})
+}
+
+func (s *AuthService) writeJSON(w http.ResponseWriter, r *http.Request, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	s.httpStatus(w, r, code)
+	json.NewEncoder(w).Encode(v)
+}
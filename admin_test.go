@@ -0,0 +1,162 @@
+package authorizer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func adminService(t *testing.T, c AdminConfig) (*AuthService, StoreSessionProvider) {
+	t.Helper()
+	p := StoreSessionProvider{Store: NewMemoryStore(), Name: "token"}
+	admin, err := NewAdmin(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := fakeAuthService(p, nil)
+	s.Reload(&Settings{ACL: mustNewACL(nil, nil), Admin: admin})
+	if s.Revoker, err = NewRevoker(&SessionConfig{Store: "memory"}, p); err != nil {
+		t.Fatal(err)
+	}
+	return s, p
+}
+
+func TestAdminAPI(t *testing.T) {
+	s, p := adminService(t, AdminConfig{Token: testSecret})
+	user := sessionCookie(t, p)
+	sessions, _ := s.Revoker.Sessions(user.Context())
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		body   string
+		want   int
+		count  int
+	}{
+		{"NoToken", "GET", "/saml/admin/sessions", "", "", http.StatusUnauthorized, 0},
+		{"WrongToken", "GET", "/saml/admin/sessions", "wrong", "", http.StatusUnauthorized, 0},
+		{"List", "GET", "/saml/admin/sessions", testSecret, "", http.StatusOK, 1},
+		{"ListByNameID", "GET", "/saml/admin/sessions?nameid=bob", testSecret, "", http.StatusOK, 0},
+		{"ListByAlias", "GET", "/saml/admin/sessions?attribute=userid=alice", testSecret, "", http.StatusOK, 1},
+		{"ListBadFilter", "GET", "/saml/admin/sessions?attribute=uid", testSecret, "", http.StatusBadRequest, 0},
+		{"DeleteUnknown", "DELETE", "/saml/admin/sessions/" + sessionID("x"), testSecret, "", http.StatusNotFound, 0},
+		{"MethodNotAllowed", "PUT", "/saml/admin/sessions", testSecret, "", http.StatusMethodNotAllowed, 0},
+		{"RevokeEmpty", "POST", "/saml/admin/revocations", testSecret, `{}`, http.StatusBadRequest, 0},
+		{"NotFound", "GET", "/saml/admin/other", testSecret, "", http.StatusNotFound, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			res := httptest.NewRecorder()
+			s.Admin(res, req)
+			if res.Code != tt.want {
+				t.Fatalf("got status %d but wanted %d: %s", res.Code, tt.want, res.Body)
+			}
+			if tt.want == http.StatusOK {
+				var got []ServerSession
+				if err := json.NewDecoder(res.Body).Decode(&got); err != nil || len(got) != tt.count {
+					t.Errorf("got %d sessions (%v) but wanted %d", len(got), err, tt.count)
+				}
+			}
+		})
+	}
+
+	// revoke single session, user is signed out
+	req := httptest.NewRequest("DELETE", "/saml/admin/sessions/"+sessions[0].ID, nil)
+	req.Header.Set("Authorization", "Bearer "+testSecret)
+	res := httptest.NewRecorder()
+	s.Admin(res, req)
+	if res.Code != http.StatusNoContent {
+		t.Errorf("got status %d but wanted %d", res.Code, http.StatusNoContent)
+	}
+	res = httptest.NewRecorder()
+	s.Auth(res, user)
+	if res.Code != http.StatusUnauthorized {
+		t.Errorf("auth after revocation got status %d but wanted %d", res.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestAdminRevokeUser(t *testing.T) {
+	s, p := adminService(t, AdminConfig{Users: `groups == "sre"`})
+	admin := sessionCookie(t, p)
+
+	// session issued before revocation
+	user := sessionCookie(t, p)
+	res := httptest.NewRecorder()
+	s.Auth(res, user)
+	if res.Code != http.StatusAccepted {
+		t.Fatalf("auth got status %d but wanted %d", res.Code, http.StatusAccepted)
+	}
+
+	// not JSON, could be cross-site form
+	req := httptest.NewRequest("POST", "/saml/admin/revocations", strings.NewReader(`nameid=alice`))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Cookie", admin.Header.Get("Cookie"))
+	res = httptest.NewRecorder()
+	s.Admin(res, req)
+	if res.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("form post got status %d but wanted %d", res.Code, http.StatusUnsupportedMediaType)
+	}
+
+	before := time.Now().Add(time.Second).UTC().Format(time.RFC3339)
+	req = httptest.NewRequest("POST", "/saml/admin/revocations", strings.NewReader(`{"nameid": "alice@example.com", "before": "`+before+`"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Cookie", admin.Header.Get("Cookie"))
+	res = httptest.NewRecorder()
+	s.Admin(res, req)
+	if res.Code != http.StatusCreated {
+		t.Fatalf("revoke got status %d but wanted %d: %s", res.Code, http.StatusCreated, res.Body)
+	}
+
+	res = httptest.NewRecorder()
+	s.Auth(res, user)
+	if res.Code != http.StatusUnauthorized {
+		t.Errorf("auth after revocation got status %d but wanted %d", res.Code, http.StatusUnauthorized)
+	}
+
+	// admin session was revoked too as it belongs to the same user
+	req = httptest.NewRequest("GET", "/saml/admin/revocations", nil)
+	req.Header.Set("Cookie", admin.Header.Get("Cookie"))
+	res = httptest.NewRecorder()
+	s.Admin(res, req)
+	if res.Code != http.StatusUnauthorized {
+		t.Errorf("revoked admin got status %d but wanted %d", res.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestNewAdminErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config AdminConfig
+		want   string
+	}{{
+		name:   "Empty",
+		config: AdminConfig{},
+		want:   "token, tokenfile or users is required",
+	}, {
+		name:   "ShortToken",
+		config: AdminConfig{Token: "short"},
+		want:   "token: must be at least 32 bytes",
+	}, {
+		name:   "Users",
+		config: AdminConfig{Users: `groups ==`},
+		want:   "users: ",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewAdmin(tt.config)
+			if err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+				t.Errorf("NewAdmin() error = %v, want %s", err, tt.want)
+			}
+		})
+	}
+}
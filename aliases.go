@@ -0,0 +1,190 @@
+package authorizer
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/crewjam/saml/samlsp"
+)
+
+// AttributesConfig controls normalization of attribute names, applied
+// before policies are checked and headers are set
+type AttributesConfig struct {
+	// Aliases maps canonical attribute name to alternative names
+	Aliases map[string][]string `yaml:"aliases"`
+	// NoBuiltinAliases disables BuiltinAliases
+	NoBuiltinAliases bool `yaml:"nobuiltinaliases"`
+	// CaseInsensitive matches canonical and alternative names ignoring case,
+	// names not listed in aliases are still compared exactly
+	CaseInsensitive bool `yaml:"caseinsensitive"`
+}
+
+// BuiltinAliases of well-known LDAP, eduPerson and ADFS attribute names
+var BuiltinAliases = map[string][]string{
+	"uid": {
+		"urn:oid:0.9.2342.19200300.100.1.1",
+		"userid",
+	},
+	"mail": {
+		"urn:oid:0.9.2342.19200300.100.1.3",
+		"urn:oid:1.2.840.113549.1.9.1",
+		"email",
+		"emailAddress",
+		"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress",
+	},
+	"cn": {
+		"urn:oid:2.5.4.3",
+		"commonName",
+	},
+	"sn": {
+		"urn:oid:2.5.4.4",
+		"surname",
+		"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/surname",
+	},
+	"givenName": {
+		"urn:oid:2.5.4.42",
+		"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/givenname",
+	},
+	"displayName": {
+		"urn:oid:2.16.840.1.113730.3.1.241",
+		"http://schemas.microsoft.com/identity/claims/displayname",
+	},
+	"groups": {
+		"urn:oid:1.3.6.1.4.1.5923.1.5.1.1",
+		"urn:oid:1.2.840.113556.1.2.102",
+		"isMemberOf",
+		"memberOf",
+		"http://schemas.xmlsoap.org/claims/Group",
+		"http://schemas.microsoft.com/ws/2008/06/identity/claims/groups",
+	},
+	"role": {
+		"http://schemas.microsoft.com/ws/2008/06/identity/claims/role",
+	},
+	"eduPersonPrincipalName": {
+		"urn:oid:1.3.6.1.4.1.5923.1.1.1.6",
+		"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/upn",
+	},
+	"eduPersonAffiliation": {
+		"urn:oid:1.3.6.1.4.1.5923.1.1.1.1",
+	},
+	"eduPersonScopedAffiliation": {
+		"urn:oid:1.3.6.1.4.1.5923.1.1.1.9",
+	},
+	"eduPersonEntitlement": {
+		"urn:oid:1.3.6.1.4.1.5923.1.1.1.7",
+	},
+	"eduPersonTargetedID": {
+		"urn:oid:1.3.6.1.4.1.5923.1.1.1.10",
+	},
+	"eduPersonUniqueId": {
+		"urn:oid:1.3.6.1.4.1.5923.1.1.1.13",
+	},
+	"schacHomeOrganization": {
+		"urn:oid:1.3.6.1.4.1.25178.1.2.9",
+	},
+}
+
+// Aliases renames attributes to canonical names
+type Aliases struct {
+	names map[string]string
+	fold  bool
+}
+
+var builtinAliases, _ = NewAliases(AttributesConfig{})
+
+// NewAliases returns Aliases for config, user aliases take precedence over
+// builtin ones
+func NewAliases(c AttributesConfig) (*Aliases, error) {
+	a := &Aliases{names: map[string]string{}, fold: c.CaseInsensitive}
+	if !c.NoBuiltinAliases {
+		for canonical, names := range BuiltinAliases {
+			a.names[a.key(canonical)] = canonical
+			for _, name := range names {
+				a.names[a.key(name)] = canonical
+			}
+		}
+	}
+
+	user := map[string]string{}
+	canonicals := make([]string, 0, len(c.Aliases))
+	for canonical := range c.Aliases {
+		canonicals = append(canonicals, canonical)
+	}
+	sort.Strings(canonicals)
+	for _, canonical := range canonicals {
+		if canonical == "" {
+			return nil, errors.New("aliases: empty attribute name")
+		}
+		for _, name := range append([]string{canonical}, c.Aliases[canonical]...) {
+			if name == "" {
+				return nil, fmt.Errorf("aliases: %s: empty alias", canonical)
+			}
+			k := a.key(name)
+			if other, ok := user[k]; ok && other != canonical {
+				return nil, fmt.Errorf("aliases: %s: %q is already alias of %s", canonical, name, other)
+			}
+			user[k] = canonical
+		}
+	}
+	for k, canonical := range user {
+		a.names[k] = canonical
+	}
+	return a, nil
+}
+
+func (a *Aliases) key(name string) string {
+	if a.fold {
+		return strings.ToLower(name)
+	}
+	return name
+}
+
+// Canonical returns canonical name of attribute
+func (a *Aliases) Canonical(name string) string {
+	if a == nil {
+		a = builtinAliases
+	}
+	if canonical, ok := a.names[a.key(name)]; ok {
+		return canonical
+	}
+	return name
+}
+
+// normalize returns attributes renamed to canonical names, values of
+// attributes with the same canonical name are merged
+func (a *Aliases) normalize(attributes samlsp.Attributes) samlsp.Attributes {
+	if a == nil {
+		a = builtinAliases
+	}
+
+	names := make([]string, 0, len(attributes))
+	for name := range attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	res := samlsp.Attributes{}
+	for _, name := range names {
+		canonical := a.Canonical(name)
+		for _, v := range attributes[name] {
+			if !contains(res[canonical], v) {
+				res[canonical] = append(res[canonical], v)
+			}
+		}
+		if _, ok := res[canonical]; !ok {
+			res[canonical] = []string{}
+		}
+	}
+	return res
+}
+
+func contains(values []string, v string) bool {
+	for _, x := range values {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
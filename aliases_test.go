@@ -0,0 +1,133 @@
+package authorizer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/crewjam/saml/samlsp"
+)
+
+func mustNewAliases(c AttributesConfig) *Aliases {
+	a, err := NewAliases(c)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+func TestAliasesNormalize(t *testing.T) {
+	attributes := samlsp.Attributes{
+		"urn:oid:0.9.2342.19200300.100.1.3":                                  {"alice@example.com"},
+		"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress": {"alice@example.com", "alice@example.org"},
+		"http://schemas.xmlsoap.org/claims/Group":                            {"sre"},
+		"Department": {"ops"},
+		"UID":        {"alice"},
+		"present":    {},
+	}
+	tests := []struct {
+		name   string
+		config AttributesConfig
+		want   samlsp.Attributes
+	}{{
+		name:   "Builtin",
+		config: AttributesConfig{},
+		want: samlsp.Attributes{
+			"mail":       {"alice@example.com", "alice@example.org"},
+			"groups":     {"sre"},
+			"Department": {"ops"},
+			"UID":        {"alice"},
+			"present":    {},
+		},
+	}, {
+		name: "UserAliases",
+		config: AttributesConfig{Aliases: map[string][]string{
+			"dept":  {"Department", "ou"},
+			"group": {"http://schemas.xmlsoap.org/claims/Group"},
+		}},
+		want: samlsp.Attributes{
+			"mail":    {"alice@example.com", "alice@example.org"},
+			"group":   {"sre"},
+			"dept":    {"ops"},
+			"UID":     {"alice"},
+			"present": {},
+		},
+	}, {
+		name:   "NoBuiltin",
+		config: AttributesConfig{NoBuiltinAliases: true, Aliases: map[string][]string{"uid": nil}},
+		want:   attributes,
+	}, {
+		name: "CaseInsensitive",
+		config: AttributesConfig{
+			Aliases:         map[string][]string{"dept": {"department"}},
+			CaseInsensitive: true,
+		},
+		want: samlsp.Attributes{
+			"mail":    {"alice@example.com", "alice@example.org"},
+			"groups":  {"sre"},
+			"dept":    {"ops"},
+			"uid":     {"alice"},
+			"present": {},
+		},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mustNewAliases(tt.config).normalize(attributes)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Aliases.normalize() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewAliasesErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config AttributesConfig
+		want   string
+	}{{
+		name:   "EmptyName",
+		config: AttributesConfig{Aliases: map[string][]string{"": {"x"}}},
+		want:   "aliases: empty attribute name",
+	}, {
+		name:   "EmptyAlias",
+		config: AttributesConfig{Aliases: map[string][]string{"dept": {""}}},
+		want:   "aliases: dept: empty alias",
+	}, {
+		name: "Duplicate",
+		config: AttributesConfig{
+			Aliases:         map[string][]string{"dept": {"ou"}, "unit": {"OU"}},
+			CaseInsensitive: true,
+		},
+		want: `aliases: unit: "OU" is already alias of dept`,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewAliases(tt.config)
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("NewAliases() error = %v, want %s", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthHandlerAliases(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/saml/auth", nil)
+	res := httptest.NewRecorder()
+
+	// policy and headers use canonical name of email attribute
+	s := fakeAuthService(&validUser{}, nil)
+	s.Reload(&Settings{
+		ACL: mustNewACL([]requirement{{"mail suffix": "@example.com"}}, nil),
+	})
+
+	s.Auth(res, req)
+
+	if got, want := res.Code, http.StatusAccepted; got != want {
+		t.Errorf("got status %d but wanted %d", got, want)
+	}
+	if got, want := res.Header().Get("X-Auth-Request-Email"), "alice@example.com"; got != want {
+		t.Errorf("got header X-Auth-Request-Email %s but wanted %s", got, want)
+	}
+}
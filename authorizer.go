@@ -5,63 +5,95 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/crewjam/saml/samlsp"
 	"go.uber.org/zap"
 )
 
-// Config for Authorizer
-type Config struct {
-	EntityID            string
-	URL                 string
-	KeyFile             string
-	CertificateFile     string
-	AllowIDPInitiated   bool
-	DefaultRedirectURI  string
-	IDPMetadataURL      string
-	SignRequest         bool
-	UseArtifactResponse bool
-	ForceAuthn          bool
-	Addr                string
-	RequireAttribute    []requirement
-}
-
 // AuthService authorizes users using SAML
 type AuthService struct {
-	SP                 samlsp.SessionProvider
-	M                  *samlsp.Middleware
-	RootURL            *url.URL
-	RequiredAttributes []requirement
-	Log                *zap.Logger
+	SP      samlsp.SessionProvider
+	M       *samlsp.Middleware
+	RootURL *url.URL
+	Log     *zap.Logger
+	Revoker *Revoker
+	// IDPs users choose from, M serves metadata only when set
+	IDPs []*IDP
+	// Tenant name, empty for top level service provider
+	Tenant string
+	// Tenants of top level service provider, their settings are reloaded
+	// with its own
+	Tenants []*Tenant
+
+	settings atomic.Value // *Settings
+	// idpMu guards IdP metadata of M and IDPs replaced by refresh
+	idpMu sync.RWMutex
 }
 
 // Auth handler
 func (s *AuthService) Auth(w http.ResponseWriter, r *http.Request) {
-	attributes, err := s.getAttributes(r)
+	session, attributes, err := s.getSession(r)
 	if err != nil {
 		s.httpError(w, r, http.StatusUnauthorized)
 		return
 	}
 
 	// First check if we are allowed to process request
-	if !s.checkACL(attributes) {
+	st := s.Settings()
+	_, issued, _ := sessionInfo(session)
+	decision, e := s.decide(st, r, attributes, issued)
+	if st.Explainer.showHeader(e) {
+		w.Header().Set(decisionHeader, decision.String())
+	}
+	if !decision.Allowed {
+		s.logDecision(r, decision)
 		s.httpError(w, r, http.StatusUnauthorized)
 		return
 	}
 
+	// Active session is extended by idle timeout
+	if renewer, ok := s.SP.(sessionRenewer); ok {
+		if err := renewer.RenewSession(w, r, session); err != nil {
+			s.Log.Warn("session renewal", zap.Error(err))
+		}
+	}
+
 	// Second pass attributes as headers
-	for name := range attributes {
-		for _, v := range attributes[name] {
-			w.Header().Add("X-"+name, v)
+	identity, rejected := st.Headers.set(w.Header(), attributes)
+	if len(rejected) > 0 {
+		s.Log.Warn("attribute values not representable in headers",
+			zap.String("originalUrl", decision.URL),
+			zap.Strings("attributes", rejected),
+		)
+	}
+	pdpHeaders, refused := st.Headers.setDecision(w.Header(), decision.headers, identity)
+	if len(refused) > 0 {
+		s.Log.Warn("policy decision point headers refused",
+			zap.String("originalUrl", decision.URL),
+			zap.Strings("headers", refused),
+		)
+	}
+	identity = append(identity, pdpHeaders...)
+	if st.Token != nil {
+		if err := st.Token.set(w.Header(), attributes, e.request["host"]); err != nil {
+			s.Log.Error("upstream token", zap.Error(err))
+			s.httpError(w, r, http.StatusInternalServerError)
+			return
 		}
 	}
+	if st.Signer != nil {
+		st.Signer.set(w.Header(), e.request["host"], identity)
+	}
 
 	s.httpStatus(w, r, http.StatusAccepted)
 }
 
 // Signin handler
 func (s *AuthService) Signin(w http.ResponseWriter, r *http.Request) {
-	attributes, err := s.getAttributes(r)
+	session, attributes, err := s.getSession(r)
 	if err != nil {
 		if err == samlsp.ErrNoSession {
 			// We expect most of the time to go here as this is signin handler
@@ -72,8 +104,15 @@ func (s *AuthService) Signin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Session is too old for policy of requested URL, sign in again
+	_, issued, _ := sessionInfo(session)
+	if s.Settings().ACL.Lookup(s.originalURL(r)).stale(issued, time.Now()) {
+		s.startAuthFlow(w, r)
+		return
+	}
+
 	// Not strictly necessary but for user convince we check ACL
-	if !s.checkACL(attributes) {
+	if !s.checkACL(r, attributes) {
 		s.httpError(w, r, http.StatusForbidden)
 		return
 	}
@@ -101,15 +140,39 @@ func (s *AuthService) Whoami(w http.ResponseWriter, r *http.Request) {
 var errNoAttributes = errors.New("saml: attributes not present")
 
 func (s *AuthService) getAttributes(r *http.Request) (samlsp.Attributes, error) {
+	_, attributes, err := s.getSession(r)
+	return attributes, err
+}
+
+func (s *AuthService) getSession(r *http.Request) (samlsp.Session, samlsp.Attributes, error) {
 	session, err := s.SP.GetSession(r)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	attributes, err := s.sessionAttributes(r, session)
+	if err != nil {
+		return nil, nil, err
+	}
+	return session, attributes, nil
+}
+
+// sessionAttributes returns normalized attributes of session, revoked
+// sessions are treated as missing
+func (s *AuthService) sessionAttributes(r *http.Request, session samlsp.Session) (samlsp.Attributes, error) {
+	if s.Revoker != nil {
+		revoked, err := s.Revoker.Revoked(r.Context(), session)
+		if err != nil {
+			return nil, err
+		}
+		if revoked {
+			return nil, samlsp.ErrNoSession
+		}
 	}
 	sa, ok := session.(samlsp.SessionWithAttributes)
 	if !ok {
 		return nil, errNoAttributes
 	}
-	return sa.GetAttributes(), nil
+	return s.Settings().Aliases.normalize(sa.GetAttributes()), nil
 }
 
 func (s *AuthService) startAuthFlow(w http.ResponseWriter, r *http.Request) {
@@ -128,8 +191,26 @@ func (s *AuthService) startAuthFlow(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	s.idpMu.RLock()
+	defer s.idpMu.RUnlock()
+
+	m := s.M
+	if len(s.IDPs) > 0 {
+		idp, message := s.selectIDP(query, cleanURL.Hostname())
+		if idp == nil {
+			s.discovery(w, r, rd, message)
+			return
+		}
+		m = idp.M
+	}
+	if m.ServiceProvider.IDPMetadata == nil {
+		// IdP metadata was not loaded yet, refresh keeps trying
+		s.httpError(w, r, http.StatusServiceUnavailable)
+		return
+	}
+
 	r.URL = cleanURL
-	s.M.HandleStartAuthFlow(w, r)
+	m.HandleStartAuthFlow(w, r)
 }
 
 func (s *AuthService) httpError(w http.ResponseWriter, r *http.Request, code int) {
@@ -147,22 +228,15 @@ func (s *AuthService) httpStatus(w http.ResponseWriter, r *http.Request, code in
 	w.WriteHeader(code)
 }
 
-func (s *AuthService) checkACL(attributes samlsp.Attributes) bool {
-	// Session with no attributes but configuration explicitly required some
-	if len(attributes) == 0 && len(s.RequiredAttributes) > 0 {
-		return false
-	}
-	// No required attributes so we can skip checking
-	if len(s.RequiredAttributes) == 0 {
-		return true
-	}
-	return aclCheckOR(attributes, s.RequiredAttributes)
+func (s *AuthService) checkACL(r *http.Request, attributes samlsp.Attributes) bool {
+	u := s.originalURL(r)
+	st := s.Settings()
+	e := newEnv(r, u, attributes)
+	return st.checkIDP(st.ACL.Lookup(u).decide(e), e).Allowed
 }
 
-type requirement map[string]string
-
-func aclCheckOR(attributes samlsp.Attributes, requirements []requirement) bool {
-	for _, r := range requirements {
+func aclCheckOR(attributes samlsp.Attributes, rules []rule) bool {
+	for _, r := range rules {
 		if aclCheckAND(attributes, r) {
 			return true
 		}
@@ -170,17 +244,11 @@ func aclCheckOR(attributes samlsp.Attributes, requirements []requirement) bool {
 	return false
 }
 
-func aclCheckAND(attributes samlsp.Attributes, r requirement) bool {
-next:
-	for name, want := range r {
-		if values, ok := attributes[name]; ok {
-			for _, got := range values {
-				if got == want {
-					continue next
-				}
-			}
+func aclCheckAND(attributes samlsp.Attributes, r rule) bool {
+	for _, c := range r {
+		if !c.match(attributes[c.name]) {
+			return false
 		}
-		return false
 	}
 	return true
 }
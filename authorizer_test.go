@@ -16,7 +16,7 @@ import (
 
 func fakeAuthService(sp samlsp.SessionProvider, r []requirement) *AuthService {
 	rootURL, _ := url.Parse("http://example.com")
-	return &AuthService{
+	s := &AuthService{
 		SP: sp,
 		M: &samlsp.Middleware{
 			ServiceProvider: saml.ServiceProvider{
@@ -33,10 +33,11 @@ func fakeAuthService(sp samlsp.SessionProvider, r []requirement) *AuthService {
 			RequestTracker: &fakeRequestTracker{},
 			// Session:     sp,
 		},
-		RequiredAttributes: r,
-		RootURL:            rootURL,
-		Log:                zap.NewNop(),
+		RootURL: rootURL,
+		Log:     zap.NewNop(),
 	}
+	s.Reload(&Settings{ACL: mustNewACL(r, nil)})
+	return s
 }
 
 func TestAuthHandlerWithoutSession(t *testing.T) {
@@ -88,9 +89,88 @@ func TestAuthHandlerSuccess(t *testing.T) {
 		t.Errorf("got status %d but wanted %d", got, want)
 	}
 
-	header, expect := res.Header().Get("X-Name"), "Alice"
-	if header != expect {
-		t.Errorf("got header X-Name %s but wanted %s", header, expect)
+	// attributes are not forwarded unless mapped or allowed
+	if header := res.Header().Get("X-Name"); header != "" {
+		t.Errorf("got header X-Name %s but wanted none", header)
+	}
+}
+
+func TestAuthHandlerAliasNames(t *testing.T) {
+	// session has email attribute normalized to mail, policies written
+	// with any name of the attribute match it
+	tests := []struct {
+		name   string
+		config func(c *Config)
+		want   int
+	}{{
+		name:   "Requirement",
+		config: func(c *Config) { c.RequiredAttributes = []requirement{{"email": "alice@example.com"}} },
+		want:   http.StatusAccepted,
+	}, {
+		name:   "RequirementOperator",
+		config: func(c *Config) { c.RequiredAttributes = []requirement{{"emailAddress suffix": "@example.com"}} },
+		want:   http.StatusAccepted,
+	}, {
+		name:   "Expression",
+		config: func(c *Config) { c.Expression = `has(email) && email == "alice@example.com"` },
+		want:   http.StatusAccepted,
+	}, {
+		name:   "ExpressionDenied",
+		config: func(c *Config) { c.Expression = `email == "bob@example.com"` },
+		want:   http.StatusUnauthorized,
+	}, {
+		name: "HostPolicy",
+		config: func(c *Config) {
+			c.Policies = []Policy{{Host: "example.com", Expression: `email in ["alice@example.com"]`}}
+		},
+		want: http.StatusAccepted,
+	}, {
+		name: "CaseInsensitive",
+		config: func(c *Config) {
+			c.Attributes = AttributesConfig{CaseInsensitive: true}
+			c.RequiredAttributes = []requirement{{"EMAIL": "alice@example.com"}}
+		},
+		want: http.StatusAccepted,
+	}, {
+		name: "CaseInsensitiveListed",
+		config: func(c *Config) {
+			c.Attributes = AttributesConfig{CaseInsensitive: true, Aliases: map[string][]string{"group": {}}}
+			c.RequiredAttributes = []requirement{{"GROUP": "users"}}
+		},
+		want: http.StatusAccepted,
+	}, {
+		name: "UserAlias",
+		config: func(c *Config) {
+			c.Attributes = AttributesConfig{Aliases: map[string][]string{"department": {"dept"}}}
+			c.RequiredAttributes = []requirement{{"dept absent": ""}, {"mail": "alice@example.com"}}
+		},
+		want: http.StatusAccepted,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := validConfig()
+			tt.config(c)
+			st, err := NewSettings(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := fakeAuthService(&validUser{}, nil)
+			s.Reload(st)
+
+			res := httptest.NewRecorder()
+			s.Auth(res, httptest.NewRequest(http.MethodGet, "/saml/auth", nil))
+			if res.Code != tt.want {
+				t.Errorf("Auth() status = %d, want %d", res.Code, tt.want)
+			}
+		})
+	}
+
+	// test services built without NewSettings resolve names too
+	s := fakeAuthService(&validUser{}, []requirement{{"email": "alice@example.com"}})
+	res := httptest.NewRecorder()
+	s.Auth(res, httptest.NewRequest(http.MethodGet, "/saml/auth", nil))
+	if res.Code != http.StatusAccepted {
+		t.Errorf("Auth() status = %d, want %d", res.Code, http.StatusAccepted)
 	}
 }
 
@@ -261,7 +341,7 @@ func TestGetAttributes(t *testing.T) {
 		service: fakeAuthService(&validUser{}, nil),
 		want: samlsp.Attributes{
 			"name":  []string{"Alice"},
-			"email": []string{"alice@example.com"},
+			"mail":  []string{"alice@example.com"}, // builtin alias of email
 			"group": []string{"users"},
 		},
 		wantErr: false,
@@ -358,13 +438,14 @@ func TestCheckACL(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			s := &AuthService{
-				SP:                 tt.fields.sp,
-				M:                  tt.fields.m,
-				RootURL:            tt.fields.rootURL,
-				RequiredAttributes: tt.fields.requiredAttributes,
-				Log:                tt.fields.log,
+				SP:      tt.fields.sp,
+				M:       tt.fields.m,
+				RootURL: tt.fields.rootURL,
+				Log:     tt.fields.log,
 			}
-			if got := s.checkACL(tt.args.attributes); got != tt.want {
+			s.Reload(&Settings{ACL: mustNewACL(tt.fields.requiredAttributes, nil)})
+			req := httptest.NewRequest(http.MethodGet, "/saml/auth", nil)
+			if got := s.checkACL(req, tt.args.attributes); got != tt.want {
 				t.Errorf("authService.checkACL() = %v, want %v", got, tt.want)
 			}
 		})
@@ -447,7 +528,7 @@ func TestAclCheckOR(t *testing.T) {
 	}}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := aclCheckOR(tt.args.attributes, tt.args.requirements); got != tt.want {
+			if got := aclCheckOR(tt.args.attributes, mustCompileRequirements(tt.args.requirements)); got != tt.want {
 				t.Errorf("aclCheckOR() = %v, want %v", got, tt.want)
 			}
 		})
@@ -545,13 +626,39 @@ func TestAclCheckAND(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := aclCheckAND(tt.args.attributes, tt.args.r); got != tt.want {
+			if got := aclCheckAND(tt.args.attributes, mustCompileRequirement(tt.args.r)); got != tt.want {
 				t.Errorf("aclCheckAND() = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
 
+func mustNewACL(required []requirement, policies []Policy) *ACL {
+	acl, err := NewACL(Policy{RequiredAttributes: required}, policies)
+	if err != nil {
+		panic(err)
+	}
+	// like NewSettings with builtin aliases
+	acl.canonical(nil)
+	return acl
+}
+
+func mustCompileRequirements(requirements []requirement) []rule {
+	rules, err := compileRequirements(requirements)
+	if err != nil {
+		panic(err)
+	}
+	return rules
+}
+
+func mustCompileRequirement(r requirement) rule {
+	compiled, err := compileRequirement(r)
+	if err != nil {
+		panic(err)
+	}
+	return compiled
+}
+
 type invalidUser struct{}
 
 func (u *invalidUser) CreateSession(w http.ResponseWriter, r *http.Request, assertion *saml.Assertion) error {
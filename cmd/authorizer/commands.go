@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/crewjam/saml"
+	"go.uber.org/zap"
+
+	authorizer "github.com/dzeromsk/ingress-saml-authorizer"
+)
+
+// checkConfig loads and validates everything needed to start the server
+// and prints a summary, returns process exit code
+func checkConfig(w io.Writer) int {
+	fail := func(step string, err error) int {
+		fmt.Fprintf(w, "FAIL %s\n", step)
+		var errs authorizer.ConfigError
+		if errors.As(err, &errs) {
+			for _, e := range errs {
+				fmt.Fprintf(w, "  %s\n", e)
+			}
+		} else {
+			fmt.Fprintf(w, "  %v\n", err)
+		}
+		return 1
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return fail("config "+*configFile, err)
+	}
+
+	s, code := checkServiceProvider(w, config, authorizer.TenantConfig{}, fail)
+	if s == nil {
+		return code
+	}
+	var tenants []*authorizer.AuthService
+	for _, t := range config.Tenants {
+		ts, code := checkServiceProvider(w, config.Tenant(t), t, fail)
+		if ts == nil {
+			return code
+		}
+		tenants = append(tenants, ts)
+	}
+
+	fmt.Fprintf(w, "Policies\n")
+	for _, p := range s.Settings().ACL.Describe() {
+		fmt.Fprintf(w, "  %s\n", p)
+	}
+	for _, p := range s.Settings().DescribeIDPPolicies() {
+		fmt.Fprintf(w, "  %s\n", p)
+	}
+	for _, ts := range tenants {
+		for _, p := range ts.Settings().DescribeIDPPolicies() {
+			fmt.Fprintf(w, "  tenant %s %s\n", ts.Tenant, p)
+		}
+	}
+	if config.PDP != nil {
+		fmt.Fprintf(w, "  pdp: %s (fail open: %t)\n", config.PDP.URL, config.PDP.FailOpen)
+	}
+	if c := config.Session; c != nil && (c.Store != "" || c.Revocations != "") {
+		store := c.Store
+		if store == "" {
+			store = "cookie"
+		}
+		fmt.Fprintf(w, "Sessions\n")
+		fmt.Fprintf(w, "  store:       %s\n", store)
+		if c.Revocations != "" {
+			fmt.Fprintf(w, "  revocations: %s\n", c.Revocations)
+		}
+	}
+	if t := s.Settings().Token; t != nil {
+		fmt.Fprintf(w, "Upstream token\n")
+		fmt.Fprintf(w, "  header:      %s\n", t.Header())
+		fmt.Fprintf(w, "  key:         %s %s\n", t.Algorithm(), t.KeyID())
+	}
+
+	fmt.Fprintf(w, "OK\n")
+	return 0
+}
+
+// checkServiceProvider loads key pair and IdP metadata of service provider
+// for config of tenant t, empty for top level one, and prints them;
+// returns nil service and exit code of fail on error
+func checkServiceProvider(w io.Writer, config *authorizer.Config, t authorizer.TenantConfig, fail func(string, error) int) (*authorizer.AuthService, int) {
+	tenant := t.Name
+	step := func(name string) string {
+		if tenant != "" {
+			return "tenant " + tenant + " " + name
+		}
+		return name
+	}
+
+	sp, err := newMiddleware(config, tenant)
+	if err != nil {
+		return nil, fail(step("key pair"), err)
+	}
+
+	idps := config.IDPs
+	if len(idps) == 0 {
+		idps = []authorizer.IDPConfig{{}}
+	}
+	mds := make([]*saml.EntityDescriptor, len(idps))
+	var warnings []string
+	for i, c := range idps {
+		src := config.MetadataSource(c.Name)
+		mds[i], err = src.Fetch(context.Background())
+		if err != nil && src.URL != "" {
+			// startup falls back to cache too
+			if cached, cerr := src.Cached(); cerr == nil {
+				warnings = append(warnings, fmt.Sprintf("%s: using cached metadata, %v", src, err))
+				mds[i], err = cached, nil
+			}
+		}
+		if err != nil {
+			return nil, fail(step("idp metadata "+src.String()), err)
+		}
+		if _, err := authorizer.IDPSigningCertificates(mds[i]); err != nil {
+			return nil, fail(step("idp certificates "+src.String()), err)
+		}
+	}
+
+	s, err := newAuthService(config, zap.NewNop())
+	if err != nil {
+		return nil, fail(step("policies"), err)
+	}
+	s.Tenant = tenant
+
+	fmt.Fprintf(w, "%s\n", strings.TrimSpace("Service provider "+tenant))
+	fmt.Fprintf(w, "  entity id:   %s\n", sp.ServiceProvider.Metadata().EntityID)
+	fmt.Fprintf(w, "  acs url:     %s\n", sp.ServiceProvider.AcsURL.String())
+	fmt.Fprintf(w, "  metadata:    %s\n", sp.ServiceProvider.MetadataURL.String())
+	if len(t.Hosts) > 0 {
+		fmt.Fprintf(w, "  hosts:       %s\n", strings.Join(t.Hosts, ", "))
+	}
+	printCertificate(w, sp.ServiceProvider.Certificate.Subject.String(), sp.ServiceProvider.Certificate.NotAfter)
+
+	for i, md := range mds {
+		fmt.Fprintf(w, "%s\n", strings.TrimSpace("Identity provider "+idps[i].Name))
+		fmt.Fprintf(w, "  entity id:   %s\n", md.EntityID)
+		if config.MetadataSource(idps[i].Name).Signing != nil {
+			fmt.Fprintf(w, "  metadata:    signed with pinned certificate\n")
+		}
+		for _, idp := range md.IDPSSODescriptors {
+			for _, e := range idp.SingleSignOnServices {
+				fmt.Fprintf(w, "  sso:         %s %s\n", e.Binding, e.Location)
+			}
+		}
+		certs, _ := authorizer.IDPSigningCertificates(md)
+		for _, c := range certs {
+			printCertificate(w, c.Subject.String(), c.NotAfter)
+		}
+	}
+	for _, warning := range warnings {
+		fmt.Fprintf(w, "  warning:     %s\n", warning)
+	}
+	return s, 0
+}
+
+func printCertificate(w io.Writer, subject string, notAfter time.Time) {
+	left := time.Until(notAfter)
+	status := fmt.Sprintf("expires in %d days", int(left.Hours()/24))
+	if left <= 0 {
+		status = "EXPIRED"
+	}
+	fmt.Fprintf(w, "  certificate: %s, not after %s (%s)\n", subject, notAfter.Format(time.RFC3339), status)
+}
+
+// testPolicy runs offline policy tests from files against policies in
+// config, external policy decision point is not consulted. Returns process
+// exit code.
+func testPolicy(w io.Writer, files []string) int {
+	if len(files) == 0 {
+		fmt.Fprintf(w, "test-policy: no test files\n")
+		return 2
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(w, "FAIL config %s\n  %v\n", *configFile, err)
+		return 1
+	}
+
+	config.PDP = nil
+	s, err := newAuthService(config, zap.NewNop())
+	if err != nil {
+		fmt.Fprintf(w, "FAIL policies\n  %v\n", err)
+		return 1
+	}
+
+	var tests []authorizer.PolicyTest
+	for _, name := range files {
+		t, err := authorizer.LoadPolicyTests(name)
+		if err != nil {
+			fmt.Fprintf(w, "FAIL tests\n  %v\n", err)
+			return 1
+		}
+		tests = append(tests, t...)
+	}
+
+	if s.RunPolicyTests(tests, w) > 0 {
+		return 1
+	}
+	return 0
+}
@@ -6,15 +6,21 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/xml"
+	"errors"
 	"flag"
+	"fmt"
+	"io/fs"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/crewjam/saml"
 	"github.com/crewjam/saml/samlsp"
 	"go.uber.org/zap"
-	"gopkg.in/yaml.v3"
 
 	authorizer "github.com/dzeromsk/ingress-saml-authorizer"
 )
@@ -22,50 +28,232 @@ import (
 var (
 	configFile    = flag.String("config", "config.yaml", "Path to config file")
 	printMetadata = flag.Bool("print-metadata", false, "Print metadata on stdout and exit")
+	printTenant   = flag.String("tenant", "", "Tenant whose metadata -print-metadata prints")
+	watchInterval = flag.Duration("watch-interval", 10*time.Second, "How often to check config file for changes, 0 disables (SIGHUP still reloads)")
+
+	overrides = authorizer.Overrides{}
 )
 
+func init() {
+	overrides.RegisterFlags(flag.CommandLine)
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [command]\n\n", os.Args[0])
+	fmt.Fprintf(flag.CommandLine.Output(), "Commands:\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  check-config\tvalidate config, key pair, IdP metadata and policies and exit\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  test-policy FILE...\trun policy test cases from YAML or JSON files and exit\n\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "Every config key can be set with a flag named after the key or with\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "%sKEY environment variable (dots replaced by underscores); with\n", authorizer.EnvPrefix)
+	fmt.Fprintf(flag.CommandLine.Output(), "%sKEY_FILE the value is read from file. Flags take precedence over\n", authorizer.EnvPrefix)
+	fmt.Fprintf(flag.CommandLine.Output(), "environment which takes precedence over config file. Config file is\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "optional when -config is not given and default file does not exist.\n\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "Flags:\n")
+	flag.PrintDefaults()
+}
+
 func main() {
+	flag.Usage = usage
 	flag.Parse()
 
+	if !flagSet("config") {
+		if _, err := os.Stat(*configFile); errors.Is(err, fs.ErrNotExist) {
+			*configFile = ""
+		}
+	}
+
+	switch flag.Arg(0) {
+	case "":
+	case "check-config":
+		os.Exit(checkConfig(os.Stdout))
+	case "test-policy":
+		os.Exit(testPolicy(os.Stdout, flag.Args()[1:]))
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
 	logger, err := zap.NewProduction()
 	if err != nil {
 		log.Fatalln("can't initialize zap logger:", err)
 	}
 	defer logger.Sync()
 
-	f, err := os.Open(*configFile)
+	config, err := loadConfig()
 	if err != nil {
-		logger.Error("setup", zap.Error(err))
+		var errs authorizer.ConfigError
+		if errors.As(err, &errs) {
+			logger.Fatal("setup", zap.Strings("errors", errs))
+		}
+		logger.Fatal("setup", zap.Error(err))
+	}
+
+	if *printMetadata {
+		// Usefull for helm installation hook jobs to autoregister our SP
+		c, tenant := config, ""
+		if *printTenant != "" {
+			t, ok := findTenant(config, *printTenant)
+			if !ok {
+				logger.Fatal("setup", zap.String("tenant", *printTenant), zap.Error(errors.New("no such tenant")))
+			}
+			c, tenant = config.Tenant(t), t.Name
+		}
+		sp, err := newMiddleware(c, tenant)
+		if err != nil {
+			logger.Fatal("setup", zap.Error(err))
+		}
+		buf, _ := xml.MarshalIndent(sp.ServiceProvider.Metadata(), "", "  ")
+		os.Stdout.Write(buf)
+		return
 	}
-	defer f.Close()
 
-	d := yaml.NewDecoder(f)
+	// log.Println("Config:")
+	// spew.Dump(config)
 
-	var config authorizer.Config
-	if err := d.Decode(&config); err != nil {
-		logger.Error("setup", zap.Error(err))
+	s, err := newService(config, "", logger)
+	if err != nil {
+		logger.Fatal("setup", zap.Error(err))
 	}
+	mux := http.NewServeMux()
+	handle(mux, s, "/saml/")
 
-	keyPair, err := tls.LoadX509KeyPair(config.CertificateFile, config.KeyFile)
+	// tenants share logger and listener, everything else is their own
+	for _, t := range config.Tenants {
+		ts, err := newService(config.Tenant(t), t.Name, logger.With(zap.String("tenant", t.Name)))
+		if err != nil {
+			logger.Fatal("setup", zap.String("tenant", t.Name), zap.Error(err))
+		}
+		tmux := http.NewServeMux()
+		handle(tmux, ts, "/saml/")
+		handle(tmux, ts, "/saml/"+t.Name+"/")
+		s.Tenants = append(s.Tenants, authorizer.NewTenant(t, ts, tmux))
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go s.WatchConfig(context.Background(), *configFile, loadConfig, config, *watchInterval, hup)
+
+	mux.HandleFunc("/readyz", s.Ready)
+	http.Handle("/", s.TenantHandler(mux))
+
+	logger.Info("Listening", zap.String("addr", config.Addr))
+	if err := http.ListenAndServe(config.Addr, nil); err != nil {
+		logger.Fatal("Listening", zap.Error(err))
+	}
+}
+
+// newService returns service provider for config with IdP metadata
+// fetched, tenant endpoints are under /saml/<tenant>/
+func newService(config *authorizer.Config, tenant string, logger *zap.Logger) (*authorizer.AuthService, error) {
+	sp, err := newMiddleware(config, tenant)
 	if err != nil {
-		logger.Error("setup", zap.Error(err))
+		return nil, err
 	}
-	keyPair.Leaf, err = x509.ParseCertificate(keyPair.Certificate[0])
+
+	s, err := newAuthService(config, logger)
 	if err != nil {
-		logger.Error("setup", zap.Error(err))
+		return nil, err
 	}
+	s.SP = sp.Session
+	s.M = sp
+	s.Tenant = tenant
 
-	idpMetadataURL, err := url.Parse(config.IDPMetadataURL)
+	if len(config.IDPs) == 0 {
+		sp.ServiceProvider.IDPMetadata, err = loadIDPMetadata(config.MetadataSource(""), "", logger)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, c := range config.IDPs {
+		md, err := loadIDPMetadata(config.MetadataSource(c.Name), c.Name, logger)
+		if err != nil {
+			return nil, fmt.Errorf("idp %s: %w", c.Name, err)
+		}
+		s.IDPs = append(s.IDPs, authorizer.NewIDP(c, sp, md))
+	}
+
+	s.Revoker, err = authorizer.NewRevoker(config.Session, sp.Session)
 	if err != nil {
-		logger.Error("setup", zap.Error(err))
+		return nil, err
+	}
+
+	// IdP signing certificate rollover is picked up without restart,
+	// metadata missing at startup is fetched as soon as IdP is back
+	names := []string{""}
+	if len(config.IDPs) > 0 {
+		names = nil
+		for _, c := range config.IDPs {
+			names = append(names, c.Name)
+		}
+	}
+	for _, name := range names {
+		if src := config.MetadataSource(name); !src.Static() {
+			go s.RefreshIDPMetadata(context.Background(), name, src.Fetch, config.MetadataRefresh)
+		}
+	}
+	return s, nil
+}
+
+// handle registers endpoints of s under prefix
+func handle(mux *http.ServeMux, s *authorizer.AuthService, prefix string) {
+	mux.HandleFunc(prefix+"auth", s.Auth)
+	mux.HandleFunc(prefix+"signin", s.Signin)
+	mux.HandleFunc(prefix+"signout", s.Signout)
+	mux.HandleFunc(prefix+"whoami", s.Whoami)
+	mux.HandleFunc(prefix+"explain", s.Explain)
+	mux.HandleFunc(prefix+"jwks.json", s.JWKS)
+	mux.HandleFunc(prefix+"admin/", s.Admin)
+	mux.HandleFunc(prefix, s.SAML)
+}
+
+func findTenant(config *authorizer.Config, name string) (authorizer.TenantConfig, bool) {
+	for _, t := range config.Tenants {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return authorizer.TenantConfig{}, false
+}
+
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// loadConfig reads config file with environment and flag overrides applied
+func loadConfig() (*authorizer.Config, error) {
+	env, err := authorizer.EnvOverrides(os.Environ())
+	if err != nil {
+		return nil, err
+	}
+	return authorizer.LoadConfig(*configFile, env, overrides)
+}
+
+func newMiddleware(config *authorizer.Config, tenant string) (*samlsp.Middleware, error) {
+	keyPair, err := tls.LoadX509KeyPair(config.CertificateFile, config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	keyPair.Leaf, err = x509.ParseCertificate(keyPair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	key, ok := keyPair.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("keyfile must contain RSA private key")
 	}
 
 	rootURL, err := url.Parse(config.URL)
 	if err != nil {
-		logger.Error("setup", zap.Error(err))
+		return nil, err
 	}
 
-	sp, _ := samlsp.New(samlsp.Options{
+	m, err := samlsp.New(samlsp.Options{
 		EntityID:            config.EntityID,
 		AllowIDPInitiated:   config.AllowIDPInitiated,
 		DefaultRedirectURI:  config.DefaultRedirectURI,
@@ -73,43 +261,67 @@ func main() {
 		UseArtifactResponse: config.UseArtifactResponse,
 		ForceAuthn:          config.ForceAuthn,
 		URL:                 *rootURL,
-		Key:                 keyPair.PrivateKey.(*rsa.PrivateKey),
+		Key:                 key,
 		Certificate:         keyPair.Leaf,
 		// IDPMetadata:         idpMetadata,
 	})
+	if err != nil {
+		return nil, err
+	}
 
-	if *printMetadata {
-		// Usefull for helm installation hook jobs to autoregister our SP
-		buf, _ := xml.MarshalIndent(sp.ServiceProvider.Metadata(), "", "  ")
-		os.Stdout.Write(buf)
-		return
+	// endpoints of tenant are under /saml/<tenant>/, IdP sends logout
+	// requests and responses to Signout handler
+	base := "saml/"
+	if tenant != "" {
+		base += tenant + "/"
 	}
+	m.ServiceProvider.MetadataURL = *rootURL.ResolveReference(&url.URL{Path: base + "metadata"})
+	m.ServiceProvider.AcsURL = *rootURL.ResolveReference(&url.URL{Path: base + "acs"})
+	m.ServiceProvider.SloURL = *rootURL.ResolveReference(&url.URL{Path: base + "signout"})
 
-	// log.Println("Config:")
-	// spew.Dump(config)
+	m.Session, err = authorizer.NewSessionProvider(config.Session, config.Cookie, m.Session.(samlsp.CookieSessionProvider))
+	if err != nil {
+		return nil, fmt.Errorf("session: %w", err)
+	}
+	m.RequestTracker = authorizer.NewRequestTracker(config.Cookie, m.RequestTracker.(samlsp.CookieRequestTracker))
+	return m, nil
+}
 
-	logger.Info("Fetching IdP metadata", zap.String("url", idpMetadataURL.String()))
+// loadIDPMetadata returns metadata of IdP named idp from src, cached
+// metadata when URL can not be fetched and nil when there is none, the
+// service is not ready until refresh fetches it. Unreadable file or
+// inline metadata is an error.
+func loadIDPMetadata(src authorizer.MetadataSource, idp string, logger *zap.Logger) (*saml.EntityDescriptor, error) {
+	logger.Info("Fetching IdP metadata", zap.String("idp", idp), zap.Stringer("source", src))
+	md, err := src.Fetch(context.Background())
+	if err == nil || src.URL == "" {
+		return md, err
+	}
+	if cached, cerr := src.Cached(); cerr == nil {
+		logger.Warn("IdP metadata fetch failed, using cached metadata", zap.String("idp", idp), zap.Error(err))
+		return cached, nil
+	} else if src.Cache != "" {
+		logger.Warn("IdP metadata cache", zap.String("idp", idp), zap.Error(cerr))
+	}
+	logger.Error("IdP metadata fetch failed, not ready until it is fetched", zap.String("idp", idp), zap.Error(err))
+	return nil, nil
+}
 
-	sp.ServiceProvider.IDPMetadata, err = samlsp.FetchMetadata(
-		context.Background(), http.DefaultClient, *idpMetadataURL)
+func newAuthService(config *authorizer.Config, logger *zap.Logger) (*authorizer.AuthService, error) {
+	settings, err := authorizer.NewSettings(config)
 	if err != nil {
-		logger.Error("setup", zap.Error(err))
+		return nil, err
 	}
 
-	s := &authorizer.AuthService{
-		SP:                 sp.Session,
-		M:                  sp,
-		RootURL:            rootURL,
-		RequiredAttributes: config.RequireAttribute,
-		Log:                logger,
+	rootURL, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, err
 	}
-	http.HandleFunc("/saml/auth", s.Auth)
-	http.HandleFunc("/saml/signin", s.Signin)
-	http.HandleFunc("/saml/whoami", s.Whoami)
-	http.Handle("/saml/", sp)
 
-	logger.Info("Listening", zap.String("addr", config.Addr))
-	if err := http.ListenAndServe(config.Addr, nil); err != nil {
-		logger.Error("Listening", zap.Error(err))
+	s := &authorizer.AuthService{
+		RootURL: rootURL,
+		Log:     logger,
 	}
+	s.Reload(settings)
+	return s, nil
 }
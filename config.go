@@ -0,0 +1,308 @@
+package authorizer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config for Authorizer
+type Config struct {
+	EntityID            string                 `yaml:"entityid"`
+	URL                 string                 `yaml:"url"`
+	KeyFile             string                 `yaml:"keyfile"`
+	CertificateFile     string                 `yaml:"certificatefile"`
+	AllowIDPInitiated   bool                   `yaml:"allowidpinitiated"`
+	DefaultRedirectURI  string                 `yaml:"defaultredirecturi"`
+	IDPMetadataURL      string                 `yaml:"idpmetadataurl"`
+	IDPMetadataFile     string                 `yaml:"idpmetadatafile"`
+	IDPMetadataXML      string                 `yaml:"idpmetadataxml"`
+	IDPMetadataSigning  *MetadataSigningConfig `yaml:"idpmetadatasigning"`
+	MetadataCache       string                 `yaml:"metadatacache"`
+	MetadataCAFile      string                 `yaml:"metadatacafile"`
+	MetadataTimeout     time.Duration          `yaml:"metadatatimeout"`
+	IDPs                []IDPConfig            `yaml:"idps"`
+	MetadataRefresh     time.Duration          `yaml:"metadatarefresh"`
+	SignRequest         bool                   `yaml:"signrequest"`
+	UseArtifactResponse bool                   `yaml:"useartifactresponse"`
+	ForceAuthn          bool                   `yaml:"forceauthn"`
+	Addr                string                 `yaml:"addr"`
+	RequiredAttributes  []requirement          `yaml:"requiredattributes"`
+	Expression          string                 `yaml:"policy"`
+	Policies            []Policy               `yaml:"policies"`
+	PDP                 *PDPConfig             `yaml:"pdp"`
+	Explain             ExplainConfig          `yaml:"explain"`
+	Headers             HeadersConfig          `yaml:"headers"`
+	Attributes          AttributesConfig       `yaml:"attributes"`
+	JWT                 *TokenConfig           `yaml:"jwt"`
+	Signature           *SignatureConfig       `yaml:"signature"`
+	Session             *SessionConfig         `yaml:"session"`
+	Cookie              *CookieConfig          `yaml:"cookie"`
+	Admin               *AdminConfig           `yaml:"admin"`
+	Tenants             []TenantConfig         `yaml:"tenants"`
+}
+
+// ConfigError lists all problems found in configuration
+type ConfigError []string
+
+func (e ConfigError) Error() string {
+	return "invalid config: " + strings.Join(e, "; ")
+}
+
+// LoadConfig reads config file, applies overrides in order and validates
+// the result. Unknown keys are rejected so typos do not silently disable
+// parts of configuration. Empty name means no config file, everything
+// comes from overrides.
+func LoadConfig(name string, overrides ...Overrides) (*Config, error) {
+	var c Config
+	if name != "" {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		if err := DecodeConfig(f, &c); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	for _, o := range overrides {
+		if err := c.Apply(o); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// DecodeConfig strictly decodes YAML config from r into c. Keys differing
+// from known ones only in case, e.g. requiredAttributes used by earlier
+// versions, are reported with their new name.
+func DecodeConfig(r io.Reader, c *Config) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err == nil {
+		if errs := renamedKeys(&doc, reflect.TypeOf(c).Elem(), ""); len(errs) > 0 {
+			return errs
+		}
+	}
+
+	d := yaml.NewDecoder(bytes.NewReader(data))
+	d.KnownFields(true)
+	if err := d.Decode(c); err != nil {
+		if errors.Is(err, io.EOF) {
+			return errors.New("config is empty")
+		}
+		return err
+	}
+	return nil
+}
+
+// renamedKeys returns error for every key of n, decoded into value of type
+// t at field, that matches config key only when case is ignored
+func renamedKeys(n *yaml.Node, t reflect.Type, field string) ConfigError {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	var errs ConfigError
+	switch {
+	case n.Kind == yaml.DocumentNode && len(n.Content) > 0:
+		return renamedKeys(n.Content[0], t, field)
+	case n.Kind == yaml.SequenceNode && t.Kind() == reflect.Slice:
+		for i, item := range n.Content {
+			errs = append(errs, renamedKeys(item, t.Elem(), fmt.Sprintf("%s[%d]", field, i))...)
+		}
+	case n.Kind == yaml.MappingNode && t.Kind() == reflect.Struct:
+		fields := map[string]reflect.StructField{}
+		for i := 0; i < t.NumField(); i++ {
+			if tag := t.Field(i).Tag.Get("yaml"); tag != "" {
+				fields[tag] = t.Field(i)
+			}
+		}
+		prefix := field
+		if prefix != "" {
+			prefix += "."
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key := n.Content[i].Value
+			if f, ok := fields[key]; ok {
+				errs = append(errs, renamedKeys(n.Content[i+1], f.Type, prefix+key)...)
+			} else if _, ok := fields[strings.ToLower(key)]; ok {
+				errs = append(errs, fmt.Sprintf("%s%s: renamed to %s%s, keys are lowercase", prefix, key, prefix, strings.ToLower(key)))
+			}
+		}
+	}
+	return errs
+}
+
+// Validate checks all config fields and returns ConfigError listing every
+// problem found
+func (c *Config) Validate() error {
+	var errs ConfigError
+	add := func(field, format string, args ...interface{}) {
+		errs = append(errs, field+": "+fmt.Sprintf(format, args...))
+	}
+
+	if c.URL == "" {
+		add("url", "is required")
+	} else if err := validateHTTPURL(c.URL); err != nil {
+		add("url", "%v", err)
+	}
+	if c.KeyFile == "" {
+		add("keyfile", "is required")
+	}
+	if c.CertificateFile == "" {
+		add("certificatefile", "is required")
+	}
+	sources, merrs := validateMetadataSource("", "idpmetadata", c.IDPMetadataURL, c.IDPMetadataFile, c.IDPMetadataXML, c.IDPMetadataSigning)
+	errs = append(errs, merrs...)
+	switch {
+	case sources == 0 && len(c.IDPs) == 0:
+		add("idpmetadataurl", "is required")
+	case sources > 0 && len(c.IDPs) > 0:
+		add("idps", "only one of idpmetadataurl, idpmetadatafile, idpmetadataxml and idps can be set")
+	}
+	errs = append(errs, validateIDPs(c.IDPs)...)
+	if c.MetadataRefresh < 0 {
+		add("metadatarefresh", "must not be negative")
+	}
+	if c.MetadataTimeout < 0 {
+		add("metadatatimeout", "must not be negative")
+	}
+	if c.DefaultRedirectURI != "" {
+		if _, err := url.Parse(c.DefaultRedirectURI); err != nil {
+			add("defaultredirecturi", "%v", err)
+		}
+	}
+	if c.Addr == "" {
+		add("addr", "is required")
+	} else if _, _, err := net.SplitHostPort(c.Addr); err != nil {
+		add("addr", "%v", err)
+	}
+
+	if _, err := compilePolicy(Policy{
+		RequiredAttributes: c.RequiredAttributes,
+		Expression:         c.Expression,
+	}); err != nil {
+		add("requiredattributes/policy", "%v", err)
+	}
+
+	seen := map[string]bool{}
+	for i, p := range c.Policies {
+		field := fmt.Sprintf("policies[%d]", i)
+		if err := validateHostPattern(p.Host); err != nil {
+			add(field+".host", "%v", err)
+		}
+		if p.Path != "" && !strings.HasPrefix(p.Path, "/") {
+			add(field+".path", "must start with /")
+		}
+		if p.MaxAge < 0 {
+			add(field+".maxage", "must not be negative")
+		}
+		key := strings.ToLower(p.Host) + strings.TrimSuffix(p.Path, "/")
+		if seen[key] {
+			add(field, "duplicate policy for %s%s", p.Host, p.Path)
+		}
+		seen[key] = true
+		if _, err := compilePolicy(p); err != nil {
+			add(field, "%v", err)
+		}
+	}
+
+	if c.PDP != nil {
+		if c.PDP.URL == "" {
+			add("pdp.url", "is required")
+		} else if err := validateHTTPURL(c.PDP.URL); err != nil {
+			add("pdp.url", "%v", err)
+		}
+		if c.PDP.Timeout < 0 {
+			add("pdp.timeout", "must not be negative")
+		}
+		if c.PDP.CacheTTL < 0 {
+			add("pdp.cachettl", "must not be negative")
+		}
+	}
+
+	if c.Explain.Admins != "" {
+		if _, err := parseExpr(c.Explain.Admins); err != nil {
+			add("explain.admins", "%v", err)
+		}
+	}
+
+	if _, err := NewHeaderMap(c.Headers); err != nil {
+		errs = append(errs, "headers."+err.Error())
+	}
+	if _, err := NewAliases(c.Attributes); err != nil {
+		errs = append(errs, "attributes."+err.Error())
+	}
+	if c.JWT != nil {
+		for _, err := range c.JWT.validate() {
+			errs = append(errs, "jwt."+err)
+		}
+	}
+	if c.Signature != nil {
+		for _, err := range c.Signature.validate() {
+			errs = append(errs, "signature."+err)
+		}
+	}
+	if c.Session != nil {
+		for _, err := range c.Session.validate() {
+			errs = append(errs, "session."+err)
+		}
+	}
+	if c.Cookie != nil {
+		for _, err := range c.Cookie.validate(c.URL) {
+			errs = append(errs, "cookie."+err)
+		}
+	}
+	if c.Admin != nil {
+		for _, err := range c.Admin.validate() {
+			errs = append(errs, "admin."+err)
+		}
+	}
+	errs = append(errs, validateTenants(c)...)
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func validateHTTPURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%q must be http or https URL", s)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("%q has no host", s)
+	}
+	return nil
+}
+
+func validateHostPattern(host string) error {
+	if host == "" {
+		return nil
+	}
+	name := strings.TrimPrefix(host, "*.")
+	if name == "" || strings.ContainsAny(name, "*/:@ ") {
+		return fmt.Errorf("%q must be host name or *.domain wildcard", host)
+	}
+	return nil
+}
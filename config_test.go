@@ -0,0 +1,157 @@
+package authorizer
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigExample(t *testing.T) {
+	c, err := LoadConfig("config.yaml")
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+
+	want := []requirement{{"foo": "bar", "abc": "xyz"}, {"foo": "baz"}}
+	if !reflect.DeepEqual(c.RequiredAttributes, want) {
+		t.Errorf("RequiredAttributes = %v, want %v", c.RequiredAttributes, want)
+	}
+	if len(c.Policies) == 0 {
+		t.Error("expected policies")
+	}
+}
+
+func TestDecodeConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		want    Config
+		wantErr string
+	}{{
+		name: "Tags",
+		yaml: `
+url: http://localhost
+idpmetadataurl: https://idp.example.com/metadata
+requiredattributes:
+  - group: sre
+pdp:
+  url: http://opa:8181/v1/data/authz
+  timeout: 3s
+`,
+		want: Config{
+			URL:                "http://localhost",
+			IDPMetadataURL:     "https://idp.example.com/metadata",
+			RequiredAttributes: []requirement{{"group": "sre"}},
+			PDP: &PDPConfig{
+				URL:     "http://opa:8181/v1/data/authz",
+				Timeout: 3 * time.Second,
+			},
+		},
+	}, {
+		name:    "RenamedKey",
+		yaml:    "url: http://localhost\nrequiredAttributes:\n  - group: sre\n",
+		wantErr: "requiredAttributes: renamed to requiredattributes",
+	}, {
+		name:    "RenamedNestedKey",
+		yaml:    "policies:\n  - host: example.com\n    requiredAttributes: []\npdp:\n  failOpen: true\n",
+		wantErr: "policies[0].requiredAttributes: renamed to policies[0].requiredattributes, keys are lowercase; pdp.failOpen: renamed to pdp.failopen",
+	}, {
+		name:    "UnknownKey",
+		yaml:    "url: http://localhost\nrequired: []\n",
+		wantErr: "field required not found",
+	}, {
+		name:    "UnknownNestedKey",
+		yaml:    "policies:\n  - host: example.com\n    requireattribute: []\n",
+		wantErr: "field requireattribute not found",
+	}, {
+		name:    "Empty",
+		yaml:    "",
+		wantErr: "config is empty",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got Config
+			err := DecodeConfig(strings.NewReader(tt.yaml), &got)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("DecodeConfig() error = %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DecodeConfig() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DecodeConfig() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func validConfig() *Config {
+	return &Config{
+		URL:             "https://auth.example.com",
+		KeyFile:         "tls.key",
+		CertificateFile: "tls.crt",
+		IDPMetadataURL:  "https://idp.example.com/metadata",
+		Addr:            ":8000",
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	if err := validConfig().Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+
+	c := &Config{
+		URL:                "ftp://auth.example.com",
+		IDPMetadataURL:     "https://",
+		Addr:               "8000",
+		RequiredAttributes: []requirement{{"group regex": "("}},
+		Policies: []Policy{{
+			Host: "grafana.example.com",
+			Path: "admin",
+		}, {
+			Host: "grafana.example.com",
+			Path: "/admin",
+		}, {
+			Host: "Grafana.example.com",
+			Path: "/admin/",
+		}, {
+			Host:       "*.*.example.com",
+			Expression: "group ==",
+		}},
+		PDP: &PDPConfig{
+			Timeout: -time.Second,
+		},
+		Explain: ExplainConfig{Admins: "!"},
+		Headers: HeadersConfig{Multivalue: "first"},
+	}
+	err := c.Validate()
+
+	var errs ConfigError
+	if !errors.As(err, &errs) {
+		t.Fatalf("Validate() error = %v, want ConfigError", err)
+	}
+	want := ConfigError{
+		`url: "ftp://auth.example.com" must be http or https URL`,
+		`keyfile: is required`,
+		`certificatefile: is required`,
+		`idpmetadataurl: "https://" has no host`,
+		`addr: address 8000: missing port in address`,
+		"requiredattributes/policy: requirement 0: group regex: error parsing regexp: missing closing ): `(`",
+		`policies[0].path: must start with /`,
+		`policies[2]: duplicate policy for Grafana.example.com/admin/`,
+		`policies[3].host: "*.*.example.com" must be host name or *.domain wildcard`,
+		`policies[3]: policy expression: 9: expected attribute, string or list, got end of expression`,
+		`pdp.url: is required`,
+		`pdp.timeout: must not be negative`,
+		`explain.admins: 2: expected attribute, string or list, got end of expression`,
+		`headers.multivalue: "first" must be join or repeat`,
+	}
+	if !reflect.DeepEqual(errs, want) {
+		t.Errorf("Validate() errors:\n%s\nwant:\n%s", strings.Join(errs, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,280 @@
+package authorizer
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlsp"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// CookieConfig sets attributes of session and request tracker cookies,
+// Domain shared by protected hosts gives single sign on across them
+type CookieConfig struct {
+	// Name of session cookie, default token; request tracker cookies are
+	// named after it
+	Name string `yaml:"name"`
+	// Domain must cover host of url, default is that host
+	Domain string `yaml:"domain"`
+	// Path of session cookie, default /
+	Path string `yaml:"path"`
+	// SameSite is lax, strict or none, default is browser default
+	SameSite string `yaml:"samesite"`
+	// Secure defaults to true for https url
+	Secure *bool `yaml:"secure"`
+	// HTTPOnly defaults to true
+	HTTPOnly *bool `yaml:"httponly"`
+}
+
+var sameSiteModes = map[string]http.SameSite{
+	"lax":    http.SameSiteLaxMode,
+	"strict": http.SameSiteStrictMode,
+	"none":   http.SameSiteNoneMode,
+}
+
+// validate checks cookie config against service url, invalid url is
+// reported elsewhere
+func (c *CookieConfig) validate(rawURL string) []string {
+	var errs []string
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		u = &url.URL{}
+	}
+	if c.Name != "" && (&http.Cookie{Name: c.Name, Value: "x"}).String() == "" {
+		errs = append(errs, fmt.Sprintf("name: %q is not valid cookie name", c.Name))
+	}
+	if c.Domain != "" && u.Hostname() != "" && !domainCovers(c.domain(), u.Hostname()) {
+		errs = append(errs, fmt.Sprintf("domain: %q does not cover url host %q", c.Domain, u.Hostname()))
+	}
+	if c.Path != "" && !strings.HasPrefix(c.Path, "/") {
+		errs = append(errs, "path: must start with /")
+	}
+	if _, ok := sameSiteModes[c.SameSite]; c.SameSite != "" && !ok {
+		errs = append(errs, fmt.Sprintf("samesite: %q must be lax, strict or none", c.SameSite))
+	}
+	if c.SameSite == "none" && u.Scheme != "https" {
+		errs = append(errs, "samesite: none requires https url, browsers reject insecure cookies")
+	}
+	if c.SameSite == "none" && c.Secure != nil && !*c.Secure {
+		errs = append(errs, "secure: must be true with samesite none")
+	}
+	return errs
+}
+
+// domain returns Domain without leading dot
+func (c *CookieConfig) domain() string {
+	return strings.ToLower(strings.TrimPrefix(c.Domain, "."))
+}
+
+// path returns cookie path, / when not configured
+func (c *CookieConfig) path() string {
+	if c == nil || c.Path == "" {
+		return "/"
+	}
+	return c.Path
+}
+
+// domainCovers reports whether cookie with domain is sent to host
+func domainCovers(domain, host string) bool {
+	host = strings.ToLower(host)
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// apply sets configured attributes on session cookie provider p
+func (c *CookieConfig) apply(p samlsp.CookieSessionProvider) samlsp.CookieSessionProvider {
+	if c == nil {
+		return p
+	}
+	if c.Name != "" {
+		p.Name = c.Name
+	}
+	if c.Domain != "" {
+		p.Domain = c.domain()
+	}
+	if mode, ok := sameSiteModes[c.SameSite]; ok {
+		p.SameSite = mode
+	}
+	if c.Secure != nil {
+		p.Secure = *c.Secure
+	}
+	if c.HTTPOnly != nil {
+		p.HTTPOnly = *c.HTTPOnly
+	}
+	return p
+}
+
+// NewRequestTracker returns t with request cookies named after session
+// cookie and sharing its SameSite mode; request cookies stay on url host
+// and are always HttpOnly, Secure for https url
+func NewRequestTracker(c *CookieConfig, t samlsp.CookieRequestTracker) samlsp.CookieRequestTracker {
+	if c == nil {
+		return t
+	}
+	if c.Name != "" {
+		t.NamePrefix = c.Name + "_saml_"
+	}
+	if mode, ok := sameSiteModes[c.SameSite]; ok {
+		t.SameSite = mode
+	}
+	return t
+}
+
+// CookieSession is session kept in signed JWT cookie, Deadline limits
+// renewals
+type CookieSession struct {
+	samlsp.JWTSessionClaims
+	Deadline int64 `json:"deadline,omitempty"`
+}
+
+// CookieSessionCodec is samlsp.JWTSessionCodec honoring session lifetime
+type CookieSessionCodec struct {
+	samlsp.JWTSessionCodec
+	lifetime sessionLifetime
+}
+
+var _ samlsp.SessionCodec = CookieSessionCodec{}
+
+// New returns CookieSession for assertion
+func (c CookieSessionCodec) New(assertion *saml.Assertion) (samlsp.Session, error) {
+	session, err := c.JWTSessionCodec.New(assertion)
+	if err != nil {
+		return nil, err
+	}
+	claims := session.(samlsp.JWTSessionClaims)
+	now := time.Unix(claims.IssuedAt, 0)
+	deadline := c.lifetime.deadline(assertion, now)
+	expires := c.lifetime.expires(now, deadline)
+	if !expires.After(now) {
+		return nil, errors.New("session: assertion SessionNotOnOrAfter is in the past")
+	}
+	claims.ExpiresAt = expires.Unix()
+	return CookieSession{JWTSessionClaims: claims, Deadline: deadline.Unix()}, nil
+}
+
+// Encode returns signed JWT for CookieSession
+func (c CookieSessionCodec) Encode(s samlsp.Session) (string, error) {
+	token := jwt.NewWithClaims(c.SigningMethod, s.(CookieSession))
+	return token.SignedString(c.Key)
+}
+
+// Decode verifies signed JWT and returns CookieSession, sessions encoded
+// by samlsp.JWTSessionCodec are accepted too
+func (c CookieSessionCodec) Decode(signed string) (samlsp.Session, error) {
+	parser := jwt.Parser{ValidMethods: []string{c.SigningMethod.Alg()}}
+	var claims CookieSession
+	_, err := parser.ParseWithClaims(signed, &claims, func(*jwt.Token) (interface{}, error) {
+		return c.Key.Public(), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !claims.VerifyAudience(c.Audience, true) {
+		return nil, fmt.Errorf("expected audience %q, got %q", c.Audience, claims.Audience)
+	}
+	if !claims.VerifyIssuer(c.Issuer, true) {
+		return nil, fmt.Errorf("expected issuer %q, got %q", c.Issuer, claims.Issuer)
+	}
+	if !claims.SAMLSession {
+		return nil, errors.New("expected saml-session")
+	}
+	return claims, nil
+}
+
+// CookieSessionProvider is samlsp.CookieSessionProvider that renews
+// sessions encoded with CookieSessionCodec and sets cookie on Path
+type CookieSessionProvider struct {
+	samlsp.CookieSessionProvider
+	// Path of session cookie, default /
+	Path string
+}
+
+var _ sessionRenewer = CookieSessionProvider{}
+
+// NewCookieSessionProvider returns provider with session lifetime applied
+// to cookie and JWT codec of p
+func NewCookieSessionProvider(p samlsp.CookieSessionProvider, l sessionLifetime) CookieSessionProvider {
+	p.MaxAge = l.maxLifetime
+	if codec, ok := p.Codec.(samlsp.JWTSessionCodec); ok {
+		codec.MaxAge = l.maxLifetime
+		p.Codec = CookieSessionCodec{JWTSessionCodec: codec, lifetime: l}
+	}
+	return CookieSessionProvider{CookieSessionProvider: p}
+}
+
+// CreateSession sets cookie with session for assertion
+func (p CookieSessionProvider) CreateSession(w http.ResponseWriter, r *http.Request, assertion *saml.Assertion) error {
+	session, err := p.Codec.New(assertion)
+	if err != nil {
+		return err
+	}
+	value, err := p.Codec.Encode(session)
+	if err != nil {
+		return err
+	}
+	maxAge := p.MaxAge
+	if s, ok := session.(CookieSession); ok && s.Deadline != 0 {
+		maxAge = time.Until(time.Unix(s.Deadline, 0))
+	}
+	p.setCookie(w, r, value, int(maxAge.Seconds()))
+	return nil
+}
+
+// DeleteSession removes session cookie
+func (p CookieSessionProvider) DeleteSession(w http.ResponseWriter, r *http.Request) error {
+	if _, err := r.Cookie(p.Name); err == http.ErrNoCookie {
+		return nil
+	}
+	p.setCookie(w, r, "", -1)
+	return nil
+}
+
+// RenewSession sets cookie with session expiring after idle timeout
+func (p CookieSessionProvider) RenewSession(w http.ResponseWriter, r *http.Request, session samlsp.Session) error {
+	codec, ok := p.Codec.(CookieSessionCodec)
+	if !ok {
+		return nil
+	}
+	s, ok := session.(CookieSession)
+	if !ok || s.Deadline == 0 {
+		return nil
+	}
+	expires, ok := codec.lifetime.renew(time.Unix(s.ExpiresAt, 0), time.Unix(s.Deadline, 0), saml.TimeNow())
+	if !ok {
+		return nil
+	}
+	s.ExpiresAt = expires.Unix()
+	value, err := codec.Encode(s)
+	if err != nil {
+		return err
+	}
+	p.setCookie(w, r, value, int(time.Until(time.Unix(s.Deadline, 0)).Seconds()))
+	return nil
+}
+
+// setCookie sets session cookie, negative maxAge deletes it
+func (p CookieSessionProvider) setCookie(w http.ResponseWriter, r *http.Request, value string, maxAge int) {
+	domain := p.Domain
+	if host, _, err := net.SplitHostPort(domain); err == nil {
+		domain = host
+	}
+	path := p.Path
+	if path == "" {
+		path = "/"
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     p.Name,
+		Domain:   domain,
+		Value:    value,
+		MaxAge:   maxAge,
+		HttpOnly: p.HTTPOnly,
+		Secure:   p.Secure || r.URL.Scheme == "https",
+		SameSite: p.SameSite,
+		Path:     path,
+	})
+}
@@ -0,0 +1,212 @@
+package authorizer
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlsp"
+)
+
+func testCookieProvider(t *testing.T, l sessionLifetime) CookieSessionProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse("https://sso.example.com")
+	return NewCookieSessionProvider(samlsp.DefaultSessionProvider(samlsp.Options{URL: *u, Key: key}), l)
+}
+
+func TestCookieSessionProvider(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	defer func() { saml.TimeNow = time.Now }()
+	saml.TimeNow = func() time.Time { return now }
+
+	p := testCookieProvider(t, sessionLifetime{maxLifetime: 8 * time.Hour, idleTimeout: 30 * time.Minute})
+	req := sessionCookie(t, p)
+	if c, _ := req.Cookie("token"); c == nil {
+		t.Fatal("session cookie not set")
+	}
+
+	session, err := p.GetSession(req)
+	if err != nil {
+		t.Fatalf("GetSession() error = %v", err)
+	}
+	s, ok := session.(CookieSession)
+	if !ok {
+		t.Fatalf("GetSession() = %T, want CookieSession", session)
+	}
+	if s.Subject != "alice@example.com" || s.GetAttributes().Get("uid") != "alice" {
+		t.Errorf("unexpected session %+v", s)
+	}
+	if got := time.Unix(s.ExpiresAt, 0); !got.Equal(now.Add(30 * time.Minute)) {
+		t.Errorf("session expires at %v, want idle timeout", got)
+	}
+	if got := time.Unix(s.Deadline, 0); !got.Equal(now.Add(8 * time.Hour)) {
+		t.Errorf("session deadline %v, want max lifetime", got)
+	}
+
+	// renewal sets new cookie
+	saml.TimeNow = func() time.Time { return now.Add(10 * time.Minute) }
+	res := httptest.NewRecorder()
+	if err := p.RenewSession(res, req, session); err != nil {
+		t.Fatal(err)
+	}
+	cookies := res.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("got %d cookies, want renewed session cookie", len(cookies))
+	}
+	renewed := httptest.NewRequest(http.MethodGet, "/saml/auth", nil)
+	renewed.AddCookie(cookies[0])
+	session, err = p.GetSession(renewed)
+	if err != nil {
+		t.Fatalf("GetSession() renewed error = %v", err)
+	}
+	if got := time.Unix(session.(CookieSession).ExpiresAt, 0); !got.Equal(now.Add(40 * time.Minute)) {
+		t.Errorf("renewed session expires at %v, want 40m after sign in", got)
+	}
+	if session.(CookieSession).IssuedAt != s.IssuedAt {
+		t.Error("renewal changed issue time")
+	}
+
+	// no renewal shortly after previous one
+	res = httptest.NewRecorder()
+	p.RenewSession(res, renewed, session)
+	if len(res.Result().Cookies()) != 0 {
+		t.Error("session renewed again within renew interval")
+	}
+}
+
+func TestCookieSessionNotOnOrAfter(t *testing.T) {
+	p := testCookieProvider(t, sessionLifetime{maxLifetime: 8 * time.Hour})
+	codec := p.Codec.(CookieSessionCodec)
+
+	a := testAssertion()
+	notOnOrAfter := time.Now().Add(20 * time.Minute).Truncate(time.Second)
+	a.AuthnStatements[0].SessionNotOnOrAfter = &notOnOrAfter
+	session, err := codec.New(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := time.Unix(session.(CookieSession).ExpiresAt, 0); !got.Equal(notOnOrAfter) {
+		t.Errorf("session expires at %v, want SessionNotOnOrAfter %v", got, notOnOrAfter)
+	}
+
+	past := time.Now().Add(-time.Minute)
+	a.AuthnStatements[0].SessionNotOnOrAfter = &past
+	if _, err := codec.New(a); err == nil {
+		t.Error("New() accepted assertion with SessionNotOnOrAfter in the past")
+	}
+}
+
+func TestCookieConfigValidate(t *testing.T) {
+	no := false
+	tests := []struct {
+		name   string
+		url    string
+		config CookieConfig
+		want   []string
+	}{{
+		name:   "Domain",
+		url:    "https://sso.apps.example.com",
+		config: CookieConfig{Name: "sso", Domain: ".apps.example.com", Path: "/", SameSite: "none"},
+	}, {
+		name:   "DomainIsHost",
+		url:    "http://localhost:8000",
+		config: CookieConfig{Domain: "localhost", SameSite: "lax"},
+	}, {
+		name:   "DomainDoesNotCover",
+		url:    "https://sso.example.com",
+		config: CookieConfig{Domain: "apps.example.com"},
+		want:   []string{`domain: "apps.example.com" does not cover url host "sso.example.com"`},
+	}, {
+		name:   "DomainSuffixOnly",
+		url:    "https://sso.badexample.com",
+		config: CookieConfig{Domain: "example.com"},
+		want:   []string{`domain: "example.com" does not cover url host "sso.badexample.com"`},
+	}, {
+		name:   "Invalid",
+		url:    "https://sso.example.com",
+		config: CookieConfig{Name: "my token", Path: "saml", SameSite: "always"},
+		want: []string{
+			`name: "my token" is not valid cookie name`,
+			"path: must start with /",
+			`samesite: "always" must be lax, strict or none`,
+		},
+	}, {
+		name:   "SameSiteNone",
+		url:    "http://localhost:8000",
+		config: CookieConfig{SameSite: "none", Secure: &no},
+		want: []string{
+			"samesite: none requires https url, browsers reject insecure cookies",
+			"secure: must be true with samesite none",
+		},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.config.validate(tt.url); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("validate() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCookieConfig(t *testing.T) {
+	no := false
+	c := &CookieConfig{Name: "sso", Domain: ".Apps.example.com", Path: "/app", SameSite: "strict", HTTPOnly: &no}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse("https://sso.apps.example.com")
+	opts := samlsp.Options{URL: *u, Key: key}
+
+	for _, sc := range []*SessionConfig{nil, {Store: "memory"}} {
+		p, err := NewSessionProvider(sc, c, samlsp.DefaultSessionProvider(opts))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		if err := p.CreateSession(res, httptest.NewRequest(http.MethodPost, "/saml/acs", nil), testAssertion()); err != nil {
+			t.Fatalf("CreateSession() error = %v", err)
+		}
+		cookies := res.Result().Cookies()
+		if len(cookies) != 1 {
+			t.Fatalf("got %d cookies, want 1", len(cookies))
+		}
+		got := cookies[0]
+		if got.Name != "sso" || got.Domain != "apps.example.com" || got.Path != "/app" ||
+			got.SameSite != http.SameSiteStrictMode || !got.Secure || got.HttpOnly {
+			t.Errorf("%T cookie = %s", p, got)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/saml/auth", nil)
+		req.AddCookie(got)
+		if _, err := p.GetSession(req); err != nil {
+			t.Errorf("%T GetSession() error = %v", p, err)
+		}
+		res = httptest.NewRecorder()
+		if err := p.DeleteSession(res, req); err != nil {
+			t.Fatal(err)
+		}
+		cookies = res.Result().Cookies()
+		if len(cookies) != 1 || cookies[0].Path != "/app" || cookies[0].Value != "" {
+			t.Errorf("%T DeleteSession() cookies = %v", p, cookies)
+		}
+	}
+
+	tracker := NewRequestTracker(c, samlsp.DefaultRequestTracker(opts, nil))
+	if tracker.NamePrefix != "sso_saml_" || tracker.SameSite != http.SameSiteStrictMode {
+		t.Errorf("NewRequestTracker() = %+v", tracker)
+	}
+	if tracker := NewRequestTracker(nil, samlsp.DefaultRequestTracker(opts, nil)); tracker.NamePrefix != "saml_" {
+		t.Errorf("NewRequestTracker(nil) prefix = %q, want default", tracker.NamePrefix)
+	}
+}
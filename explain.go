@@ -0,0 +1,141 @@
+package authorizer
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/crewjam/saml/samlsp"
+	"go.uber.org/zap"
+)
+
+// decisionHeader carries decision on auth responses when enabled
+const decisionHeader = "X-Auth-Decision"
+
+// Decision describes outcome of authorization: which policy matched the
+// request and which checks failed
+type Decision struct {
+	URL     string
+	Policy  string
+	Allowed bool
+	Reasons []string
+
+	// headers returned by policy decision point
+	headers map[string]string
+}
+
+func (d Decision) deny(reasons ...string) Decision {
+	d.Allowed = false
+	d.Reasons = append(d.Reasons, reasons...)
+	return d
+}
+
+// String returns single line ASCII representation of d suitable for
+// X-Auth-Decision header
+func (d Decision) String() string {
+	verdict := "deny"
+	if d.Allowed {
+		verdict = "allow"
+	}
+	s := []string{verdict, "policy=" + strconv.QuoteToASCII(d.Policy)}
+	for _, r := range d.Reasons {
+		s = append(s, "reason="+strconv.QuoteToASCII(r))
+	}
+	return strings.Join(s, "; ")
+}
+
+// ExplainConfig controls exposure of authorization decisions
+type ExplainConfig struct {
+	// Header adds X-Auth-Decision to auth responses
+	Header bool `yaml:"header"`
+	// Admins is a policy expression selecting users that get the header,
+	// when empty everyone gets it
+	Admins string `yaml:"admins"`
+}
+
+// Explainer decides who can see authorization decisions
+type Explainer struct {
+	header bool
+	admins expr
+}
+
+// NewExplainer returns Explainer for config
+func NewExplainer(c ExplainConfig) (*Explainer, error) {
+	x := &Explainer{header: c.Header}
+	if c.Admins != "" {
+		admins, err := parseExpr(c.Admins)
+		if err != nil {
+			return nil, fmt.Errorf("explain admins: %w", err)
+		}
+		x.admins = admins
+	}
+	return x, nil
+}
+
+func (x *Explainer) showHeader(e *env) bool {
+	if x == nil || !x.header {
+		return false
+	}
+	return x.admins == nil || x.admins.eval(e)
+}
+
+// Explain handler shows signed-in user how the request in rd parameter
+// would be authorized
+func (s *AuthService) Explain(w http.ResponseWriter, r *http.Request) {
+	session, attributes, err := s.getSession(r)
+	if err != nil {
+		s.httpError(w, r, http.StatusUnauthorized)
+		return
+	}
+
+	_, issued, _ := sessionInfo(session)
+	d, _ := s.decide(s.Settings(), r, attributes, issued)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	s.httpStatus(w, r, http.StatusOK)
+	fmt.Fprintf(w, "url: %s\n", d.URL)
+	fmt.Fprintf(w, "policy: %s\n", d.Policy)
+	fmt.Fprintf(w, "allowed: %t\n", d.Allowed)
+	for _, reason := range d.Reasons {
+		fmt.Fprintf(w, "reason: %s\n", reason)
+	}
+}
+
+// decide evaluates ACL, IdP policy and policy decision point from st for
+// request, issued is time session was created or zero when unknown
+func (s *AuthService) decide(st *Settings, r *http.Request, attributes samlsp.Attributes, issued time.Time) (Decision, *env) {
+	u := s.originalURL(r)
+	e := newEnv(r, u, attributes)
+	e.issued = issued
+
+	d := st.checkIDP(st.ACL.Lookup(u).decide(e), e)
+	d.URL = u.String()
+	if !d.Allowed {
+		return d, e
+	}
+
+	pd, err := s.checkPDP(st.PDP, r, u, e)
+	if err != nil {
+		if !st.PDP.FailOpen {
+			return d.deny("policy decision point: " + err.Error()), e
+		}
+		return d, e
+	}
+	if !pd.Allow {
+		return d.deny("denied by policy decision point"), e
+	}
+	d.headers = pd.Headers
+	return d, e
+}
+
+func (s *AuthService) logDecision(r *http.Request, d Decision) {
+	s.Log.Info("access denied",
+		zap.String("requestMethod", r.Method),
+		zap.String("originalUrl", d.URL),
+		zap.String("remoteIp", r.RemoteAddr),
+		zap.String("policy", d.Policy),
+		zap.Strings("reasons", d.Reasons),
+	)
+}
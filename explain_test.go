@@ -0,0 +1,219 @@
+package authorizer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crewjam/saml/samlsp"
+)
+
+func TestPolicyDecide(t *testing.T) {
+	acl := mustNewACL([]requirement{{"group": "admins"}}, []Policy{{
+		Host: "grafana.example.com",
+		RequiredAttributes: []requirement{{
+			"group":       "sre",
+			"mail suffix": "@example.com",
+		}, {
+			"name": "Bob",
+		}},
+	}, {
+		Host:       "wiki.example.com",
+		Expression: `has(mail) && (group == "staff" || !(name == "Alice"))`,
+	}, {
+		Host:   "vault.example.com",
+		MaxAge: 15 * time.Minute,
+	}})
+
+	tests := []struct {
+		name       string
+		url        string
+		attributes samlsp.Attributes
+		issued     time.Time
+		want       Decision
+	}{{
+		name: "GlobalPolicy",
+		url:  "https://example.org/",
+		attributes: samlsp.Attributes{
+			"group": []string{"admins"},
+		},
+		want: Decision{Allowed: true, Policy: "global"},
+	}, {
+		name:       "NoAttributes",
+		url:        "https://grafana.example.com/",
+		attributes: samlsp.Attributes{},
+		want: Decision{Policy: "grafana.example.com", Reasons: []string{
+			"session has no attributes",
+		}},
+	}, {
+		name: "FailedRequirements",
+		url:  "https://grafana.example.com/",
+		attributes: samlsp.Attributes{
+			"name":  []string{"Alice"},
+			"group": []string{"sre"},
+			"mail":  []string{"alice@example.org"},
+		},
+		want: Decision{Policy: "grafana.example.com", Reasons: []string{
+			`mail suffix "@example.com" not met, got ["alice@example.org"]`,
+			`name equals "Bob" not met, got ["Alice"]`,
+		}},
+	}, {
+		name: "FailedExpression",
+		url:  "https://wiki.example.com/",
+		attributes: samlsp.Attributes{
+			"name":  []string{"Alice"},
+			"group": []string{"users"},
+			"mail":  []string{"alice@example.com"},
+		},
+		want: Decision{Policy: "wiki.example.com", Reasons: []string{
+			`group == "staff" is false, got ["users"]`,
+			`!(name == "Alice") is false`,
+		}},
+	}, {
+		name:       "FreshSession",
+		url:        "https://vault.example.com/",
+		attributes: samlsp.Attributes{"name": []string{"Alice"}},
+		issued:     time.Now().Add(-5 * time.Minute),
+		want:       Decision{Allowed: true, Policy: "vault.example.com"},
+	}, {
+		name:       "StaleSession",
+		url:        "https://vault.example.com/",
+		attributes: samlsp.Attributes{"name": []string{"Alice"}},
+		issued:     time.Now().Add(-time.Hour),
+		want: Decision{Policy: "vault.example.com", Reasons: []string{
+			"session older than 15m0s, sign in again",
+		}},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/saml/auth", nil)
+			req.Header.Set("X-Original-URL", tt.url)
+
+			s := fakeAuthService(&validUser{}, nil)
+			s.Reload(&Settings{ACL: acl})
+
+			got, _ := s.decide(s.Settings(), req, tt.attributes, tt.issued)
+			tt.want.URL = tt.url
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("AuthService.decide() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecisionString(t *testing.T) {
+	d := Decision{Policy: "wiki.example.com/ö", Reasons: []string{
+		`name == "Zoë" is false`,
+		"line\nbreak",
+	}}
+	got := d.String()
+	want := `deny; policy="wiki.example.com/\u00f6"; reason="name == \"Zo\u00eb\" is false"; reason="line\nbreak"`
+	if got != want {
+		t.Errorf("Decision.String() = %s, want %s", got, want)
+	}
+
+	d = Decision{Allowed: true, Policy: "global"}
+	if got, want := d.String(), `allow; policy="global"`; got != want {
+		t.Errorf("Decision.String() = %s, want %s", got, want)
+	}
+}
+
+func TestAuthHandlerDecisionHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		config ExplainConfig
+		want   string
+	}{{
+		name:   "Disabled",
+		config: ExplainConfig{},
+		want:   "",
+	}, {
+		name:   "Everyone",
+		config: ExplainConfig{Header: true},
+		want:   `deny; policy="global"; reason="group equals \"admins\" not met, got [\"users\"]"`,
+	}, {
+		name:   "Admin",
+		config: ExplainConfig{Header: true, Admins: `name == "Alice"`},
+		want:   `deny; policy="global"; reason="group equals \"admins\" not met, got [\"users\"]"`,
+	}, {
+		name:   "NotAdmin",
+		config: ExplainConfig{Header: true, Admins: `group == "admins"`},
+		want:   "",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := fakeAuthService(&validUser{}, nil)
+			x, err := NewExplainer(tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.Reload(&Settings{
+				ACL:       mustNewACL([]requirement{{"group": "admins"}}, nil),
+				Explainer: x,
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/saml/auth", nil)
+			res := httptest.NewRecorder()
+
+			s.Auth(res, req)
+
+			if got, want := res.Code, http.StatusUnauthorized; got != want {
+				t.Errorf("got status %d but wanted %d", got, want)
+			}
+			if got := res.Header().Get("X-Auth-Decision"); got != tt.want {
+				t.Errorf("got header X-Auth-Decision %s but wanted %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewExplainerInvalidAdmins(t *testing.T) {
+	if _, err := NewExplainer(ExplainConfig{Admins: "group =="}); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestExplainHandlerWithoutSession(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/saml/explain", nil)
+	res := httptest.NewRecorder()
+
+	s := fakeAuthService(&unknownUser{}, nil)
+
+	s.Explain(res, req)
+
+	got, want := res.Code, http.StatusUnauthorized
+	if got != want {
+		t.Errorf("got status %d but wanted %d", got, want)
+	}
+}
+
+func TestExplainHandler(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/saml/explain?rd=https%3A%2F%2Fgrafana.example.com%2F", nil)
+	res := httptest.NewRecorder()
+
+	s := fakeAuthService(&validUser{}, nil)
+	s.Reload(&Settings{ACL: mustNewACL(nil, []Policy{{
+		Host:               "grafana.example.com",
+		RequiredAttributes: []requirement{{"group": "sre"}},
+	}})})
+
+	s.Explain(res, req)
+
+	if got, want := res.Code, http.StatusOK; got != want {
+		t.Errorf("got status %d but wanted %d", got, want)
+	}
+
+	want := strings.Join([]string{
+		"url: https://grafana.example.com/",
+		"policy: grafana.example.com",
+		"allowed: false",
+		`reason: group equals "sre" not met, got ["users"]`,
+		"",
+	}, "\n")
+	if got := res.Body.String(); got != want {
+		t.Errorf("got body %q but wanted %q", got, want)
+	}
+}
@@ -0,0 +1,498 @@
+package authorizer
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/crewjam/saml/samlsp"
+)
+
+// Policy expressions combine attribute and request checks, e.g.
+//
+//     (group == "sre" && mail matches "@example\\.com$") || group in ["admins", "ops"]
+//     has(mail) && !(group == "contractors") && request.method != "DELETE"
+//
+// Attributes are multi-valued so comparison is true when any of the values
+// matches. Request metadata is available as request.host, request.path,
+// request.method and request.ip. Attribute names that are not valid
+// identifiers can be referenced with attr("http://...").
+
+// env is evaluation environment of policy expressions
+type env struct {
+	attributes samlsp.Attributes
+	request    map[string]string
+	// issued is time session was created, zero when unknown
+	issued time.Time
+}
+
+var requestFields = map[string]bool{
+	"host":   true,
+	"path":   true,
+	"method": true,
+	"ip":     true,
+}
+
+func newEnv(r *http.Request, u *url.URL, attributes samlsp.Attributes) *env {
+	method := r.Header.Get("X-Original-Method")
+	if method == "" {
+		method = r.Method
+	}
+	return &env{
+		attributes: attributes,
+		request: map[string]string{
+			"host":   strings.ToLower(u.Hostname()),
+			"path":   cleanPath(u.Path),
+			"method": method,
+			"ip":     clientIP(r),
+		},
+	}
+}
+
+func clientIP(r *http.Request) string {
+	if v := r.Header.Get("X-Real-IP"); v != "" {
+		return v
+	}
+	if v := r.Header.Get("X-Forwarded-For"); v != "" {
+		return strings.TrimSpace(strings.Split(v, ",")[0])
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+type expr interface {
+	eval(e *env) bool
+	// explain returns failed checks for expression that evaluates to false
+	explain(e *env) []string
+	String() string
+}
+
+type orExpr struct{ left, right expr }
+
+func (x *orExpr) eval(e *env) bool { return x.left.eval(e) || x.right.eval(e) }
+func (x *orExpr) String() string   { return "(" + x.left.String() + " || " + x.right.String() + ")" }
+func (x *orExpr) explain(e *env) []string {
+	return append(x.left.explain(e), x.right.explain(e)...)
+}
+
+type andExpr struct{ left, right expr }
+
+func (x *andExpr) eval(e *env) bool { return x.left.eval(e) && x.right.eval(e) }
+func (x *andExpr) String() string   { return "(" + x.left.String() + " && " + x.right.String() + ")" }
+func (x *andExpr) explain(e *env) []string {
+	if !x.left.eval(e) {
+		return x.left.explain(e)
+	}
+	return x.right.explain(e)
+}
+
+type notExpr struct{ x expr }
+
+func (x *notExpr) eval(e *env) bool { return !x.x.eval(e) }
+func (x *notExpr) String() string {
+	if _, ok := x.x.(*cmpExpr); ok {
+		return "!(" + x.x.String() + ")"
+	}
+	return "!" + x.x.String()
+}
+func (x *notExpr) explain(e *env) []string { return []string{x.String() + " is false"} }
+
+type hasExpr struct{ name string }
+
+func (x *hasExpr) eval(e *env) bool        { return len(e.attributes[x.name]) > 0 }
+func (x *hasExpr) String() string          { return "has(" + formatName(x.name) + ")" }
+func (x *hasExpr) explain(e *env) []string { return []string{x.String() + " is false"} }
+
+type cmpExpr struct {
+	op          string
+	left, right operand
+	re          *regexp.Regexp
+}
+
+func (x *cmpExpr) eval(e *env) bool {
+	left := x.left.values(e)
+	if x.op == "matches" {
+		for _, v := range left {
+			if x.re.MatchString(v) {
+				return true
+			}
+		}
+		return false
+	}
+
+	found := containsAny(left, x.right.values(e))
+	if x.op == "!=" {
+		return !found
+	}
+	return found
+}
+
+func containsAny(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (x *cmpExpr) String() string {
+	return x.left.String() + " " + x.op + " " + x.right.String()
+}
+
+func (x *cmpExpr) explain(e *env) []string {
+	return []string{fmt.Sprintf("%s is false, got %q", x, x.left.values(e))}
+}
+
+// canonicalExpr renames attributes referenced by x to canonical names
+func canonicalExpr(x expr, a *Aliases) {
+	switch x := x.(type) {
+	case *orExpr:
+		canonicalExpr(x.left, a)
+		canonicalExpr(x.right, a)
+	case *andExpr:
+		canonicalExpr(x.left, a)
+		canonicalExpr(x.right, a)
+	case *notExpr:
+		canonicalExpr(x.x, a)
+	case *hasExpr:
+		x.name = a.Canonical(x.name)
+	case *cmpExpr:
+		for _, o := range []operand{x.left, x.right} {
+			if o, ok := o.(*attrOperand); ok {
+				o.name = a.Canonical(o.name)
+			}
+		}
+	}
+}
+
+type operand interface {
+	values(e *env) []string
+	String() string
+}
+
+type attrOperand struct{ name string }
+
+func (o *attrOperand) values(e *env) []string { return e.attributes[o.name] }
+func (o *attrOperand) String() string         { return formatName(o.name) }
+
+type requestOperand struct{ field string }
+
+func (o *requestOperand) values(e *env) []string { return []string{e.request[o.field]} }
+func (o *requestOperand) String() string         { return "request." + o.field }
+
+type literalOperand struct {
+	list bool
+	vals []string
+}
+
+func (o *literalOperand) values(e *env) []string { return o.vals }
+func (o *literalOperand) String() string {
+	if !o.list {
+		return strconv.Quote(o.vals[0])
+	}
+	s := make([]string, len(o.vals))
+	for i, v := range o.vals {
+		s[i] = strconv.Quote(v)
+	}
+	return "[" + strings.Join(s, ", ") + "]"
+}
+
+func formatName(name string) string {
+	for i, c := range name {
+		if !isIdentRune(c, i == 0) {
+			return "attr(" + strconv.Quote(name) + ")"
+		}
+	}
+	return name
+}
+
+// Lexer
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func isIdentRune(c rune, first bool) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_':
+		return true
+	case first:
+		return false
+	case c >= '0' && c <= '9', c == '.', c == '-', c == ':':
+		return true
+	}
+	return false
+}
+
+func lex(src string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(src); {
+		c := rune(src[i])
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case isIdentRune(c, true):
+			start := i
+			for i < len(src) && isIdentRune(rune(src[i]), false) {
+				i++
+			}
+			tokens = append(tokens, token{tokIdent, src[start:i], start})
+		case c == '"' || c == '`':
+			start := i
+			i++
+			for i < len(src) && rune(src[i]) != c {
+				if c == '"' && src[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			if i >= len(src) {
+				return nil, fmt.Errorf("%d: unterminated string", start+1)
+			}
+			i++
+			s, err := strconv.Unquote(src[start:i])
+			if err != nil {
+				return nil, fmt.Errorf("%d: invalid string %s", start+1, src[start:i])
+			}
+			tokens = append(tokens, token{tokString, s, start})
+		default:
+			op := ""
+			for _, o := range []string{"&&", "||", "==", "!=", "!", "(", ")", "[", "]", ","} {
+				if strings.HasPrefix(src[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("%d: unexpected character %q", i+1, c)
+			}
+			tokens = append(tokens, token{tokOp, op, i})
+			i += len(op)
+		}
+	}
+	return append(tokens, token{tokEOF, "", len(src)}), nil
+}
+
+// Parser
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func parseExpr(src string) (expr, error) {
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	x, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, p.errorf(t, "unexpected %q", t.text)
+	}
+	return x, nil
+}
+
+func (p *parser) peek() token { return p.tokens[p.pos] }
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) is(kind tokenKind, text string) bool {
+	t := p.peek()
+	return t.kind == kind && t.text == text
+}
+
+func (p *parser) expect(text string) error {
+	if t := p.next(); t.kind != tokOp || t.text != text {
+		return p.errorf(t, "expected %q", text)
+	}
+	return nil
+}
+
+func (p *parser) errorf(t token, format string, args ...interface{}) error {
+	if t.kind == tokEOF {
+		return fmt.Errorf("%d: %s, got end of expression", t.pos+1, fmt.Sprintf(format, args...))
+	}
+	return fmt.Errorf("%d: %s", t.pos+1, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) parseOr() (expr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.is(tokOp, "||") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orExpr{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (expr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.is(tokOp, "&&") {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &andExpr{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (expr, error) {
+	if p.is(tokOp, "!") {
+		p.next()
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notExpr{x}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (expr, error) {
+	if p.is(tokOp, "(") {
+		p.next()
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return x, nil
+	}
+
+	if p.is(tokIdent, "has") {
+		p.next()
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		t := p.next()
+		if t.kind != tokIdent && t.kind != tokString {
+			return nil, p.errorf(t, "expected attribute name")
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return &hasExpr{t.text}, nil
+	}
+
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	t := p.next()
+	x := &cmpExpr{op: t.text, left: left}
+	switch {
+	case t.kind == tokOp && (t.text == "==" || t.text == "!="):
+	case t.kind == tokIdent && t.text == "in":
+	case t.kind == tokIdent && t.text == "matches":
+		r := p.next()
+		if r.kind != tokString {
+			return nil, p.errorf(r, "expected regular expression string")
+		}
+		re, err := regexp.Compile(r.text)
+		if err != nil {
+			return nil, p.errorf(r, "%v", err)
+		}
+		x.re = re
+		x.right = &literalOperand{vals: []string{r.text}}
+		return x, nil
+	default:
+		return nil, p.errorf(t, "expected comparison operator")
+	}
+
+	if x.right, err = p.parseOperand(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+func (p *parser) parseOperand() (operand, error) {
+	t := p.next()
+	switch {
+	case t.kind == tokString:
+		return &literalOperand{vals: []string{t.text}}, nil
+
+	case t.kind == tokOp && t.text == "[":
+		o := &literalOperand{list: true, vals: []string{}}
+		for !p.is(tokOp, "]") {
+			if len(o.vals) > 0 {
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+			v := p.next()
+			if v.kind != tokString {
+				return nil, p.errorf(v, "expected string")
+			}
+			o.vals = append(o.vals, v.text)
+		}
+		p.next()
+		return o, nil
+
+	case t.kind == tokIdent && t.text == "attr" && p.is(tokOp, "("):
+		p.next()
+		name := p.next()
+		if name.kind != tokString {
+			return nil, p.errorf(name, "expected attribute name string")
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return &attrOperand{name.text}, nil
+
+	case t.kind == tokIdent && strings.HasPrefix(t.text, "request."):
+		field := strings.TrimPrefix(t.text, "request.")
+		if !requestFields[field] {
+			return nil, p.errorf(t, "unknown request field %q", field)
+		}
+		return &requestOperand{field}, nil
+
+	case t.kind == tokIdent:
+		return &attrOperand{t.text}, nil
+	}
+	return nil, p.errorf(t, "expected attribute, string or list")
+}
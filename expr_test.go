@@ -0,0 +1,180 @@
+package authorizer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/crewjam/saml/samlsp"
+)
+
+func TestParseExprEval(t *testing.T) {
+	e := &env{
+		attributes: samlsp.Attributes{
+			"name":                              []string{"Alice"},
+			"mail":                              []string{"alice@example.com"},
+			"group":                             []string{"users", "sre"},
+			"urn:oid:0.9.2342.19200300.100.1.1": []string{"alice"},
+			"http://schemas.xmlsoap.org/claims/Group": []string{"Domain Users"},
+		},
+		request: map[string]string{
+			"host":   "grafana.example.com",
+			"path":   "/admin",
+			"method": "GET",
+			"ip":     "10.0.0.1",
+		},
+	}
+	tests := []struct {
+		name string
+		src  string
+		want bool
+	}{
+		{"Equals", `name == "Alice"`, true},
+		{"EqualsAnyValue", `group == "sre"`, true},
+		{"NotEquals", `group != "contractors"`, true},
+		{"NotEqualsAnyValue", `group != "users"`, false},
+		{"In", `group in ["admins", "sre"]`, true},
+		{"NotIn", `!(group in ["admins", "contractors"])`, true},
+		{"EmptyList", `group in []`, false},
+		{"Matches", "mail matches `@example\\.com$`", true},
+		{"MatchesEscaped", `mail matches "@example\\.org$"`, false},
+		{"Has", `has(mail)`, true},
+		{"HasMissing", `has(phone)`, false},
+		{"HasQuoted", `has("http://schemas.xmlsoap.org/claims/Group")`, true},
+		{"Attr", `attr("http://schemas.xmlsoap.org/claims/Group") == "Domain Users"`, true},
+		{"OIDIdentifier", `urn:oid:0.9.2342.19200300.100.1.1 == "alice"`, true},
+		{"AndOr", `(name == "Bob" && group == "sre") || group == "users"`, true},
+		{"AndPrecedence", `name == "Bob" && group == "sre" || name == "Carol"`, false},
+		{"OrPrecedence", `name == "Alice" || name == "Bob" && group == "admins"`, true},
+		{"Not", `!has(phone) && !!has(mail)`, true},
+		{"RequestHost", `request.host == "grafana.example.com"`, true},
+		{"RequestMethod", `request.method in ["POST", "DELETE"]`, false},
+		{"RequestPath", `request.path matches "^/admin"`, true},
+		{"RequestIP", `request.ip == "10.0.0.1" && group == "sre"`, true},
+		{"AttributeToAttribute", `name == name`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			x, err := parseExpr(tt.src)
+			if err != nil {
+				t.Fatalf("parseExpr(%s) error = %v", tt.src, err)
+			}
+			if got := x.eval(e); got != tt.want {
+				t.Errorf("eval(%s) = %v, want %v", x, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseExprErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"Empty", ``, `1: expected attribute, string or list, got end of expression`},
+		{"MissingOperator", `name "Alice"`, `6: expected comparison operator`},
+		{"MissingParen", `(name == "Alice"`, `17: expected ")", got end of expression`},
+		{"Trailing", `name == "Alice")`, `16: unexpected ")"`},
+		{"BadRegex", `name matches "("`, "14: error parsing regexp: missing closing ): `(`"},
+		{"RegexNotString", `name matches other`, `14: expected regular expression string`},
+		{"UnterminatedString", `name == "Alice`, `9: unterminated string`},
+		{"UnknownCharacter", `name = "Alice"`, `6: unexpected character '='`},
+		{"UnknownRequestField", `request.query == "x"`, `1: unknown request field "query"`},
+		{"BadList", `name in ["a" "b"]`, `14: expected ","`},
+		{"HasWithoutName", `has()`, `5: expected attribute name`},
+		{"SingleAmpersand", `has(a) & has(b)`, `8: unexpected character '&'`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseExpr(tt.src)
+			if err == nil {
+				t.Fatalf("parseExpr(%s) expected error", tt.src)
+			}
+			if got := err.Error(); got != tt.want {
+				t.Errorf("parseExpr(%s) error = %s, want %s", tt.src, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExprString(t *testing.T) {
+	x, err := parseExpr(`has(mail) && !(group in ["a","b"]) || attr("x/y") == "z"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, want := x.String(), `((has(mail) && !(group in ["a", "b"])) || attr("x/y") == "z")`
+	if got != want {
+		t.Errorf("expr.String() = %s, want %s", got, want)
+	}
+}
+
+func TestNewEnv(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/saml/auth", nil)
+	req.Header.Set("X-Original-URL", "https://Grafana.example.com/admin")
+	req.Header.Set("X-Original-Method", "POST")
+	req.Header.Set("X-Forwarded-For", "10.0.0.1, 10.0.0.2")
+
+	s := fakeAuthService(&validUser{}, nil)
+	e := newEnv(req, s.originalURL(req), nil)
+
+	want := map[string]string{
+		"host":   "grafana.example.com",
+		"path":   "/admin",
+		"method": "POST",
+		"ip":     "10.0.0.1",
+	}
+	for k, v := range want {
+		if got := e.request[k]; got != v {
+			t.Errorf("request.%s = %s, want %s", k, got, v)
+		}
+	}
+}
+
+func TestAuthHandlerPolicyExpression(t *testing.T) {
+	s := fakeAuthService(&validUser{}, nil)
+	s.Reload(&Settings{ACL: mustNewACL(nil, []Policy{{
+		Host:       "grafana.example.com",
+		Expression: `group == "users" && request.method != "DELETE"`,
+	}, {
+		Host:               "wiki.example.com",
+		RequiredAttributes: []requirement{{"name": "Alice"}},
+		Expression:         `group == "admins"`,
+	}})})
+
+	tests := []struct {
+		name   string
+		url    string
+		method string
+		want   int
+	}{
+		{"ExpressionShouldPass", "https://grafana.example.com/", "GET", http.StatusAccepted},
+		{"RequestMetadataShouldFail", "https://grafana.example.com/", "DELETE", http.StatusUnauthorized},
+		{"RequirementsAndExpressionShouldFail", "https://wiki.example.com/", "GET", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/saml/auth", nil)
+			req.Header.Set("X-Original-URL", tt.url)
+			req.Header.Set("X-Original-Method", tt.method)
+			res := httptest.NewRecorder()
+
+			s.Auth(res, req)
+
+			if got := res.Code; got != tt.want {
+				t.Errorf("got status %d but wanted %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewACLInvalidExpression(t *testing.T) {
+	_, err := NewACL(Policy{}, []Policy{{
+		Host:       "grafana.example.com",
+		Expression: `group ==`,
+	}})
+	want := `policy grafana.example.com: policy expression: 9: expected attribute, string or list, got end of expression`
+	if err == nil || err.Error() != want {
+		t.Errorf("NewACL() error = %v, want %s", err, want)
+	}
+}
@@ -0,0 +1,335 @@
+package authorizer
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/crewjam/saml/samlsp"
+)
+
+// HeadersConfig controls which attributes are passed to upstream in auth
+// response headers. Zero value gives oauth2-proxy compatible headers.
+type HeadersConfig struct {
+	// Mapping of attribute name to header name, nil means DefaultHeaders
+	Mapping map[string]string `yaml:"mapping"`
+	// Allow lists attribute name patterns, * matches anything, forwarded
+	// as Prefix followed by attribute name when not in Mapping
+	Allow []string `yaml:"allow"`
+	// Deny lists attribute name patterns never forwarded, even if mapped
+	Deny []string `yaml:"deny"`
+	// Prefix of headers for allowed attributes, default X-
+	Prefix string `yaml:"prefix"`
+	// Multivalue is join (default) to send one header with values joined
+	// by Separator or repeat to send header for every value
+	Multivalue string `yaml:"multivalue"`
+	// Separator of joined values, default ,
+	Separator string `yaml:"separator"`
+	// Encoding of values per header name, one of raw, rfc2047, percent or
+	// base64
+	Encoding map[string]string `yaml:"encoding"`
+	// DefaultEncoding of headers not listed in Encoding, default raw
+	DefaultEncoding string `yaml:"defaultencoding"`
+}
+
+// DefaultHeaders maps common attributes to headers set by oauth2-proxy
+var DefaultHeaders = map[string]string{
+	"uid":                    "X-Auth-Request-User",
+	"mail":                   "X-Auth-Request-Email",
+	"groups":                 "X-Auth-Request-Groups",
+	"eduPersonPrincipalName": "X-Auth-Request-Preferred-Username",
+}
+
+// HeaderMap turns session attributes into auth response headers
+type HeaderMap struct {
+	mapping   map[string]string
+	allow     []*regexp.Regexp
+	deny      []*regexp.Regexp
+	prefix    string
+	repeat    bool
+	separator string
+	encoding  map[string]encoder
+	fallback  encoder
+	// reserved are canonical names of mapped headers and headers set by
+	// authorizer, allowed attributes and policy decision point can not
+	// set them
+	reserved map[string]bool
+}
+
+// encoder returns value safe to use in header or false if value can not be
+// represented
+type encoder func(v string) (string, bool)
+
+var encoders = map[string]encoder{
+	"raw": func(v string) (string, bool) {
+		for i := 0; i < len(v); i++ {
+			if v[i] >= utf8.RuneSelf {
+				return "", false
+			}
+		}
+		return v, true
+	},
+	"rfc2047": func(v string) (string, bool) {
+		return mime.QEncoding.Encode("utf-8", v), true
+	},
+	"percent": func(v string) (string, bool) {
+		return strings.ReplaceAll(url.QueryEscape(v), "+", "%20"), true
+	},
+	"base64": func(v string) (string, bool) {
+		return base64.StdEncoding.EncodeToString([]byte(v)), true
+	},
+}
+
+func newEncoder(name string) (encoder, error) {
+	if name == "" {
+		name = "raw"
+	}
+	e, ok := encoders[name]
+	if !ok {
+		return nil, fmt.Errorf("%q must be raw, rfc2047, percent or base64", name)
+	}
+	return e, nil
+}
+
+var defaultHeaderMap, _ = NewHeaderMap(HeadersConfig{})
+
+// headerName matches RFC 7230 token
+var headerName = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+// NewHeaderMap returns HeaderMap for config
+func NewHeaderMap(c HeadersConfig) (*HeaderMap, error) {
+	m := &HeaderMap{
+		mapping:   c.Mapping,
+		prefix:    c.Prefix,
+		separator: c.Separator,
+	}
+	if m.mapping == nil {
+		m.mapping = DefaultHeaders
+	}
+	if m.prefix == "" {
+		m.prefix = "X-"
+	}
+	if m.separator == "" {
+		m.separator = ","
+	}
+
+	switch c.Multivalue {
+	case "", "join":
+	case "repeat":
+		m.repeat = true
+	default:
+		return nil, fmt.Errorf("multivalue: %q must be join or repeat", c.Multivalue)
+	}
+	if strings.ContainsAny(m.separator, "\r\n") {
+		return nil, errors.New("separator: must not contain line breaks")
+	}
+	if !headerName.MatchString(m.prefix) {
+		return nil, fmt.Errorf("prefix: %q is not valid header name", m.prefix)
+	}
+
+	m.reserved = map[string]bool{}
+	for _, name := range sortedKeys(m.mapping) {
+		if !headerName.MatchString(m.mapping[name]) {
+			return nil, fmt.Errorf("mapping: %s: %q is not valid header name", name, m.mapping[name])
+		}
+		m.reserved[http.CanonicalHeaderKey(m.mapping[name])] = true
+	}
+	m.reserve(decisionHeader)
+
+	var err error
+	if m.fallback, err = newEncoder(c.DefaultEncoding); err != nil {
+		return nil, fmt.Errorf("defaultencoding: %w", err)
+	}
+	m.encoding = map[string]encoder{}
+	for _, header := range sortedKeys(c.Encoding) {
+		if !headerName.MatchString(header) {
+			return nil, fmt.Errorf("encoding: %q is not valid header name", header)
+		}
+		e, err := newEncoder(c.Encoding[header])
+		if err != nil {
+			return nil, fmt.Errorf("encoding: %s: %w", header, err)
+		}
+		m.encoding[http.CanonicalHeaderKey(header)] = e
+	}
+
+	if m.allow, err = compilePatterns(c.Allow); err != nil {
+		return nil, fmt.Errorf("allow: %w", err)
+	}
+	if m.deny, err = compilePatterns(c.Deny); err != nil {
+		return nil, fmt.Errorf("deny: %w", err)
+	}
+	return m, nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for _, p := range patterns {
+		if p == "" {
+			return nil, errors.New("empty pattern")
+		}
+		re := "^" + strings.ReplaceAll(regexp.QuoteMeta(p), `\*`, ".*") + "$"
+		res = append(res, regexp.MustCompile(re))
+	}
+	return res, nil
+}
+
+func matchAny(patterns []*regexp.Regexp, name string) bool {
+	for _, re := range patterns {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// invalidHeaderChars matches characters not allowed in header names
+var invalidHeaderChars = regexp.MustCompile("[^!#$%&'*+.^_`|~0-9A-Za-z-]+")
+
+// header returns canonical header name for attribute or empty string when
+// attribute must not be forwarded. Allowed attributes can not take names
+// of mapped headers or headers set by authorizer, otherwise IdP could
+// spoof identity with attribute named e.g. Auth-Request-User.
+func (m *HeaderMap) header(name string) string {
+	if matchAny(m.deny, name) {
+		return ""
+	}
+	if h, ok := m.mapping[name]; ok {
+		return http.CanonicalHeaderKey(h)
+	}
+	if matchAny(m.allow, name) {
+		if name = strings.Trim(invalidHeaderChars.ReplaceAllString(name, "-"), "-"); name != "" {
+			if h := http.CanonicalHeaderKey(m.prefix + name); !m.reserved[h] {
+				return h
+			}
+		}
+	}
+	return ""
+}
+
+// set adds headers for attributes to h, returns names of headers set and
+// names of attributes with values that could not be encoded and were left
+// out
+func (m *HeaderMap) set(h http.Header, attributes samlsp.Attributes) (headers, rejected []string) {
+	if m == nil {
+		m = defaultHeaderMap
+	}
+
+	names := make([]string, 0, len(attributes))
+	for name := range attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	values := map[string][]string{}
+	for _, name := range names {
+		header := m.header(name)
+		if header == "" {
+			continue
+		}
+		encode, ok := m.encoding[header]
+		if !ok {
+			encode = m.fallback
+		}
+		for _, v := range attributes[name] {
+			v = stripControl(v)
+			if v == "" {
+				continue
+			}
+			if v, ok = encode(v); !ok {
+				rejected = append(rejected, name)
+				continue
+			}
+			if _, ok := values[header]; !ok {
+				headers = append(headers, header)
+			}
+			values[header] = append(values[header], v)
+		}
+	}
+
+	for _, header := range headers {
+		if m.repeat {
+			for _, v := range values[header] {
+				h.Add(header, v)
+			}
+			continue
+		}
+		h.Set(header, strings.Join(values[header], m.separator))
+	}
+	return headers, rejected
+}
+
+// reserve keeps headers, e.g. token and signature headers, from being set
+// by policy decision point
+func (m *HeaderMap) reserve(names ...string) {
+	for _, name := range names {
+		if name != "" {
+			m.reserved[http.CanonicalHeaderKey(name)] = true
+		}
+	}
+}
+
+// setDecision adds headers returned by policy decision point to h, values
+// are sanitized and encoded like attribute values. Reserved headers and
+// headers in taken are refused. Returns names of headers set and refused.
+func (m *HeaderMap) setDecision(h http.Header, headers map[string]string, taken []string) (set, refused []string) {
+	if m == nil {
+		m = defaultHeaderMap
+	}
+	skip := map[string]bool{}
+	for _, name := range taken {
+		skip[http.CanonicalHeaderKey(name)] = true
+	}
+	for _, name := range sortedKeys(headers) {
+		header := http.CanonicalHeaderKey(name)
+		if !headerName.MatchString(name) || m.reserved[header] || skip[header] {
+			refused = append(refused, name)
+			continue
+		}
+		encode, ok := m.encoding[header]
+		if !ok {
+			encode = m.fallback
+		}
+		v := stripControl(headers[name])
+		if v == "" {
+			continue
+		}
+		if v, ok = encode(v); !ok {
+			refused = append(refused, name)
+			continue
+		}
+		h.Set(header, v)
+		set = append(set, header)
+	}
+	return set, refused
+}
+
+// stripControl turns line breaks and tabs into spaces and removes other
+// control characters and invalid UTF-8
+func stripControl(v string) string {
+	return strings.TrimSpace(strings.Map(func(r rune) rune {
+		switch {
+		case r == '\t' || r == '\n' || r == '\v' || r == '\f' || r == '\r':
+			return ' '
+		case r == utf8.RuneError || unicode.IsControl(r):
+			return -1
+		}
+		return r
+	}, v))
+}
@@ -0,0 +1,301 @@
+package authorizer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/crewjam/saml/samlsp"
+)
+
+func mustNewHeaderMap(c HeadersConfig) *HeaderMap {
+	m, err := NewHeaderMap(c)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+func TestHeaderMapSet(t *testing.T) {
+	attributes := samlsp.Attributes{
+		"uid":                               {"alice"},
+		"mail":                              {"alice@example.com"},
+		"groups":                            {"sre", "users"},
+		"displayName":                       {"Alice"},
+		"urn:oid:0.9.2342.19200300.100.1.3": {"alice@example.org"},
+		"empty":                             {},
+	}
+	tests := []struct {
+		name   string
+		config HeadersConfig
+		want   http.Header
+	}{{
+		name:   "Default",
+		config: HeadersConfig{},
+		want: http.Header{
+			"X-Auth-Request-User":   {"alice"},
+			"X-Auth-Request-Email":  {"alice@example.com"},
+			"X-Auth-Request-Groups": {"sre,users"},
+		},
+	}, {
+		name: "Mapping",
+		config: HeadersConfig{Mapping: map[string]string{
+			"mail":        "X-Email",
+			"displayName": "X-Name",
+		}},
+		want: http.Header{
+			"X-Email": {"alice@example.com"},
+			"X-Name":  {"Alice"},
+		},
+	}, {
+		name: "AllowAndDeny",
+		config: HeadersConfig{
+			Mapping: map[string]string{"mail": "X-Email", "uid": "X-User"},
+			Allow:   []string{"*"},
+			Deny:    []string{"mail", "urn:*"},
+			Prefix:  "X-Saml-",
+		},
+		want: http.Header{
+			"X-User":             {"alice"},
+			"X-Saml-Groups":      {"sre,users"},
+			"X-Saml-Displayname": {"Alice"},
+		},
+	}, {
+		name: "SanitizedName",
+		config: HeadersConfig{
+			Mapping: map[string]string{},
+			Allow:   []string{"urn:oid:*"},
+		},
+		want: http.Header{
+			"X-Urn-Oid-0.9.2342.19200300.100.1.3": {"alice@example.org"},
+		},
+	}, {
+		name: "Repeat",
+		config: HeadersConfig{
+			Mapping:    map[string]string{"groups": "X-Groups"},
+			Multivalue: "repeat",
+		},
+		want: http.Header{
+			"X-Groups": {"sre", "users"},
+		},
+	}, {
+		name: "SameHeader",
+		config: HeadersConfig{
+			Mapping:   map[string]string{"groups": "X-Who", "uid": "X-Who"},
+			Separator: ";",
+		},
+		want: http.Header{
+			"X-Who": {"sre;users;alice"},
+		},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := http.Header{}
+			mustNewHeaderMap(tt.config).set(got, attributes)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("HeaderMap.set() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHeaderMapEncoding(t *testing.T) {
+	attributes := samlsp.Attributes{
+		"uid":    {"alice"},
+		"name":   {"Zoë Ångström"},
+		"cn":     {"山田太郎"},
+		"title":  {"line\r\nX-Injected: 1"},
+		"desc":   {"\x00\x1b[31mred\x7f\u0085", "\xff\xfe", " \t "},
+		"groups": {"a,b", "ünits"},
+	}
+	tests := []struct {
+		name         string
+		config       HeadersConfig
+		want         http.Header
+		wantRejected []string
+	}{{
+		name: "Raw",
+		config: HeadersConfig{
+			Mapping: map[string]string{
+				"uid": "X-User", "name": "X-Name", "cn": "X-Cn",
+				"title": "X-Title", "desc": "X-Desc", "groups": "X-Groups",
+			},
+		},
+		want: http.Header{
+			"X-User":   {"alice"},
+			"X-Title":  {"line  X-Injected: 1"},
+			"X-Desc":   {"[31mred"},
+			"X-Groups": {"a,b"},
+		},
+		wantRejected: []string{"cn", "groups", "name"},
+	}, {
+		name: "PerHeader",
+		config: HeadersConfig{
+			Mapping: map[string]string{
+				"uid": "X-User", "name": "X-Name", "cn": "X-Cn", "groups": "X-Groups",
+			},
+			Encoding: map[string]string{
+				"x-name":   "rfc2047",
+				"X-Cn":     "base64",
+				"X-Groups": "percent",
+			},
+		},
+		want: http.Header{
+			"X-User":   {"alice"},
+			"X-Name":   {"=?utf-8?q?Zo=C3=AB_=C3=85ngstr=C3=B6m?="},
+			"X-Cn":     {"5bGx55Sw5aSq6YOO"},
+			"X-Groups": {"a%2Cb,%C3%BCnits"},
+		},
+	}, {
+		name: "Default",
+		config: HeadersConfig{
+			Mapping:         map[string]string{"uid": "X-User", "title": "X-Title"},
+			DefaultEncoding: "percent",
+		},
+		want: http.Header{
+			"X-User":  {"alice"},
+			"X-Title": {"line%20%20X-Injected%3A%201"},
+		},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := http.Header{}
+			_, rejected := mustNewHeaderMap(tt.config).set(got, attributes)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("HeaderMap.set() = %q, want %q", got, tt.want)
+			}
+			if !reflect.DeepEqual(rejected, tt.wantRejected) {
+				t.Errorf("HeaderMap.set() rejected %v, want %v", rejected, tt.wantRejected)
+			}
+		})
+	}
+}
+
+func TestNewHeaderMapErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config HeadersConfig
+		want   string
+	}{{
+		name:   "Multivalue",
+		config: HeadersConfig{Multivalue: "first"},
+		want:   `multivalue: "first" must be join or repeat`,
+	}, {
+		name:   "Separator",
+		config: HeadersConfig{Separator: "\r\n"},
+		want:   "separator: must not contain line breaks",
+	}, {
+		name:   "Prefix",
+		config: HeadersConfig{Prefix: "X Saml"},
+		want:   `prefix: "X Saml" is not valid header name`,
+	}, {
+		name:   "Mapping",
+		config: HeadersConfig{Mapping: map[string]string{"mail": "X-Email:"}},
+		want:   `mapping: mail: "X-Email:" is not valid header name`,
+	}, {
+		name:   "Deny",
+		config: HeadersConfig{Deny: []string{""}},
+		want:   "deny: empty pattern",
+	}, {
+		name:   "Encoding",
+		config: HeadersConfig{Encoding: map[string]string{"X-Name": "utf8"}},
+		want:   `encoding: X-Name: "utf8" must be raw, rfc2047, percent or base64`,
+	}, {
+		name:   "DefaultEncoding",
+		config: HeadersConfig{DefaultEncoding: "quoted"},
+		want:   `defaultencoding: "quoted" must be raw, rfc2047, percent or base64`,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewHeaderMap(tt.config)
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("NewHeaderMap() error = %v, want %s", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestHeaderMapSetReserved(t *testing.T) {
+	m := mustNewHeaderMap(HeadersConfig{Allow: []string{"*"}, Prefix: "X-"})
+	m.reserve("X-Auth-Request-Signature")
+
+	h := http.Header{}
+	headers, _ := m.set(h, samlsp.Attributes{
+		"uid":                    {"alice"},
+		"Auth-Request-User":      {"mallory"},
+		"auth-request-email":     {"mallory@example.com"},
+		"Auth-Request-Signature": {"forged"},
+		"dept":                   {"sre"},
+		"Dept":                   {"ops"},
+	})
+	want := http.Header{
+		"X-Auth-Request-User": {"alice"},
+		"X-Dept":              {"ops,sre"},
+	}
+	if !reflect.DeepEqual(h, want) {
+		t.Errorf("got headers %v, want %v", h, want)
+	}
+	if want := []string{"X-Dept", "X-Auth-Request-User"}; !reflect.DeepEqual(headers, want) {
+		t.Errorf("headers = %v, want %v", headers, want)
+	}
+}
+
+func TestHeaderMapSetDecision(t *testing.T) {
+	m := mustNewHeaderMap(HeadersConfig{
+		Allow:    []string{"*"},
+		Encoding: map[string]string{"X-Team": "percent"},
+	})
+	m.reserve("Authorization", "X-Auth-Request-Signature")
+
+	h := http.Header{}
+	set, refused := m.setDecision(h, map[string]string{
+		"x-tenant":                 "sre\r\nX-Injected: 1",
+		"X-Team":                   "Zespół",
+		"X-Auth-Request-User":      "mallory",
+		"authorization":            "Bearer forged",
+		"X-Auth-Request-Signature": "forged",
+		"X-Auth-Decision":          "allowed",
+		"X-Saml-Mail":              "mallory@example.com",
+		"X Bad":                    "value",
+	}, []string{"X-Saml-Mail"})
+
+	want := http.Header{
+		"X-Tenant": {"sre  X-Injected: 1"},
+		"X-Team":   {"Zesp%C3%B3%C5%82"},
+	}
+	if !reflect.DeepEqual(h, want) {
+		t.Errorf("got headers %v, want %v", h, want)
+	}
+	if want := []string{"X-Team", "X-Tenant"}; !reflect.DeepEqual(set, want) {
+		t.Errorf("set = %v, want %v", set, want)
+	}
+	wantRefused := []string{"X Bad", "X-Auth-Decision", "X-Auth-Request-Signature", "X-Auth-Request-User", "X-Saml-Mail", "authorization"}
+	if !reflect.DeepEqual(refused, wantRefused) {
+		t.Errorf("refused = %v, want %v", refused, wantRefused)
+	}
+}
+
+func TestAuthHandlerHeaders(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/saml/auth", nil)
+	res := httptest.NewRecorder()
+
+	s := fakeAuthService(&validUser{}, nil)
+	s.Reload(&Settings{
+		Headers: mustNewHeaderMap(HeadersConfig{
+			Mapping: map[string]string{"mail": "X-Auth-Request-Email"},
+		}),
+	})
+
+	s.Auth(res, req)
+
+	if got, want := res.Code, http.StatusAccepted; got != want {
+		t.Errorf("got status %d but wanted %d", got, want)
+	}
+	want := http.Header{
+		"X-Auth-Request-Email": {"alice@example.com"},
+	}
+	if got := res.Header(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got headers %v but wanted %v", got, want)
+	}
+}
@@ -0,0 +1,207 @@
+// Package headersig signs identity headers set by ingress-saml-authorizer
+// and verifies them in upstream services.
+//
+// Signature covers request host name without port, timestamp and listed
+// headers, it is
+// passed in Header as
+//
+//	v1;t=<unix time>;h=<comma separated header names>;s=<base64url HMAC-SHA256>
+//
+// Upstream wraps its handler with Verifier.Middleware to reject requests
+// with missing, stale or tampered headers:
+//
+//	v := &headersig.Verifier{
+//		Secrets:   [][]byte{secret},
+//		Protected: []string{"X-Auth-Request-User", "X-Auth-Request-Email"},
+//	}
+//	http.ListenAndServe(":8080", v.Middleware(handler))
+package headersig
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Header is default name of signature header
+const Header = "X-Auth-Request-Signature"
+
+const version = "v1"
+
+// Errors returned by Verify
+var (
+	ErrMissing   = errors.New("headersig: signature header missing")
+	ErrMalformed = errors.New("headersig: malformed signature header")
+	ErrStale     = errors.New("headersig: signature expired")
+	ErrInvalid   = errors.New("headersig: signature mismatch")
+	ErrUnsigned  = errors.New("headersig: protected header not signed")
+)
+
+// Sign returns signature header value covering host, time t and headers
+// names from h. Absent headers are signed as empty so they can not be
+// added later.
+func Sign(secret []byte, host string, h http.Header, names []string, t time.Time) string {
+	names = normalize(names)
+	ts := strconv.FormatInt(t.Unix(), 10)
+	sig := mac(secret, ts, host, h, names)
+	return fmt.Sprintf("%s;t=%s;h=%s;s=%s", version, ts, strings.Join(names, ","), sig)
+}
+
+func normalize(names []string) []string {
+	seen := map[string]bool{}
+	var res []string
+	for _, name := range names {
+		name = strings.ToLower(name)
+		if !seen[name] {
+			seen[name] = true
+			res = append(res, name)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+func mac(secret []byte, ts, host string, h http.Header, names []string) string {
+	m := hmac.New(sha256.New, secret)
+	fmt.Fprintf(m, "%s\n%s\n%s\n", version, ts, hostname(host))
+	for _, name := range names {
+		fmt.Fprintf(m, "%s:%s\n", name, canonicalValue(h.Values(name)))
+	}
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+// canonicalValue returns values of header as comma separated list without
+// spaces around items; NGINX passes repeated auth response headers to
+// upstream joined with ", "
+func canonicalValue(values []string) string {
+	items := strings.Split(strings.Join(values, ","), ",")
+	for i, item := range items {
+		items[i] = strings.TrimSpace(item)
+	}
+	return strings.Join(items, ",")
+}
+
+// hostname returns host without port in lowercase, authorizer signs host
+// name of original URL while upstream sees Host header with port
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"))
+}
+
+// Verifier checks signatures of incoming requests
+type Verifier struct {
+	// Secrets shared with authorizer, more than one during rotation
+	Secrets [][]byte
+	// Header with signature, default Header
+	Header string
+	// MaxAge of signature, default 5 minutes; must be longer than NGINX
+	// auth cache duration
+	MaxAge time.Duration
+	// Protected headers must be signed when present
+	Protected []string
+
+	// Now returns current time, default time.Now
+	Now func() time.Time
+}
+
+// Verify checks signature of r and returns names of signed headers
+func (v *Verifier) Verify(r *http.Request) ([]string, error) {
+	header := v.Header
+	if header == "" {
+		header = Header
+	}
+	value := r.Header.Get(header)
+	if value == "" {
+		return nil, ErrMissing
+	}
+
+	fields := strings.Split(value, ";")
+	if len(fields) != 4 || fields[0] != version {
+		return nil, ErrMalformed
+	}
+	params := map[string]string{}
+	for _, f := range fields[1:] {
+		i := strings.IndexByte(f, '=')
+		if i < 0 {
+			return nil, ErrMalformed
+		}
+		params[f[:i]] = f[i+1:]
+	}
+	ts, names, sig := params["t"], params["h"], params["s"]
+	if ts == "" || sig == "" {
+		return nil, ErrMalformed
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	var signed []string
+	if names != "" {
+		signed = strings.Split(names, ",")
+	}
+	if strings.Join(normalize(signed), ",") != names {
+		return nil, ErrMalformed
+	}
+
+	now, maxAge := time.Now, v.MaxAge
+	if v.Now != nil {
+		now = v.Now
+	}
+	if maxAge == 0 {
+		maxAge = 5 * time.Minute
+	}
+	age := now().Sub(time.Unix(unix, 0))
+	if age > maxAge || age < -time.Minute {
+		return nil, ErrStale
+	}
+
+	valid := false
+	for _, secret := range v.Secrets {
+		if hmac.Equal([]byte(mac(secret, ts, r.Host, r.Header, signed)), []byte(sig)) {
+			valid = true
+		}
+	}
+	if !valid {
+		return nil, ErrInvalid
+	}
+
+	for _, p := range v.Protected {
+		if r.Header.Get(p) == "" {
+			continue
+		}
+		if !contains(signed, strings.ToLower(p)) {
+			return nil, fmt.Errorf("%w: %s", ErrUnsigned, p)
+		}
+	}
+	return signed, nil
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware rejects requests failing Verify with 401 Unauthorized
+func (v *Verifier) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := v.Verify(r); err != nil {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
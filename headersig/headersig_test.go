@@ -0,0 +1,130 @@
+package headersig
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var (
+	secret = []byte("0123456789abcdef0123456789abcdef")
+	now    = time.Unix(1700000000, 0)
+)
+
+func signedRequest() *http.Request {
+	h := http.Header{}
+	h.Set("X-Auth-Request-User", "alice")
+	h.Set("X-Auth-Request-Email", "alice@example.com")
+	h.Add("X-Auth-Request-Groups", "sre")
+	h.Add("X-Auth-Request-Groups", "users")
+
+	r := httptest.NewRequest(http.MethodGet, "http://grafana.example.com/", nil)
+	for name, v := range h {
+		r.Header[name] = v
+	}
+	r.Header.Set(Header, Sign(secret, "grafana.example.com", h, []string{"X-Auth-Request-User", "X-Auth-Request-Email", "X-Auth-Request-Groups"}, now))
+	return r
+}
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(r *http.Request)
+		verify  Verifier
+		wantErr error
+	}{{
+		name: "Valid",
+	}, {
+		name:   "RotatedSecret",
+		verify: Verifier{Secrets: [][]byte{[]byte("new secret"), secret}},
+	}, {
+		name:    "WrongSecret",
+		verify:  Verifier{Secrets: [][]byte{[]byte("other")}},
+		wantErr: ErrInvalid,
+	}, {
+		name:    "Missing",
+		modify:  func(r *http.Request) { r.Header.Del(Header) },
+		wantErr: ErrMissing,
+	}, {
+		name:    "Malformed",
+		modify:  func(r *http.Request) { r.Header.Set(Header, "v1;t=1;s=abc") },
+		wantErr: ErrMalformed,
+	}, {
+		name:    "TamperedValue",
+		modify:  func(r *http.Request) { r.Header.Set("X-Auth-Request-User", "mallory") },
+		wantErr: ErrInvalid,
+	}, {
+		name:    "AddedSignedHeader",
+		modify:  func(r *http.Request) { r.Header.Set("X-Auth-Request-Groups", "admins") },
+		wantErr: ErrInvalid,
+	}, {
+		name:    "RemovedHeader",
+		modify:  func(r *http.Request) { r.Header.Del("X-Auth-Request-Email") },
+		wantErr: ErrInvalid,
+	}, {
+		name:   "HostWithPort",
+		modify: func(r *http.Request) { r.Host = "Grafana.example.com:8443" },
+	}, {
+		name:   "RepeatedHeaderJoined",
+		modify: func(r *http.Request) { r.Header.Set("X-Auth-Request-Groups", "sre, users") },
+	}, {
+		name:    "OtherHost",
+		modify:  func(r *http.Request) { r.Host = "wiki.example.com" },
+		wantErr: ErrInvalid,
+	}, {
+		name:    "Stale",
+		verify:  Verifier{Now: func() time.Time { return now.Add(6 * time.Minute) }},
+		wantErr: ErrStale,
+	}, {
+		name:    "UnsignedProtected",
+		modify:  func(r *http.Request) { r.Header.Set("X-Auth-Request-Preferred-Username", "admin") },
+		verify:  Verifier{Protected: []string{"X-Auth-Request-Preferred-Username"}},
+		wantErr: ErrUnsigned,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := signedRequest()
+			if tt.modify != nil {
+				tt.modify(r)
+			}
+			v := tt.verify
+			if v.Secrets == nil {
+				v.Secrets = [][]byte{secret}
+			}
+			if v.Now == nil {
+				v.Now = func() time.Time { return now.Add(time.Minute) }
+			}
+
+			_, err := v.Verify(r)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Verify() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	v := &Verifier{
+		Secrets: [][]byte{secret},
+		Now:     func() time.Time { return now },
+	}
+	h := v.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	res := httptest.NewRecorder()
+	h.ServeHTTP(res, signedRequest())
+	if got, want := res.Code, http.StatusNoContent; got != want {
+		t.Errorf("got status %d but wanted %d", got, want)
+	}
+
+	r := signedRequest()
+	r.Header.Set("X-Auth-Request-User", "mallory")
+	res = httptest.NewRecorder()
+	h.ServeHTTP(res, r)
+	if got, want := res.Code, http.StatusUnauthorized; got != want {
+		t.Errorf("got status %d but wanted %d", got, want)
+	}
+}
@@ -0,0 +1,394 @@
+package authorizer
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlsp"
+	"go.uber.org/zap"
+)
+
+// IDPConfig is one of identity providers users can sign in with
+type IDPConfig struct {
+	// Name identifies IdP in idp query parameter and idp session
+	// attribute
+	Name string `yaml:"name"`
+	// Title is shown on discovery page, default is Name
+	Title string `yaml:"title"`
+	// MetadataURL, MetadataFile or inline MetadataXML
+	MetadataURL  string `yaml:"metadataurl"`
+	MetadataFile string `yaml:"metadatafile"`
+	MetadataXML  string `yaml:"metadataxml"`
+	// MetadataSigning requires metadata signed with pinned certificate
+	MetadataSigning *MetadataSigningConfig `yaml:"metadatasigning"`
+	// Domains of user email addresses selecting this IdP
+	Domains []string `yaml:"domains"`
+	// Hosts selecting this IdP, exact names or *.domain wildcards
+	Hosts []string `yaml:"hosts"`
+	// RequiredAttributes and Policy expression restrict sessions from this
+	// IdP on top of policies
+	RequiredAttributes []requirement `yaml:"requiredattributes"`
+	Policy             string        `yaml:"policy"`
+}
+
+// idpAttribute is session attribute naming IdP session was created with
+const idpAttribute = "idp"
+
+var idpName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+func validateIDPs(idps []IDPConfig) []string {
+	var errs []string
+	add := func(field, format string, args ...interface{}) {
+		errs = append(errs, field+": "+fmt.Sprintf(format, args...))
+	}
+
+	names := map[string]bool{}
+	domains := map[string]string{}
+	for i, c := range idps {
+		field := fmt.Sprintf("idps[%d]", i)
+		switch {
+		case c.Name == "":
+			add(field+".name", "is required")
+		case !idpName.MatchString(c.Name):
+			add(field+".name", "%q must be lowercase letters, digits and dashes", c.Name)
+		case names[c.Name]:
+			add(field+".name", "duplicate identity provider %q", c.Name)
+		}
+		names[c.Name] = true
+
+		sources, merrs := validateMetadataSource(field+".", "metadata", c.MetadataURL, c.MetadataFile, c.MetadataXML, c.MetadataSigning)
+		errs = append(errs, merrs...)
+		if sources == 0 {
+			add(field+".metadataurl", "is required")
+		}
+		for _, d := range c.Domains {
+			d = strings.ToLower(d)
+			if d == "" || strings.ContainsAny(d, "@*/: ") {
+				add(field+".domains", "%q must be email domain", d)
+			} else if other, ok := domains[d]; ok {
+				add(field+".domains", "%s already belongs to %s", d, other)
+			}
+			domains[d] = c.Name
+		}
+		for _, h := range c.Hosts {
+			if h == "" {
+				add(field+".hosts", "host must not be empty")
+			} else if err := validateHostPattern(h); err != nil {
+				add(field+".hosts", "%v", err)
+			}
+		}
+		if _, err := compilePolicy(Policy{RequiredAttributes: c.RequiredAttributes, Expression: c.Policy}); err != nil {
+			add(field, "%v", err)
+		}
+	}
+	return errs
+}
+
+// newIDPPolicies compiles policies of identity providers that have one
+func newIDPPolicies(idps []IDPConfig) (map[string]*policy, error) {
+	policies := map[string]*policy{}
+	for _, c := range idps {
+		if len(c.RequiredAttributes) == 0 && c.Policy == "" {
+			continue
+		}
+		p, err := compilePolicy(Policy{RequiredAttributes: c.RequiredAttributes, Expression: c.Policy})
+		if err != nil {
+			return nil, fmt.Errorf("idp %s: %w", c.Name, err)
+		}
+		p.name = "idp " + c.Name
+		policies[c.Name] = p
+	}
+	return policies, nil
+}
+
+// DescribeIDPPolicies returns IdP policies in ACL.Describe format, sorted
+// by IdP name
+func (st *Settings) DescribeIDPPolicies() []string {
+	var lines []string
+	for _, p := range st.IDPPolicies {
+		lines = append(lines, p.describe())
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// withoutPolicies returns idps with policies cleared, policies are
+// reloadable while the rest needs restart
+func withoutPolicies(idps []IDPConfig) []IDPConfig {
+	var static []IDPConfig
+	for _, c := range idps {
+		c.RequiredAttributes, c.Policy = nil, ""
+		static = append(static, c)
+	}
+	return static
+}
+
+// checkIDP applies policy of IdP session was created with to decision
+// allowed by ACL
+func (st *Settings) checkIDP(d Decision, e *env) Decision {
+	if !d.Allowed {
+		return d
+	}
+	p := st.IDPPolicies[e.attributes.Get(idpAttribute)]
+	if p == nil {
+		return d
+	}
+	if pd := p.decide(e); !pd.Allowed {
+		return d.deny(append([]string{"denied by " + p.name + " policy"}, pd.Reasons...)...)
+	}
+	return d
+}
+
+// IDP is identity provider with its own middleware, middlewares share
+// service provider settings, session provider and request tracker
+type IDP struct {
+	Name  string
+	Title string
+	M     *samlsp.Middleware
+
+	domains []string
+	hosts   []string
+}
+
+// NewIDP returns IdP for config using copy of m with IdP metadata md,
+// sessions it creates carry idp attribute with IdP name
+func NewIDP(c IDPConfig, m *samlsp.Middleware, md *saml.EntityDescriptor) *IDP {
+	mm := *m
+	mm.ServiceProvider.IDPMetadata = md
+	mm.Session = idpSessionProvider{SessionProvider: m.Session, name: c.Name}
+
+	idp := &IDP{Name: c.Name, Title: c.Title, M: &mm}
+	if idp.Title == "" {
+		idp.Title = c.Name
+	}
+	for _, d := range c.Domains {
+		idp.domains = append(idp.domains, strings.ToLower(d))
+	}
+	for _, h := range c.Hosts {
+		idp.hosts = append(idp.hosts, strings.ToLower(h))
+	}
+	return idp
+}
+
+// idpSessionProvider replaces idp attribute of assertion with name of IdP
+// so IdP can not claim sessions of another one
+type idpSessionProvider struct {
+	samlsp.SessionProvider
+	name string
+}
+
+func (p idpSessionProvider) CreateSession(w http.ResponseWriter, r *http.Request, assertion *saml.Assertion) error {
+	a := *assertion
+	a.AttributeStatements = nil
+	for _, statement := range assertion.AttributeStatements {
+		var attributes []saml.Attribute
+		for _, attr := range statement.Attributes {
+			if !strings.EqualFold(attr.Name, idpAttribute) && !strings.EqualFold(attr.FriendlyName, idpAttribute) {
+				attributes = append(attributes, attr)
+			}
+		}
+		statement.Attributes = attributes
+		a.AttributeStatements = append(a.AttributeStatements, statement)
+	}
+	a.AttributeStatements = append(a.AttributeStatements, saml.AttributeStatement{
+		Attributes: []saml.Attribute{{
+			Name:   idpAttribute,
+			Values: []saml.AttributeValue{{Value: p.name}},
+		}},
+	})
+	return p.SessionProvider.CreateSession(w, r, &a)
+}
+
+func (s *AuthService) idpByName(name string) *IDP {
+	for _, idp := range s.IDPs {
+		if idp.Name == name {
+			return idp
+		}
+	}
+	return nil
+}
+
+// sessionMiddleware returns middleware of IdP session was created with
+func (s *AuthService) sessionMiddleware(session samlsp.Session) *samlsp.Middleware {
+	if sa, ok := session.(samlsp.SessionWithAttributes); ok {
+		if idp := s.idpByName(sa.GetAttributes().Get(idpAttribute)); idp != nil {
+			return idp.M
+		}
+	}
+	return s.M
+}
+
+// issuerMiddleware returns middleware of IdP with entity ID, nil when
+// there is no such IdP
+func (s *AuthService) issuerMiddleware(entityID string) *samlsp.Middleware {
+	if len(s.IDPs) == 0 {
+		return s.M
+	}
+	for _, idp := range s.IDPs {
+		if md := idp.M.ServiceProvider.IDPMetadata; md != nil && md.EntityID == entityID {
+			return idp.M
+		}
+	}
+	return nil
+}
+
+// selectIDP returns IdP named by idp parameter, owning domain of email
+// parameter, listing host of original request or the only one; message
+// explains why choice in parameters was not accepted
+func (s *AuthService) selectIDP(query url.Values, host string) (*IDP, string) {
+	if name := query.Get("idp"); name != "" {
+		if idp := s.idpByName(name); idp != nil {
+			return idp, ""
+		}
+		return nil, fmt.Sprintf("Unknown identity provider %q.", name)
+	}
+	if email := query.Get("email"); email != "" {
+		domain := strings.ToLower(email[strings.LastIndexByte(email, '@')+1:])
+		for _, idp := range s.IDPs {
+			if contains(idp.domains, domain) {
+				return idp, ""
+			}
+		}
+		return nil, fmt.Sprintf("No identity provider for %s, choose one below.", domain)
+	}
+	host = strings.ToLower(host)
+	for _, idp := range s.IDPs {
+		for _, pattern := range idp.hosts {
+			if matchHost(pattern, host) {
+				return idp, ""
+			}
+		}
+	}
+	if len(s.IDPs) == 1 {
+		return s.IDPs[0], ""
+	}
+	return nil, ""
+}
+
+var discoveryPage = template.Must(template.New("discovery").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Sign in</title></head>
+<body>
+<h1>Sign in</h1>
+{{if .Message}}<p>{{.Message}}</p>
+{{end}}<ul>
+{{range .IDPs}}<li><a href="{{.URL}}">{{.Title}}</a></li>
+{{end}}</ul>
+{{if .Email}}<form method="get" action="{{.Action}}">
+<input type="hidden" name="rd" value="{{.RD}}">
+<label>Email <input type="email" name="email" required></label>
+<button type="submit">Continue</button>
+</form>
+{{end}}</body>
+</html>
+`))
+
+// discovery writes page letting user choose IdP to sign in with, links
+// come back to signin with idp parameter
+func (s *AuthService) discovery(w http.ResponseWriter, r *http.Request, rd, message string) {
+	type choice struct{ Title, URL string }
+	data := struct {
+		Message string
+		IDPs    []choice
+		Email   bool
+		Action  string
+		RD      string
+	}{Message: message, Action: r.URL.Path, RD: rd}
+	for _, idp := range s.IDPs {
+		q := url.Values{"rd": {rd}, "idp": {idp.Name}}
+		data.IDPs = append(data.IDPs, choice{idp.Title, r.URL.Path + "?" + q.Encode()})
+		data.Email = data.Email || len(idp.domains) > 0
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; form-action 'self'")
+	s.httpStatus(w, r, http.StatusOK)
+	if err := discoveryPage.Execute(w, data); err != nil {
+		s.Log.Error("discovery page", zap.Error(err))
+	}
+}
+
+// SAML handler serves service provider metadata and assertion consumer
+// service, with several IdPs responses are passed to middleware of IdP
+// that issued them
+func (s *AuthService) SAML(w http.ResponseWriter, r *http.Request) {
+	s.idpMu.RLock()
+	defer s.idpMu.RUnlock()
+
+	if r.URL.Path != s.M.ServiceProvider.AcsURL.Path {
+		s.M.ServeHTTP(w, r)
+		return
+	}
+	if len(s.IDPs) == 0 {
+		if s.M.ServiceProvider.IDPMetadata == nil {
+			s.httpError(w, r, http.StatusServiceUnavailable)
+			return
+		}
+		s.M.ServeHTTP(w, r)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		s.httpError(w, r, http.StatusBadRequest)
+		return
+	}
+	idp := s.responseIDP(r)
+	if idp == nil {
+		s.Log.Info("response from unknown identity provider")
+		s.httpError(w, r, http.StatusForbidden)
+		return
+	}
+	idp.M.ServeHTTP(w, r)
+}
+
+// responseIDP returns IdP that issued SAMLResponse or artifact in r, the
+// response is verified later by IdP middleware
+func (s *AuthService) responseIDP(r *http.Request) *IDP {
+	if art := r.Form.Get("SAMLart"); art != "" {
+		// artifact carries SHA-1 of issuer entity ID as source ID
+		raw, err := base64.StdEncoding.DecodeString(art)
+		if err != nil || len(raw) < 24 {
+			return nil
+		}
+		for _, idp := range s.IDPs {
+			if md := idp.M.ServiceProvider.IDPMetadata; md != nil {
+				if sum := sha1.Sum([]byte(md.EntityID)); string(sum[:]) == string(raw[4:24]) {
+					return idp
+				}
+			}
+		}
+		return nil
+	}
+
+	data, err := base64.StdEncoding.DecodeString(r.PostForm.Get("SAMLResponse"))
+	if err != nil {
+		return nil
+	}
+	var resp struct {
+		Issuer    string `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+		Assertion struct {
+			Issuer string `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+		} `xml:"urn:oasis:names:tc:SAML:2.0:assertion Assertion"`
+	}
+	if err := xml.Unmarshal(data, &resp); err != nil {
+		return nil
+	}
+	issuer := resp.Issuer
+	if issuer == "" {
+		issuer = resp.Assertion.Issuer
+	}
+	for _, idp := range s.IDPs {
+		if md := idp.M.ServiceProvider.IDPMetadata; md != nil && md.EntityID == strings.TrimSpace(issuer) {
+			return idp
+		}
+	}
+	return nil
+}
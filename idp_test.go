@@ -0,0 +1,348 @@
+package authorizer
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlsp"
+)
+
+func TestValidateIDPs(t *testing.T) {
+	got := validateIDPs([]IDPConfig{{
+		Name:        "employees",
+		MetadataURL: "https://login.example.com/metadata",
+		Domains:     []string{"example.com"},
+		Hosts:       []string{"*.corp.example.com"},
+	}, {
+		Name:        "Contractors",
+		MetadataURL: "ftp://idp.example.org/metadata",
+		Domains:     []string{"Example.com", "@example.org"},
+		Hosts:       []string{"*.*.example.org"},
+		Policy:      "group ==",
+	}, {
+		Name: "employees",
+	}})
+	want := []string{
+		`idps[1].name: "Contractors" must be lowercase letters, digits and dashes`,
+		`idps[1].metadataurl: "ftp://idp.example.org/metadata" must be http or https URL`,
+		`idps[1].domains: example.com already belongs to employees`,
+		`idps[1].domains: "@example.org" must be email domain`,
+		`idps[1].hosts: "*.*.example.org" must be host name or *.domain wildcard`,
+		`idps[1]: policy expression: 9: expected attribute, string or list, got end of expression`,
+		`idps[2].name: duplicate identity provider "employees"`,
+		`idps[2].metadataurl: is required`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("validateIDPs() = %q, want %q", got, want)
+	}
+}
+
+func TestConfigValidateIDPs(t *testing.T) {
+	c := validConfig()
+	c.IDPs = []IDPConfig{{Name: "employees", MetadataURL: "https://login.example.com/metadata"}}
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "only one of idpmetadataurl, idpmetadatafile, idpmetadataxml and idps") {
+		t.Errorf("Validate() error = %v, want only one of idpmetadataurl, idpmetadatafile, idpmetadataxml and idps", err)
+	}
+
+	c.IDPMetadataURL = ""
+	if err := c.Validate(); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+}
+
+// idpService returns service with employees and contractors IdPs
+func idpService(sp samlsp.SessionProvider) *AuthService {
+	s := fakeAuthService(sp, nil)
+	s.M.Session = sp
+	for _, c := range []IDPConfig{{
+		Name:    "employees",
+		Title:   "Employees",
+		Domains: []string{"example.com"},
+	}, {
+		Name:  "contractors",
+		Hosts: []string{"*.partners.example.com"},
+	}} {
+		s.IDPs = append(s.IDPs, NewIDP(c, s.M, &saml.EntityDescriptor{
+			EntityID: "https://" + c.Name + ".example.com/metadata",
+			IDPSSODescriptors: []saml.IDPSSODescriptor{{
+				SingleSignOnServices: []saml.Endpoint{{
+					Binding:  saml.HTTPRedirectBinding,
+					Location: "https://" + c.Name + ".example.com/sso",
+				}},
+			}},
+		}))
+	}
+	return s
+}
+
+func TestSelectIDP(t *testing.T) {
+	s := idpService(&unknownUser{})
+
+	tests := []struct {
+		name    string
+		query   string
+		host    string
+		want    string
+		message string
+	}{{
+		name:  "Parameter",
+		query: "idp=contractors",
+		host:  "app.example.com",
+		want:  "contractors",
+	}, {
+		name:    "UnknownParameter",
+		query:   "idp=partners",
+		message: `Unknown identity provider "partners".`,
+	}, {
+		name:  "EmailDomain",
+		query: "email=Alice%40Example.com",
+		want:  "employees",
+	}, {
+		name:    "UnknownEmailDomain",
+		query:   "email=bob%40example.org",
+		message: "No identity provider for example.org, choose one below.",
+	}, {
+		name: "Host",
+		host: "wiki.partners.example.com",
+		want: "contractors",
+	}, {
+		name: "NoChoice",
+		host: "app.example.com",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, _ := url.ParseQuery(tt.query)
+			idp, message := s.selectIDP(query, tt.host)
+			got := ""
+			if idp != nil {
+				got = idp.Name
+			}
+			if got != tt.want || message != tt.message {
+				t.Errorf("selectIDP() = %q, %q, want %q, %q", got, message, tt.want, tt.message)
+			}
+		})
+	}
+}
+
+func TestSigninDiscovery(t *testing.T) {
+	s := idpService(&unknownUser{})
+
+	req := httptest.NewRequest(http.MethodGet, "/saml/signin?rd=https%3A%2F%2Fapp.example.com%2F", nil)
+	res := httptest.NewRecorder()
+	s.Signin(res, req)
+
+	if got, want := res.Code, http.StatusOK; got != want {
+		t.Fatalf("got status %d but wanted %d", got, want)
+	}
+	body := res.Body.String()
+	for _, want := range []string{
+		`<a href="/saml/signin?idp=employees&amp;rd=https%3A%2F%2Fapp.example.com%2F">Employees</a>`,
+		`<a href="/saml/signin?idp=contractors&amp;rd=https%3A%2F%2Fapp.example.com%2F">contractors</a>`,
+		`<input type="hidden" name="rd" value="https://app.example.com/">`,
+		`<input type="email" name="email" required>`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("discovery page does not contain %s\n%s", want, body)
+		}
+	}
+	if got := res.Header().Get("Content-Security-Policy"); !strings.Contains(got, "default-src 'none'") {
+		t.Errorf("got Content-Security-Policy %q", got)
+	}
+}
+
+func TestSigninSelectedIDP(t *testing.T) {
+	s := idpService(&unknownUser{})
+
+	req := httptest.NewRequest(http.MethodGet, "/saml/signin?rd=https%3A%2F%2Fwiki.partners.example.com%2F", nil)
+	res := httptest.NewRecorder()
+	s.Signin(res, req)
+
+	if got, want := res.Code, http.StatusFound; got != want {
+		t.Fatalf("got status %d but wanted %d", got, want)
+	}
+	if got := res.Header().Get("Location"); !strings.HasPrefix(got, "https://contractors.example.com/sso?") {
+		t.Errorf("got Location %s, want contractors IdP", got)
+	}
+}
+
+// assertionRecorder keeps assertion of last created session
+type assertionRecorder struct {
+	unknownUser
+	assertion *saml.Assertion
+}
+
+func (p *assertionRecorder) CreateSession(w http.ResponseWriter, r *http.Request, assertion *saml.Assertion) error {
+	p.assertion = assertion
+	return nil
+}
+
+func TestIDPSessionProvider(t *testing.T) {
+	p := &assertionRecorder{}
+	s := idpService(p)
+
+	assertion := &saml.Assertion{
+		AttributeStatements: []saml.AttributeStatement{{
+			Attributes: []saml.Attribute{{
+				Name:   "mail",
+				Values: []saml.AttributeValue{{Value: "bob@example.org"}},
+			}, {
+				Name:   "IdP",
+				Values: []saml.AttributeValue{{Value: "employees"}},
+			}},
+		}},
+	}
+	err := s.IDPs[1].M.Session.CreateSession(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/saml/acs", nil), assertion)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string][]string{}
+	for _, statement := range p.assertion.AttributeStatements {
+		for _, attr := range statement.Attributes {
+			for _, v := range attr.Values {
+				got[attr.Name] = append(got[attr.Name], v.Value)
+			}
+		}
+	}
+	want := map[string][]string{
+		"mail": {"bob@example.org"},
+		"idp":  {"contractors"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("session attributes = %v, want %v", got, want)
+	}
+	if len(assertion.AttributeStatements[0].Attributes) != 2 {
+		t.Error("original assertion was modified")
+	}
+}
+
+func TestIDPPolicy(t *testing.T) {
+	policies, err := newIDPPolicies([]IDPConfig{{
+		Name: "employees",
+	}, {
+		Name:   "contractors",
+		Policy: `request.host in ["wiki.example.com"]`,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		url  string
+		idp  string
+		want Decision
+	}{{
+		name: "Employee",
+		url:  "https://grafana.example.com/",
+		idp:  "employees",
+		want: Decision{Allowed: true, Policy: "global"},
+	}, {
+		name: "ContractorAllowedHost",
+		url:  "https://wiki.example.com/",
+		idp:  "contractors",
+		want: Decision{Allowed: true, Policy: "global"},
+	}, {
+		name: "ContractorDeniedHost",
+		url:  "https://grafana.example.com/",
+		idp:  "contractors",
+		want: Decision{Policy: "global", Reasons: []string{
+			"denied by idp contractors policy",
+			`request.host in ["wiki.example.com"] is false, got ["grafana.example.com"]`,
+		}},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/saml/auth", nil)
+			req.Header.Set("X-Original-URL", tt.url)
+
+			s := fakeAuthService(&validUser{}, nil)
+			s.Reload(&Settings{IDPPolicies: policies})
+
+			attributes := samlsp.Attributes{"name": {"Bob"}, idpAttribute: {tt.idp}}
+			got, _ := s.decide(s.Settings(), req, attributes, time.Time{})
+			tt.want.URL = tt.url
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("AuthService.decide() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResponseIDP(t *testing.T) {
+	s := idpService(&unknownUser{})
+
+	artifact := func(entityID string) string {
+		raw := make([]byte, 44)
+		binary.BigEndian.PutUint16(raw, 4)
+		sum := sha1.Sum([]byte(entityID))
+		copy(raw[4:], sum[:])
+		return base64.StdEncoding.EncodeToString(raw)
+	}
+	response := func(issuer string) string {
+		return base64.StdEncoding.EncodeToString([]byte(`<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion">` +
+			`<saml:Issuer>` + issuer + `</saml:Issuer></samlp:Response>`))
+	}
+
+	tests := []struct {
+		name string
+		form url.Values
+		want string
+	}{{
+		name: "Response",
+		form: url.Values{"SAMLResponse": {response("https://contractors.example.com/metadata")}},
+		want: "contractors",
+	}, {
+		name: "UnknownIssuer",
+		form: url.Values{"SAMLResponse": {response("https://evil.example.com/metadata")}},
+	}, {
+		name: "Artifact",
+		form: url.Values{"SAMLart": {artifact("https://employees.example.com/metadata")}},
+		want: "employees",
+	}, {
+		name: "InvalidArtifact",
+		form: url.Values{"SAMLart": {"AAQ="}},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/saml/acs", strings.NewReader(tt.form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if err := req.ParseForm(); err != nil {
+				t.Fatal(err)
+			}
+			got := ""
+			if idp := s.responseIDP(req); idp != nil {
+				got = idp.Name
+			}
+			if got != tt.want {
+				t.Errorf("responseIDP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigRestartRequiredIDPPolicy(t *testing.T) {
+	old := validConfig()
+	old.IDPMetadataURL = ""
+	old.IDPs = []IDPConfig{{Name: "contractors", MetadataURL: "https://idp.example.org/metadata"}}
+
+	c := *old
+	c.IDPs = []IDPConfig{{Name: "contractors", MetadataURL: "https://idp.example.org/metadata", Policy: `group == "partners"`}}
+	if got := c.restartRequired(old); len(got) != 0 {
+		t.Errorf("restartRequired() = %v, want none", got)
+	}
+
+	c.IDPs = []IDPConfig{{Name: "contractors", MetadataURL: "https://idp.example.org/saml"}}
+	if got, want := c.restartRequired(old), []string{"idps"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("restartRequired() = %v, want %v", got, want)
+	}
+}
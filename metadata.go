@@ -0,0 +1,409 @@
+package authorizer
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlsp"
+)
+
+// IDPSigningCertificates returns certificates IdP uses to sign assertions
+func IDPSigningCertificates(md *saml.EntityDescriptor) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for _, idp := range md.IDPSSODescriptors {
+		for _, kd := range idp.KeyDescriptors {
+			if kd.Use != "" && kd.Use != "signing" {
+				continue
+			}
+			for _, xc := range kd.KeyInfo.X509Data.X509Certificates {
+				data := strings.Join(strings.Fields(xc.Data), "")
+				der, err := base64.StdEncoding.DecodeString(data)
+				if err != nil {
+					return nil, fmt.Errorf("idp certificate: %w", err)
+				}
+				cert, err := x509.ParseCertificate(der)
+				if err != nil {
+					return nil, fmt.Errorf("idp certificate: %w", err)
+				}
+				certs = append(certs, cert)
+			}
+		}
+	}
+	return certs, nil
+}
+
+const (
+	// maxMetadataSize limits IdP metadata read from URL
+	maxMetadataSize        = 10 << 20
+	defaultMetadataTimeout = 30 * time.Second
+)
+
+// MetadataSigningConfig requires IdP metadata signed with one of pinned
+// certificates, unsigned and expired metadata is rejected
+type MetadataSigningConfig struct {
+	// CertificateFile holds PEM certificates metadata can be signed with
+	CertificateFile string `yaml:"certificatefile"`
+	// Fingerprints are SHA-256 fingerprints of certificates metadata can
+	// be signed with, hex with optional colons; certificate is taken from
+	// signature KeyInfo
+	Fingerprints []string `yaml:"fingerprints"`
+}
+
+func (c *MetadataSigningConfig) validate() []string {
+	var errs []string
+	if c.CertificateFile == "" && len(c.Fingerprints) == 0 {
+		errs = append(errs, "certificatefile or fingerprints is required")
+	}
+	for _, fp := range c.Fingerprints {
+		if b, err := hex.DecodeString(normalizeFingerprint(fp)); err != nil || len(b) != sha256.Size {
+			errs = append(errs, fmt.Sprintf("fingerprints: %q is not SHA-256 fingerprint", fp))
+		}
+	}
+	return errs
+}
+
+// normalizeFingerprint returns fp as lowercase hex without colons
+func normalizeFingerprint(fp string) string {
+	return strings.ToLower(strings.ReplaceAll(fp, ":", ""))
+}
+
+// certificateFingerprint returns SHA-256 fingerprint of cert in lowercase
+// hex
+func certificateFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// verify checks metadata in data is signed with one of pinned
+// certificates
+func (c *MetadataSigningConfig) verify(data []byte) error {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(data); err != nil {
+		return err
+	}
+	root := doc.Root()
+	if root == nil || root.FindElement("./Signature") == nil {
+		return errors.New("metadata is not signed")
+	}
+
+	var certs []*x509.Certificate
+	if c.CertificateFile != "" {
+		pinned, err := loadCertificates(c.CertificateFile)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, pinned...)
+	}
+	if len(c.Fingerprints) > 0 {
+		pinned := map[string]bool{}
+		for _, fp := range c.Fingerprints {
+			pinned[normalizeFingerprint(fp)] = true
+		}
+		for _, xc := range root.FindElements("./Signature/KeyInfo/X509Data/X509Certificate") {
+			der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(xc.Text()), ""))
+			if err != nil {
+				continue
+			}
+			cert, err := x509.ParseCertificate(der)
+			if err == nil && pinned[certificateFingerprint(cert)] {
+				certs = append(certs, cert)
+			}
+		}
+	}
+	if len(certs) == 0 {
+		return errors.New("metadata is not signed with pinned certificate")
+	}
+	if err := verifyXMLSignature(data, certs); err != nil {
+		return fmt.Errorf("metadata signature: %w", err)
+	}
+	return nil
+}
+
+// loadCertificates returns every certificate in PEM file name
+func loadCertificates(name string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("%s: no certificates", name)
+	}
+	return certs, nil
+}
+
+// MetadataSource is where IdP metadata comes from, one of URL, File and
+// XML is set
+type MetadataSource struct {
+	URL  string
+	File string
+	XML  string
+	// Cache is directory keeping last metadata fetched from URL, empty
+	// disables cache
+	Cache string
+	// Signing, when set, requires metadata signed with pinned certificate
+	Signing *MetadataSigningConfig
+	// CAFile holds PEM certificates trusted for https URL instead of
+	// system roots
+	CAFile string
+	// Timeout of URL fetch, default 30s
+	Timeout time.Duration
+	// Client fetches URL, default is client trusting CAFile
+	Client *http.Client
+}
+
+// MetadataSource returns where metadata of IdP named idp comes from, of
+// the only IdP when idp is empty
+func (c *Config) MetadataSource(idp string) MetadataSource {
+	src := MetadataSource{
+		URL:     c.IDPMetadataURL,
+		File:    c.IDPMetadataFile,
+		XML:     c.IDPMetadataXML,
+		Cache:   c.MetadataCache,
+		Signing: c.IDPMetadataSigning,
+		CAFile:  c.MetadataCAFile,
+		Timeout: c.MetadataTimeout,
+	}
+	for _, i := range c.IDPs {
+		if i.Name == idp {
+			src.URL, src.File, src.XML = i.MetadataURL, i.MetadataFile, i.MetadataXML
+			src.Signing = i.MetadataSigning
+		}
+	}
+	return src
+}
+
+// validateMetadataSource checks <prefix>url, <prefix>file, <prefix>xml
+// and <prefix>signing keys of field, returns how many sources are set
+func validateMetadataSource(field, prefix, rawURL, file, xml string, signing *MetadataSigningConfig) (int, []string) {
+	var errs []string
+	add := func(key, format string, args ...interface{}) {
+		errs = append(errs, field+prefix+key+": "+fmt.Sprintf(format, args...))
+	}
+
+	set := 0
+	for _, v := range []string{rawURL, file, xml} {
+		if v != "" {
+			set++
+		}
+	}
+	if set > 1 {
+		add("url", "only one of %surl, %sfile and %sxml can be set", prefix, prefix, prefix)
+	}
+	if rawURL != "" {
+		if err := validateHTTPURL(rawURL); err != nil {
+			add("url", "%v", err)
+		}
+	}
+	if xml != "" {
+		if _, err := samlsp.ParseMetadata([]byte(xml)); err != nil {
+			add("xml", "%v", err)
+		}
+	}
+	if signing != nil {
+		if set == 0 {
+			add("signing", "requires %surl, %sfile or %sxml", prefix, prefix, prefix)
+		}
+		for _, err := range signing.validate() {
+			errs = append(errs, field+prefix+"signing."+err)
+		}
+	}
+	return set, errs
+}
+
+func (src MetadataSource) String() string {
+	switch {
+	case src.URL != "":
+		return src.URL
+	case src.File != "":
+		return src.File
+	case src.XML != "":
+		return "inline XML"
+	}
+	return "none"
+}
+
+// Static reports whether metadata never changes so there is nothing to
+// refresh
+func (src MetadataSource) Static() bool {
+	return src.URL == "" && src.File == ""
+}
+
+// Fetch reads metadata from its source, metadata fetched from URL is
+// written to cache
+func (src MetadataSource) Fetch(ctx context.Context) (*saml.EntityDescriptor, error) {
+	switch {
+	case src.URL != "":
+		data, err := src.get(ctx)
+		if err != nil {
+			return nil, err
+		}
+		md, err := src.parse(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", src.URL, err)
+		}
+		if src.Cache != "" {
+			if err := writeFileAtomic(src.cacheFile(), data); err != nil {
+				return nil, fmt.Errorf("metadata cache: %w", err)
+			}
+		}
+		return md, nil
+	case src.File != "":
+		data, err := os.ReadFile(src.File)
+		if err != nil {
+			return nil, err
+		}
+		md, err := src.parse(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", src.File, err)
+		}
+		return md, nil
+	case src.XML != "":
+		return src.parse([]byte(src.XML))
+	}
+	return nil, errors.New("no IdP metadata source")
+}
+
+// Cached returns metadata last fetched from URL, used when IdP is not
+// reachable at startup; expired metadata is not returned
+func (src MetadataSource) Cached() (*saml.EntityDescriptor, error) {
+	if src.URL == "" || src.Cache == "" {
+		return nil, errors.New("no metadata cache")
+	}
+	data, err := os.ReadFile(src.cacheFile())
+	if err != nil {
+		return nil, err
+	}
+	md, err := src.parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", src.cacheFile(), err)
+	}
+	if expired(md) {
+		return nil, fmt.Errorf("%s: expired at %s", src.cacheFile(), md.ValidUntil.Format(time.RFC3339))
+	}
+	return md, nil
+}
+
+// parse returns metadata in data, with signing required it has to be
+// signed with pinned certificate and not expired
+func (src MetadataSource) parse(data []byte) (*saml.EntityDescriptor, error) {
+	if src.Signing != nil {
+		if err := src.Signing.verify(data); err != nil {
+			return nil, err
+		}
+	}
+	md, err := samlsp.ParseMetadata(data)
+	if err != nil {
+		return nil, err
+	}
+	if src.Signing != nil && expired(md) {
+		return nil, fmt.Errorf("metadata expired at %s", md.ValidUntil.Format(time.RFC3339))
+	}
+	return md, nil
+}
+
+func expired(md *saml.EntityDescriptor) bool {
+	return !md.ValidUntil.IsZero() && saml.TimeNow().After(md.ValidUntil)
+}
+
+// client returns HTTP client fetching URL
+func (src MetadataSource) client() (*http.Client, error) {
+	if src.Client != nil {
+		return src.Client, nil
+	}
+	timeout := src.Timeout
+	if timeout == 0 {
+		timeout = defaultMetadataTimeout
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if src.CAFile != "" {
+		data, err := os.ReadFile(src.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("%s: no certificates", src.CAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}
+	}
+	return &http.Client{Transport: transport, Timeout: timeout}, nil
+}
+
+func (src MetadataSource) get(ctx context.Context) ([]byte, error) {
+	client, err := src.client()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", src.URL, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxMetadataSize))
+}
+
+// cacheFile returns name of cache file of URL
+func (src MetadataSource) cacheFile() string {
+	sum := sha256.Sum256([]byte(src.URL))
+	return filepath.Join(src.Cache, hex.EncodeToString(sum[:])+".xml")
+}
+
+// writeFileAtomic replaces file name with data so readers never see
+// partial content
+func writeFileAtomic(name string, data []byte) error {
+	dir := filepath.Dir(name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
@@ -0,0 +1,396 @@
+package authorizer
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+func testCertificate(t *testing.T, cn string) *x509.Certificate {
+	t.Helper()
+	_, cert := testKeyPair(t, cn)
+	return cert
+}
+
+func testKeyPair(t *testing.T, cn string) (*rsa.PrivateKey, *x509.Certificate) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, cert
+}
+
+func keyDescriptor(use string, cert *x509.Certificate) saml.KeyDescriptor {
+	return saml.KeyDescriptor{
+		Use: use,
+		KeyInfo: saml.KeyInfo{
+			X509Data: saml.X509Data{
+				X509Certificates: []saml.X509Certificate{{
+					Data: base64.StdEncoding.EncodeToString(cert.Raw),
+				}},
+			},
+		},
+	}
+}
+
+func TestIDPSigningCertificates(t *testing.T) {
+	signing := testCertificate(t, "signing")
+	both := testCertificate(t, "both")
+	encryption := testCertificate(t, "encryption")
+
+	md := &saml.EntityDescriptor{
+		IDPSSODescriptors: []saml.IDPSSODescriptor{{
+			SSODescriptor: saml.SSODescriptor{
+				RoleDescriptor: saml.RoleDescriptor{
+					KeyDescriptors: []saml.KeyDescriptor{
+						keyDescriptor("signing", signing),
+						keyDescriptor("", both),
+						keyDescriptor("encryption", encryption),
+					},
+				},
+			},
+		}},
+	}
+
+	certs, err := IDPSigningCertificates(md)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 2 || !certs[0].Equal(signing) || !certs[1].Equal(both) {
+		t.Errorf("IDPSigningCertificates() returned %d certificates, want signing and both", len(certs))
+	}
+
+	md.IDPSSODescriptors[0].KeyDescriptors[0].KeyInfo.X509Data.X509Certificates[0].Data = "!"
+	if _, err := IDPSigningCertificates(md); err == nil {
+		t.Error("expected error for invalid certificate")
+	}
+}
+
+func TestMetadataSource(t *testing.T) {
+	md := signedMetadata(t, "idp.example.com")
+	data, err := xml.Marshal(md)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	up := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up {
+			http.Error(w, "down", http.StatusBadGateway)
+			return
+		}
+		w.Write(data)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "metadata.xml")
+	if err := os.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, src := range []MetadataSource{
+		{URL: srv.URL, Cache: filepath.Join(dir, "cache")},
+		{File: file},
+		{XML: string(data)},
+	} {
+		got, err := src.Fetch(context.Background())
+		if err != nil {
+			t.Fatalf("%s: Fetch() error = %v", src, err)
+		}
+		if got.EntityID != md.EntityID {
+			t.Errorf("%s: Fetch() entity id = %s, want %s", src, got.EntityID, md.EntityID)
+		}
+	}
+
+	// IdP outage, last fetched metadata is in cache
+	up = false
+	src := MetadataSource{URL: srv.URL, Cache: filepath.Join(dir, "cache")}
+	if _, err := src.Fetch(context.Background()); err == nil {
+		t.Error("Fetch() expected error")
+	}
+	got, err := src.Cached()
+	if err != nil {
+		t.Fatalf("Cached() error = %v", err)
+	}
+	if got.EntityID != md.EntityID {
+		t.Errorf("Cached() entity id = %s, want %s", got.EntityID, md.EntityID)
+	}
+
+	for _, src := range []MetadataSource{
+		{URL: srv.URL},
+		{URL: srv.URL + "/other", Cache: filepath.Join(dir, "cache")},
+		{File: file, Cache: filepath.Join(dir, "cache")},
+	} {
+		if _, err := src.Cached(); err == nil {
+			t.Errorf("%s: Cached() expected error", src)
+		}
+	}
+}
+
+func TestMetadataSourceExpiredCache(t *testing.T) {
+	md := signedMetadata(t, "idp.example.com")
+	md.ValidUntil = time.Now().Add(-time.Hour)
+	data, err := xml.Marshal(md)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := MetadataSource{URL: "https://idp.example.com/metadata", Cache: t.TempDir()}
+	if err := writeFileAtomic(src.cacheFile(), data); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.Cached(); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("Cached() error = %v, want expired", err)
+	}
+}
+
+func TestValidateMetadataSource(t *testing.T) {
+	tests := []struct {
+		name          string
+		url, file, md string
+		signing       *MetadataSigningConfig
+		want          int
+		errs          []string
+	}{{
+		name: "None",
+	}, {
+		name: "URL",
+		url:  "https://idp.example.com/metadata",
+		want: 1,
+	}, {
+		name: "Several",
+		url:  "idp.example.com",
+		file: "/etc/authorizer/idp.xml",
+		md:   "<EntityDescriptor",
+		want: 3,
+		errs: []string{
+			"idps[0].metadataurl: only one of metadataurl, metadatafile and metadataxml can be set",
+			`idps[0].metadataurl: "idp.example.com" must be http or https URL`,
+			"idps[0].metadataxml: XML syntax error on line 1: unexpected EOF",
+		},
+	}, {
+		name:    "Signing",
+		url:     "https://idp.example.com/metadata",
+		signing: &MetadataSigningConfig{Fingerprints: []string{strings.Repeat("AB:", 31) + "AB"}},
+		want:    1,
+	}, {
+		name:    "InvalidSigning",
+		signing: &MetadataSigningConfig{Fingerprints: []string{"abcd"}},
+		errs: []string{
+			"idps[0].metadatasigning: requires metadataurl, metadatafile or metadataxml",
+			`idps[0].metadatasigning.fingerprints: "abcd" is not SHA-256 fingerprint`,
+		},
+	}, {
+		name:    "EmptySigning",
+		file:    "/etc/authorizer/idp.xml",
+		signing: &MetadataSigningConfig{},
+		want:    1,
+		errs:    []string{"idps[0].metadatasigning.certificatefile or fingerprints is required"},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, errs := validateMetadataSource("idps[0].", "metadata", tt.url, tt.file, tt.md, tt.signing)
+			if got != tt.want || !reflect.DeepEqual(errs, tt.errs) {
+				t.Errorf("validateMetadataSource() = %d, %q, want %d, %q", got, errs, tt.want, tt.errs)
+			}
+		})
+	}
+}
+
+// signMetadata returns md signed with key and cert as enveloped signature
+func signMetadata(t *testing.T, md *saml.EntityDescriptor, key *rsa.PrivateKey, cert *x509.Certificate) []byte {
+	t.Helper()
+	md.ID = "_metadata"
+	data, err := xml.Marshal(md)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(data); err != nil {
+		t.Fatal(err)
+	}
+	ctx := dsig.NewDefaultSigningContext(dsig.TLSCertKeyStore(tls.Certificate{
+		Certificate: [][]byte{cert.Raw},
+		PrivateKey:  key,
+	}))
+	signed, err := ctx.SignEnveloped(doc.Root())
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc.SetRoot(signed)
+	data, err = doc.WriteToBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestMetadataSourceSigning(t *testing.T) {
+	key, cert := testKeyPair(t, "metadata.idp.example.com")
+	otherKey, otherCert := testKeyPair(t, "attacker.example.com")
+
+	certFile := filepath.Join(t.TempDir(), "metadata.crt")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fp := strings.ToUpper(certificateFingerprint(cert))
+	for i := len(fp) - 2; i > 0; i -= 2 {
+		fp = fp[:i] + ":" + fp[i:]
+	}
+	pinned := []*MetadataSigningConfig{
+		{CertificateFile: certFile},
+		{Fingerprints: []string{fp}},
+	}
+
+	signed := signMetadata(t, signedMetadata(t, "idp.example.com"), key, cert)
+	unsigned, err := xml.Marshal(signedMetadata(t, "idp.example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiredMD := signedMetadata(t, "idp.example.com")
+	expiredMD.ValidUntil = time.Now().Add(-time.Hour)
+	tampered := strings.Replace(string(signed), "https://idp.example.com/metadata", "https://evil.example.com/metadata", 1)
+
+	tests := []struct {
+		name string
+		data string
+		err  string
+	}{
+		{"Signed", string(signed), ""},
+		{"Unsigned", string(unsigned), "metadata is not signed"},
+		{"OtherCertificate", string(signMetadata(t, signedMetadata(t, "idp.example.com"), otherKey, otherCert)), "metadata"},
+		{"Tampered", tampered, "metadata signature"},
+		{"Expired", string(signMetadata(t, expiredMD, key, cert)), "metadata expired"},
+	}
+	for _, signing := range pinned {
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				_, err := MetadataSource{XML: tt.data, Signing: signing}.Fetch(context.Background())
+				switch {
+				case tt.err == "" && err != nil:
+					t.Errorf("Fetch() error = %v", err)
+				case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+					t.Errorf("Fetch() error = %v, want %s", err, tt.err)
+				}
+			})
+		}
+	}
+
+	// signing is not required unless configured
+	if _, err := (MetadataSource{XML: string(unsigned)}).Fetch(context.Background()); err != nil {
+		t.Errorf("Fetch() error = %v", err)
+	}
+}
+
+// withoutKeyInfo returns signed metadata with KeyInfo removed from signature
+func withoutKeyInfo(t *testing.T, data []byte) string {
+	t.Helper()
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(data); err != nil {
+		t.Fatal(err)
+	}
+	sig := doc.Root().FindElement("./Signature")
+	sig.RemoveChild(sig.FindElement("KeyInfo"))
+	out, err := doc.WriteToString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestMetadataSourceSigningBundle(t *testing.T) {
+	key, cert := testKeyPair(t, "metadata.idp.example.com")
+	nextKey, next := testKeyPair(t, "next.metadata.idp.example.com")
+	otherKey, otherCert := testKeyPair(t, "attacker.example.com")
+
+	// certificate rollover bundle pins current and next certificate
+	var bundle []byte
+	for _, c := range []*x509.Certificate{next, cert} {
+		bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})...)
+	}
+	certFile := filepath.Join(t.TempDir(), "metadata.crt")
+	if err := os.WriteFile(certFile, bundle, 0600); err != nil {
+		t.Fatal(err)
+	}
+	signing := &MetadataSigningConfig{CertificateFile: certFile}
+
+	tests := []struct {
+		name string
+		data string
+		err  string
+	}{
+		{"Current", string(signMetadata(t, signedMetadata(t, "idp.example.com"), key, cert)), ""},
+		{"Next", string(signMetadata(t, signedMetadata(t, "idp.example.com"), nextKey, next)), ""},
+		{"CurrentKeyValue", withoutKeyInfo(t, signMetadata(t, signedMetadata(t, "idp.example.com"), key, cert)), ""},
+		{"NextKeyValue", withoutKeyInfo(t, signMetadata(t, signedMetadata(t, "idp.example.com"), nextKey, next)), ""},
+		{"OtherKeyValue", withoutKeyInfo(t, signMetadata(t, signedMetadata(t, "idp.example.com"), otherKey, otherCert)), "metadata signature"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := MetadataSource{XML: tt.data, Signing: signing}.Fetch(context.Background())
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("Fetch() error = %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("Fetch() error = %v, want %s", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestMetadataSourceCAFile(t *testing.T) {
+	data, err := xml.Marshal(signedMetadata(t, "idp.example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	defer srv.Close()
+
+	if _, err := (MetadataSource{URL: srv.URL}).Fetch(context.Background()); err == nil {
+		t.Error("Fetch() expected error for certificate not in system roots")
+	}
+
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (MetadataSource{URL: srv.URL, CAFile: caFile, Timeout: 5 * time.Second}).Fetch(context.Background()); err != nil {
+		t.Errorf("Fetch() error = %v", err)
+	}
+}
@@ -0,0 +1,207 @@
+package authorizer
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix starts names of environment variables overriding config keys
+const EnvPrefix = "AUTHORIZER_"
+
+// Overrides maps config keys, e.g. pdp.url, to values set outside of config
+// file. Strings, booleans and durations are taken literally, lists and maps
+// are parsed as YAML.
+type Overrides map[string]string
+
+// ConfigKeys returns every key that can be overridden
+func ConfigKeys() []string {
+	var keys []string
+	walkConfig(reflect.TypeOf(Config{}), "", func(key string, _ reflect.Type) {
+		keys = append(keys, key)
+	})
+	return keys
+}
+
+// EnvName returns environment variable overriding config key
+func EnvName(key string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+func walkConfig(t reflect.Type, prefix string, fn func(key string, t reflect.Type)) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		key := prefix + f.Tag.Get("yaml")
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if ft.Kind() == reflect.Struct {
+			walkConfig(ft, key+".", fn)
+			continue
+		}
+		fn(key, f.Type)
+	}
+}
+
+// EnvOverrides collects overrides from environment, e.g. AUTHORIZER_PDP_URL
+// for pdp.url. Variable with _FILE suffix names file holding the value,
+// useful for secrets. Empty variables are ignored, unknown ones too as
+// Kubernetes may inject service variables sharing the prefix.
+func EnvOverrides(environ []string) (Overrides, error) {
+	env := map[string]string{}
+	for _, kv := range environ {
+		if i := strings.IndexByte(kv, '='); i > 0 && strings.HasPrefix(kv, EnvPrefix) {
+			env[kv[:i]] = kv[i+1:]
+		}
+	}
+
+	o := Overrides{}
+	var errs ConfigError
+	for _, key := range ConfigKeys() {
+		name := EnvName(key)
+		value, file := env[name], env[name+"_FILE"]
+		switch {
+		case value != "" && file != "":
+			errs = append(errs, fmt.Sprintf("%s: both %s and %s_FILE are set", key, name, name))
+		case value != "":
+			o[key] = value
+		case file != "":
+			data, err := os.ReadFile(file)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", key, err))
+				continue
+			}
+			o[key] = strings.TrimRight(string(data), "\r\n")
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return o, nil
+}
+
+// RegisterFlags defines flag for every config key on fs, values set on
+// command line are stored in o
+func (o Overrides) RegisterFlags(fs *flag.FlagSet) {
+	walkConfig(reflect.TypeOf(Config{}), "", func(key string, t reflect.Type) {
+		var usage string
+		switch {
+		case t.Kind() == reflect.Bool:
+			usage = fmt.Sprintf("Override %s config key (env %s)", key, EnvName(key))
+		case t == reflect.TypeOf(time.Duration(0)):
+			usage = fmt.Sprintf("Override %s config key with `duration` (env %s)", key, EnvName(key))
+		case t.Kind() == reflect.String:
+			usage = fmt.Sprintf("Override %s config key with `string` (env %s)", key, EnvName(key))
+		default:
+			usage = fmt.Sprintf("Override %s config key with `yaml` (env %s)", key, EnvName(key))
+		}
+		fs.Var(&overrideFlag{o, key, t.Kind() == reflect.Bool}, key, usage)
+	})
+}
+
+type overrideFlag struct {
+	o      Overrides
+	key    string
+	isBool bool
+}
+
+func (f *overrideFlag) String() string {
+	if f == nil || f.o == nil {
+		return ""
+	}
+	return f.o[f.key]
+}
+
+func (f *overrideFlag) Set(value string) error {
+	f.o[f.key] = value
+	return nil
+}
+
+func (f *overrideFlag) IsBoolFlag() bool {
+	return f.isBool
+}
+
+// Apply sets config keys from o
+func (c *Config) Apply(o Overrides) error {
+	keys := make([]string, 0, len(o))
+	for key := range o {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var errs ConfigError
+	for _, key := range keys {
+		if err := setConfigKey(reflect.ValueOf(c).Elem(), key, o[key]); err != nil {
+			errs = append(errs, key+": "+err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func setConfigKey(v reflect.Value, key, value string) error {
+	name, rest := key, ""
+	if i := strings.IndexByte(key, '.'); i >= 0 {
+		name, rest = key[:i], key[i+1:]
+	}
+
+	for i := 0; i < v.NumField(); i++ {
+		if v.Type().Field(i).Tag.Get("yaml") != name {
+			continue
+		}
+		f := v.Field(i)
+		if rest != "" {
+			if f.Kind() == reflect.Ptr {
+				if f.IsNil() {
+					f.Set(reflect.New(f.Type().Elem()))
+				}
+				f = f.Elem()
+			}
+			if f.Kind() != reflect.Struct {
+				break
+			}
+			return setConfigKey(f, rest, value)
+		}
+		return setConfigValue(f, value)
+	}
+	return errors.New("unknown config key")
+}
+
+func setConfigValue(f reflect.Value, value string) error {
+	switch {
+	case f.Type() == reflect.TypeOf(time.Duration(0)):
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		f.SetInt(int64(d))
+	case f.Kind() == reflect.String:
+		f.SetString(value)
+	case f.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		f.SetBool(b)
+	default:
+		p := reflect.New(f.Type())
+		d := yaml.NewDecoder(strings.NewReader(value))
+		d.KnownFields(true)
+		if err := d.Decode(p.Interface()); err != nil {
+			return err
+		}
+		f.Set(p.Elem())
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package authorizer
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestConfigKeys(t *testing.T) {
+	got := ConfigKeys()
+	want := []string{
+		"entityid", "url", "keyfile", "certificatefile", "allowidpinitiated",
+		"defaultredirecturi", "idpmetadataurl", "idpmetadatafile", "idpmetadataxml",
+		"idpmetadatasigning.certificatefile", "idpmetadatasigning.fingerprints",
+		"metadatacache", "metadatacafile", "metadatatimeout", "idps", "metadatarefresh", "signrequest",
+		"useartifactresponse", "forceauthn", "addr", "requiredattributes",
+		"policy", "policies", "pdp.url", "pdp.timeout", "pdp.failopen",
+		"pdp.cachettl", "explain.header", "explain.admins", "headers.mapping",
+		"headers.allow", "headers.deny", "headers.prefix", "headers.multivalue",
+		"headers.separator", "headers.encoding", "headers.defaultencoding",
+		"attributes.aliases", "attributes.nobuiltinaliases",
+		"attributes.caseinsensitive", "jwt.keyfile", "jwt.publickeyfiles",
+		"jwt.algorithm", "jwt.header", "jwt.issuer", "jwt.ttl", "jwt.claims",
+		"jwt.listclaims", "jwt.audiences", "signature.secret",
+		"signature.secretfile", "signature.header", "signature.headers",
+		"session.store", "session.revocations", "session.dir", "session.redis.addr",
+		"session.redis.username", "session.redis.password", "session.redis.db",
+		"session.redis.prefix", "session.redis.tls", "session.redis.timeout",
+		"session.maxlifetime", "session.idletimeout",
+		"cookie.name", "cookie.domain", "cookie.path", "cookie.samesite",
+		"cookie.secure", "cookie.httponly",
+		"admin.token", "admin.tokenfile", "admin.users", "tenants",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ConfigKeys() = %v, want %v", got, want)
+	}
+	if got, want := EnvName("pdp.cachettl"), "AUTHORIZER_PDP_CACHETTL"; got != want {
+		t.Errorf("EnvName() = %s, want %s", got, want)
+	}
+}
+
+func TestEnvOverrides(t *testing.T) {
+	key := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(key, []byte("/secrets/tls.key\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := EnvOverrides([]string{
+		"PATH=/bin",
+		"AUTHORIZER_URL=https://auth.example.com",
+		"AUTHORIZER_KEYFILE_FILE=" + key,
+		"AUTHORIZER_PDP_TIMEOUT=5s",
+		"AUTHORIZER_ADDR=",
+		"AUTHORIZER_SERVICE_HOST=10.0.0.1",
+	})
+	if err != nil {
+		t.Fatalf("EnvOverrides() error = %v", err)
+	}
+	want := Overrides{
+		"url":         "https://auth.example.com",
+		"keyfile":     "/secrets/tls.key",
+		"pdp.timeout": "5s",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("EnvOverrides() = %v, want %v", got, want)
+	}
+
+	_, err = EnvOverrides([]string{
+		"AUTHORIZER_KEYFILE=tls.key",
+		"AUTHORIZER_KEYFILE_FILE=" + key,
+		"AUTHORIZER_URL_FILE=" + key + ".missing",
+	})
+	var errs ConfigError
+	if !errors.As(err, &errs) || len(errs) != 2 {
+		t.Errorf("EnvOverrides() error = %v, want 2 errors", err)
+	}
+}
+
+func TestConfigApply(t *testing.T) {
+	c := validConfig()
+	err := c.Apply(Overrides{
+		"forceauthn":         "true",
+		"requiredattributes": "[{group: sre}]",
+		"policies":           `[{host: wiki.example.com, policy: has(mail)}]`,
+		"pdp.url":            "http://opa:8181/v1/data/authz",
+		"pdp.timeout":        "3s",
+		"explain.admins":     `group == "sre"`,
+	})
+	if err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+
+	want := validConfig()
+	want.ForceAuthn = true
+	want.RequiredAttributes = []requirement{{"group": "sre"}}
+	want.Policies = []Policy{{Host: "wiki.example.com", Expression: "has(mail)"}}
+	want.PDP = &PDPConfig{URL: "http://opa:8181/v1/data/authz", Timeout: 3 * time.Second}
+	want.Explain.Admins = `group == "sre"`
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("Apply() = %+v, want %+v", c, want)
+	}
+
+	err = c.Apply(Overrides{
+		"forceauthn":  "maybe",
+		"pdp.timeout": "3",
+		"policies":    "[{hots: example.com}]",
+		"url.host":    "example.com",
+		"nope":        "1",
+	})
+	var errs ConfigError
+	if !errors.As(err, &errs) || len(errs) != 5 {
+		t.Errorf("Apply() error = %v, want 5 errors", err)
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(name, []byte(reloadConfigYAML), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	overrides := Overrides{}
+	fs := flag.NewFlagSet("authorizer", flag.ContinueOnError)
+	overrides.RegisterFlags(fs)
+	if err := fs.Parse([]string{"-addr=:9000", "-forceauthn"}); err != nil {
+		t.Fatal(err)
+	}
+	env := Overrides{"addr": ":8080", "keyfile": "/secrets/tls.key"}
+
+	c, err := LoadConfig(name, env, overrides)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if c.Addr != ":9000" || c.KeyFile != "/secrets/tls.key" || c.URL != "https://auth.example.com" || !c.ForceAuthn {
+		t.Errorf("LoadConfig() = %+v", c)
+	}
+
+	// no config file
+	c, err = LoadConfig("", Overrides{
+		"url":             "https://auth.example.com",
+		"keyfile":         "tls.key",
+		"certificatefile": "tls.crt",
+		"idpmetadataurl":  "https://idp.example.com/metadata",
+		"addr":            ":8000",
+	})
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if c.URL != "https://auth.example.com" {
+		t.Errorf("LoadConfig() = %+v", c)
+	}
+}
@@ -0,0 +1,215 @@
+package authorizer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/crewjam/saml/samlsp"
+	"go.uber.org/zap"
+)
+
+// PDPConfig for external policy decision point
+type PDPConfig struct {
+	URL      string        `yaml:"url"`
+	Timeout  time.Duration `yaml:"timeout"`
+	FailOpen bool          `yaml:"failopen"`
+	CacheTTL time.Duration `yaml:"cachettl"`
+}
+
+const (
+	defaultPDPTimeout   = 2 * time.Second
+	maxPDPCacheEntries  = 10000
+	maxPDPResponseBytes = 1 << 20
+)
+
+// PDP delegates allow/deny decision to external policy decision point. It
+// speaks Open Policy Agent data API: input is posted as {"input": ...} and
+// result is either a boolean or {"allow": bool, "headers": {...}}.
+type PDP struct {
+	URL      string
+	Client   *http.Client
+	FailOpen bool
+	CacheTTL time.Duration
+
+	// config PDP was created with, PDP is kept on reload when it is the
+	// same
+	config PDPConfig
+
+	mu    sync.Mutex
+	cache map[string]pdpCacheEntry
+}
+
+// NewPDP returns PDP for given config
+func NewPDP(c PDPConfig) *PDP {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = defaultPDPTimeout
+	}
+	return &PDP{
+		URL:      c.URL,
+		Client:   &http.Client{Timeout: timeout},
+		FailOpen: c.FailOpen,
+		CacheTTL: c.CacheTTL,
+		config:   c,
+	}
+}
+
+type pdpInput struct {
+	Attributes samlsp.Attributes `json:"attributes"`
+	Method     string            `json:"method"`
+	URL        string            `json:"url"`
+	Host       string            `json:"host"`
+	Path       string            `json:"path"`
+	IP         string            `json:"ip"`
+}
+
+type pdpDecision struct {
+	Allow   bool              `json:"allow"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+type pdpCacheEntry struct {
+	decision pdpDecision
+	expires  time.Time
+}
+
+var errPDPStatus = errors.New("pdp: unexpected status")
+
+// Decide returns decision of the policy decision point for input
+func (p *PDP) Decide(ctx context.Context, in *pdpInput) (pdpDecision, error) {
+	body, err := json.Marshal(struct {
+		Input *pdpInput `json:"input"`
+	}{in})
+	if err != nil {
+		return pdpDecision{}, err
+	}
+
+	sum := sha256.Sum256(body)
+	key := hex.EncodeToString(sum[:])
+	if d, ok := p.cached(key); ok {
+		return d, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.URL, bytes.NewReader(body))
+	if err != nil {
+		return pdpDecision{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return pdpDecision{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return pdpDecision{}, fmt.Errorf("%w %d", errPDPStatus, resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxPDPResponseBytes))
+	if err != nil {
+		return pdpDecision{}, err
+	}
+
+	d, err := parsePDPResponse(data)
+	if err != nil {
+		return pdpDecision{}, err
+	}
+
+	p.store(key, d)
+	return d, nil
+}
+
+func parsePDPResponse(data []byte) (pdpDecision, error) {
+	var d pdpDecision
+
+	var envelope struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return d, fmt.Errorf("pdp: %w", err)
+	}
+	// Plain decision without OPA result envelope
+	if envelope.Result == nil {
+		err := json.Unmarshal(data, &d)
+		return d, err
+	}
+
+	if err := json.Unmarshal(envelope.Result, &d.Allow); err == nil {
+		return d, nil
+	}
+	if err := json.Unmarshal(envelope.Result, &d); err != nil {
+		return d, fmt.Errorf("pdp: %w", err)
+	}
+	return d, nil
+}
+
+func (p *PDP) cached(key string) (pdpDecision, bool) {
+	if p.CacheTTL <= 0 {
+		return pdpDecision{}, false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e, ok := p.cache[key]
+	if !ok || time.Now().After(e.expires) {
+		return pdpDecision{}, false
+	}
+	return e.decision, true
+}
+
+func (p *PDP) store(key string, d pdpDecision) {
+	if p.CacheTTL <= 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	if p.cache == nil {
+		p.cache = map[string]pdpCacheEntry{}
+	}
+	if len(p.cache) >= maxPDPCacheEntries {
+		for k, e := range p.cache {
+			if now.After(e.expires) {
+				delete(p.cache, k)
+			}
+		}
+	}
+	if len(p.cache) >= maxPDPCacheEntries {
+		p.cache = map[string]pdpCacheEntry{}
+	}
+	p.cache[key] = pdpCacheEntry{d, now.Add(p.CacheTTL)}
+}
+
+func (s *AuthService) checkPDP(pdp *PDP, r *http.Request, u *url.URL, e *env) (pdpDecision, error) {
+	if pdp == nil {
+		return pdpDecision{Allow: true}, nil
+	}
+
+	d, err := pdp.Decide(r.Context(), &pdpInput{
+		Attributes: e.attributes,
+		Method:     e.request["method"],
+		URL:        u.String(),
+		Host:       e.request["host"],
+		Path:       e.request["path"],
+		IP:         e.request["ip"],
+	})
+	if err != nil {
+		s.Log.Warn("policy decision point",
+			zap.String("requestUrl", u.String()),
+			zap.Bool("failOpen", pdp.FailOpen),
+			zap.Error(err),
+		)
+		return pdpDecision{}, err
+	}
+	return d, nil
+}
@@ -0,0 +1,162 @@
+package authorizer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func fakePDP(t *testing.T, response string, delay time.Duration, calls *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+
+		var body struct {
+			Input pdpInput `json:"input"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("decoding pdp input: %v", err)
+		}
+		if got, want := body.Input.Attributes.Get("name"), "Alice"; got != want {
+			t.Errorf("pdp input name = %s, want %s", got, want)
+		}
+		if got, want := body.Input.Method, "POST"; got != want {
+			t.Errorf("pdp input method = %s, want %s", got, want)
+		}
+		if got, want := body.Input.URL, "https://grafana.example.com/admin"; got != want {
+			t.Errorf("pdp input url = %s, want %s", got, want)
+		}
+		if got, want := body.Input.IP, "10.0.0.1"; got != want {
+			t.Errorf("pdp input ip = %s, want %s", got, want)
+		}
+
+		time.Sleep(delay)
+		if response == "" {
+			http.Error(w, "boom", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(response))
+	}))
+}
+
+func TestAuthHandlerPDP(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		delay    time.Duration
+		failOpen bool
+		want     int
+		header   string
+	}{{
+		name:     "OPABooleanAllowShouldPass",
+		response: `{"result": true}`,
+		want:     http.StatusAccepted,
+	}, {
+		name:     "OPABooleanDenyShouldFail",
+		response: `{"result": false}`,
+		want:     http.StatusUnauthorized,
+	}, {
+		name:     "OPAObjectAllowShouldPassHeaders",
+		response: `{"result": {"allow": true, "headers": {"X-Tenant": "sre"}}}`,
+		want:     http.StatusAccepted,
+		header:   "sre",
+	}, {
+		name:     "PlainDecisionShouldPass",
+		response: `{"allow": true, "headers": {"X-Tenant": "ops"}}`,
+		want:     http.StatusAccepted,
+		header:   "ops",
+	}, {
+		name:     "UndefinedResultShouldFail",
+		response: `{}`,
+		want:     http.StatusUnauthorized,
+	}, {
+		name: "ErrorShouldFailClosed",
+		want: http.StatusUnauthorized,
+	}, {
+		name:     "ErrorShouldFailOpen",
+		failOpen: true,
+		want:     http.StatusAccepted,
+	}, {
+		name:     "TimeoutShouldFailClosed",
+		response: `{"result": true}`,
+		delay:    200 * time.Millisecond,
+		want:     http.StatusUnauthorized,
+	}, {
+		name:     "InvalidJSONShouldFailClosed",
+		response: `{"result": "yes"}`,
+		want:     http.StatusUnauthorized,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int32
+			srv := fakePDP(t, tt.response, tt.delay, &calls)
+			defer srv.Close()
+
+			s := fakeAuthService(&validUser{}, nil)
+			s.Reload(&Settings{PDP: NewPDP(PDPConfig{
+				URL:      srv.URL,
+				Timeout:  50 * time.Millisecond,
+				FailOpen: tt.failOpen,
+			})})
+
+			req := httptest.NewRequest(http.MethodGet, "/saml/auth", nil)
+			req.Header.Set("X-Original-URL", "https://grafana.example.com/admin")
+			req.Header.Set("X-Original-Method", "POST")
+			req.Header.Set("X-Real-IP", "10.0.0.1")
+			res := httptest.NewRecorder()
+
+			s.Auth(res, req)
+
+			if got := res.Code; got != tt.want {
+				t.Errorf("got status %d but wanted %d", got, tt.want)
+			}
+			if got := res.Header().Get("X-Tenant"); got != tt.header {
+				t.Errorf("got header X-Tenant %s but wanted %s", got, tt.header)
+			}
+		})
+	}
+}
+
+func TestPDPCache(t *testing.T) {
+	var calls int32
+	srv := fakePDP(t, `{"result": true}`, 0, &calls)
+	defer srv.Close()
+
+	s := fakeAuthService(&validUser{}, nil)
+	s.Reload(&Settings{PDP: NewPDP(PDPConfig{
+		URL:      srv.URL,
+		CacheTTL: time.Minute,
+	})})
+
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/saml/auth", nil)
+		req.Header.Set("X-Original-URL", "https://grafana.example.com/admin")
+		req.Header.Set("X-Original-Method", "POST")
+		req.Header.Set("X-Real-IP", "10.0.0.1")
+		res := httptest.NewRecorder()
+
+		s.Auth(res, req)
+
+		if got, want := res.Code, http.StatusAccepted; got != want {
+			t.Errorf("got status %d but wanted %d", got, want)
+		}
+	}
+
+	if got, want := atomic.LoadInt32(&calls), int32(1); got != want {
+		t.Errorf("got %d pdp calls but wanted %d", got, want)
+	}
+}
+
+func TestPDPCacheExpires(t *testing.T) {
+	p := &PDP{CacheTTL: time.Millisecond}
+	p.store("key", pdpDecision{Allow: true})
+	if _, ok := p.cached("key"); !ok {
+		t.Fatal("expected cached decision")
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := p.cached("key"); ok {
+		t.Error("expected cached decision to expire")
+	}
+}
@@ -0,0 +1,264 @@
+package authorizer
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Policy applies RequiredAttributes and policy Expression to requests
+// matching Host and Path. Both have to be satisfied when set.
+type Policy struct {
+	// Host is either exact host name, wildcard like *.example.com or empty
+	// to match any host
+	Host string `yaml:"host"`
+	// Path is a path prefix matched element-wise, empty matches any path
+	Path               string        `yaml:"path"`
+	RequiredAttributes []requirement `yaml:"requiredattributes"`
+	Expression         string        `yaml:"policy"`
+	// MaxAge of session, older sessions have to sign in again
+	MaxAge time.Duration `yaml:"maxage"`
+}
+
+// ACL is a table of policies keyed by host and path prefix with a global
+// fallback used when no policy matches. Policies are compiled once.
+type ACL struct {
+	global   *policy
+	policies []*policy
+}
+
+// policy is a compiled Policy
+type policy struct {
+	name   string
+	host   string
+	path   string
+	rules  []rule
+	expr   expr
+	maxAge time.Duration
+}
+
+const globalPolicyName = "global"
+
+// NewACL returns ACL with policies ordered from the most specific one
+func NewACL(global Policy, policies []Policy) (*ACL, error) {
+	g, err := compilePolicy(global)
+	if err != nil {
+		return nil, err
+	}
+	g.name = globalPolicyName
+
+	compiled := make([]*policy, len(policies))
+	for i, p := range policies {
+		c, err := compilePolicy(p)
+		if err != nil {
+			return nil, fmt.Errorf("policy %s%s: %w", p.Host, p.Path, err)
+		}
+		compiled[i] = c
+	}
+	sort.SliceStable(compiled, func(i, j int) bool {
+		a, b := hostRank(compiled[i].host), hostRank(compiled[j].host)
+		if a != b {
+			return a > b
+		}
+		if len(compiled[i].host) != len(compiled[j].host) {
+			return len(compiled[i].host) > len(compiled[j].host)
+		}
+		return len(compiled[i].path) > len(compiled[j].path)
+	})
+
+	return &ACL{
+		global:   g,
+		policies: compiled,
+	}, nil
+}
+
+func compilePolicy(p Policy) (*policy, error) {
+	rules, err := compileRequirements(p.RequiredAttributes)
+	if err != nil {
+		return nil, err
+	}
+	c := &policy{
+		name:   p.Host + p.Path,
+		host:   strings.ToLower(p.Host),
+		path:   p.Path,
+		rules:  rules,
+		maxAge: p.MaxAge,
+	}
+	if p.Expression != "" {
+		if c.expr, err = parseExpr(p.Expression); err != nil {
+			return nil, fmt.Errorf("policy expression: %w", err)
+		}
+	}
+	return c, nil
+}
+
+// canonical renames attributes referenced by policy to canonical names so
+// policies written with alias names match normalized session attributes
+func (p *policy) canonical(a *Aliases) {
+	for _, r := range p.rules {
+		r.canonical(a)
+	}
+	if p.expr != nil {
+		canonicalExpr(p.expr, a)
+	}
+}
+
+// canonical renames attributes referenced by all policies of ACL
+func (a *ACL) canonical(aliases *Aliases) {
+	a.global.canonical(aliases)
+	for _, p := range a.policies {
+		p.canonical(aliases)
+	}
+}
+
+// Lookup returns policy applicable to u
+func (a *ACL) Lookup(u *url.URL) *policy {
+	if a == nil {
+		return &policy{name: globalPolicyName}
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, p := range a.policies {
+		if matchHost(p.host, host) && matchPath(p.path, cleanPath(u.Path)) {
+			return p
+		}
+	}
+	return a.global
+}
+
+// stale reports whether session issued at given time is older than
+// policy allows
+func (p *policy) stale(issued, now time.Time) bool {
+	return p.maxAge > 0 && !issued.IsZero() && now.Sub(issued) > p.maxAge
+}
+
+func (p *policy) decide(e *env) Decision {
+	d := Decision{Allowed: true, Policy: p.name}
+	if p.stale(e.issued, time.Now()) {
+		return d.deny(fmt.Sprintf("session older than %s, sign in again", p.maxAge))
+	}
+	if len(p.rules) > 0 {
+		// Session with no attributes but configuration explicitly required some
+		if len(e.attributes) == 0 {
+			return d.deny("session has no attributes")
+		}
+		if !aclCheckOR(e.attributes, p.rules) {
+			for _, r := range p.rules {
+				d.Reasons = append(d.Reasons, r.explain(e.attributes))
+			}
+			return d.deny()
+		}
+	}
+	if p.expr != nil && !p.expr.eval(e) {
+		return d.deny(p.expr.explain(e)...)
+	}
+	return d
+}
+
+// Describe returns human readable list of policies, the most specific first
+func (a *ACL) Describe() []string {
+	if a == nil {
+		return []string{globalPolicyName + ": allow"}
+	}
+	var lines []string
+	for _, p := range a.policies {
+		lines = append(lines, p.describe())
+	}
+	return append(lines, a.global.describe())
+}
+
+func (p *policy) describe() string {
+	name := p.name
+	if name == "" {
+		name = "*"
+	}
+	var checks []string
+	if len(p.rules) > 0 {
+		alternatives := make([]string, len(p.rules))
+		for i, r := range p.rules {
+			alternatives[i] = "(" + r.String() + ")"
+		}
+		checks = append(checks, strings.Join(alternatives, " || "))
+	}
+	if p.expr != nil {
+		checks = append(checks, p.expr.String())
+	}
+	if p.maxAge > 0 {
+		checks = append(checks, "max age "+p.maxAge.String())
+	}
+	if len(checks) == 0 {
+		return name + ": allow"
+	}
+	return name + ": " + strings.Join(checks, " && ")
+}
+
+func hostRank(pattern string) int {
+	switch {
+	case pattern == "":
+		return 0
+	case strings.HasPrefix(pattern, "*."):
+		return 1
+	default:
+		return 2
+	}
+}
+
+func matchHost(pattern, host string) bool {
+	switch {
+	case pattern == "":
+		return true
+	case strings.HasPrefix(pattern, "*."):
+		return strings.HasSuffix(host, pattern[1:])
+	default:
+		return pattern == host
+	}
+}
+
+// cleanPath returns p with dot segments and repeated slashes resolved the
+// way nginx does before serving it, trailing slash is kept
+func cleanPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	cleaned := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+func matchPath(prefix, path string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" {
+		return true
+	}
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// originalURL returns URL of the request we are asked to authorize. NGINX
+// passes it in X-Original-URL to the auth-url, for auth-signin we get it in
+// rd query parameter, otherwise we fall back to forwarded host and request
+// path.
+func (s *AuthService) originalURL(r *http.Request) *url.URL {
+	if v := r.Header.Get("X-Original-URL"); v != "" {
+		if u, err := url.Parse(v); err == nil && u.Host != "" {
+			return u
+		}
+	}
+
+	if rd := r.URL.Query().Get("rd"); rd != "" && s.RootURL != nil {
+		if u, err := s.RootURL.Parse(rd); err == nil {
+			return u
+		}
+	}
+
+	u := *r.URL
+	u.Host = r.Host
+	if v := r.Header.Get("X-Forwarded-Host"); v != "" {
+		u.Host = strings.TrimSpace(strings.Split(v, ",")[0])
+	}
+	return &u
+}
@@ -0,0 +1,203 @@
+package authorizer
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestACLLookup(t *testing.T) {
+	global := []requirement{{"group": "users"}}
+	acl := mustNewACL(global, []Policy{{
+		Host:               "grafana.example.com",
+		RequiredAttributes: []requirement{{"group": "sre"}},
+	}, {
+		Host:               "grafana.example.com",
+		Path:               "/admin",
+		RequiredAttributes: []requirement{{"group": "admins"}},
+	}, {
+		Host:               "*.example.com",
+		RequiredAttributes: []requirement{{"group": "staff"}},
+	}, {
+		Host: "wiki.example.com",
+	}})
+
+	tests := []struct {
+		name string
+		url  string
+		want []requirement
+	}{{
+		name: "ExactHostShouldMatch",
+		url:  "https://grafana.example.com/d/abc",
+		want: []requirement{{"group": "sre"}},
+	}, {
+		name: "LongestPathShouldWin",
+		url:  "https://grafana.example.com/admin/users",
+		want: []requirement{{"group": "admins"}},
+	}, {
+		name: "PathPrefixShouldMatchWholeElements",
+		url:  "https://grafana.example.com/administrator",
+		want: []requirement{{"group": "sre"}},
+	}, {
+		name: "DotSegmentsShouldBeResolved",
+		url:  "https://grafana.example.com/d/../admin",
+		want: []requirement{{"group": "admins"}},
+	}, {
+		name: "CurrentDirectoryShouldBeResolved",
+		url:  "https://grafana.example.com/./admin/users",
+		want: []requirement{{"group": "admins"}},
+	}, {
+		name: "DoubleSlashShouldBeResolved",
+		url:  "https://grafana.example.com//admin",
+		want: []requirement{{"group": "admins"}},
+	}, {
+		name: "EncodedDotSegmentsShouldBeResolved",
+		url:  "https://grafana.example.com/d/%2e%2e/admin/",
+		want: []requirement{{"group": "admins"}},
+	}, {
+		name: "HostShouldBeCaseInsensitive",
+		url:  "https://Grafana.Example.com:8443/",
+		want: []requirement{{"group": "sre"}},
+	}, {
+		name: "WildcardHostShouldMatch",
+		url:  "https://jira.example.com/",
+		want: []requirement{{"group": "staff"}},
+	}, {
+		name: "EmptyPolicyShouldAllowEveryone",
+		url:  "https://wiki.example.com/",
+		want: nil,
+	}, {
+		name: "UnknownHostShouldFallback",
+		url:  "https://example.org/",
+		want: global,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, _ := url.Parse(tt.url)
+			got, want := acl.Lookup(u).rules, mustCompileRequirements(tt.want)
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("ACL.Lookup() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestCleanPath(t *testing.T) {
+	for _, tt := range []struct{ path, want string }{
+		{"", "/"},
+		{"/", "/"},
+		{"/admin", "/admin"},
+		{"/admin/", "/admin/"},
+		{"//admin//users/", "/admin/users/"},
+		{"/x/../admin", "/admin"},
+		{"/../../admin", "/admin"},
+		{"/./admin/.", "/admin"},
+		{"admin", "/admin"},
+	} {
+		if got := cleanPath(tt.path); got != tt.want {
+			t.Errorf("cleanPath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestOriginalURL(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		header map[string]string
+		want   string
+	}{{
+		name:   "OriginalURLHeader",
+		target: "/saml/auth",
+		header: map[string]string{
+			"X-Original-URL":   "https://grafana.example.com/admin?x=1",
+			"X-Forwarded-Host": "wiki.example.com",
+		},
+		want: "https://grafana.example.com/admin?x=1",
+	}, {
+		name:   "RedirectParameter",
+		target: "/saml/signin?rd=https%3A%2F%2Fgrafana.example.com%2Fadmin",
+		want:   "https://grafana.example.com/admin",
+	}, {
+		name:   "RelativeRedirectParameter",
+		target: "/saml/signin?rd=%2Fadmin",
+		want:   "http://example.com/admin",
+	}, {
+		name:   "ForwardedHost",
+		target: "/saml/auth",
+		header: map[string]string{
+			"X-Forwarded-Host": "wiki.example.com, proxy.local",
+		},
+		want: "//wiki.example.com/saml/auth",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			s := fakeAuthService(&validUser{}, nil)
+			if got := s.originalURL(req).String(); got != tt.want {
+				t.Errorf("AuthService.originalURL() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthHandlerHostPolicy(t *testing.T) {
+	s := fakeAuthService(&validUser{}, nil)
+	s.Reload(&Settings{ACL: mustNewACL(nil, []Policy{{
+		Host:               "grafana.example.com",
+		RequiredAttributes: []requirement{{"group": "sre"}},
+	}})})
+
+	tests := []struct {
+		name string
+		url  string
+		want int
+	}{{
+		name: "ProtectedHostShouldFail",
+		url:  "https://grafana.example.com/",
+		want: http.StatusUnauthorized,
+	}, {
+		name: "OtherHostShouldPass",
+		url:  "https://wiki.example.com/",
+		want: http.StatusAccepted,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/saml/auth", nil)
+			req.Header.Set("X-Original-URL", tt.url)
+			res := httptest.NewRecorder()
+
+			s.Auth(res, req)
+
+			if got := res.Code; got != tt.want {
+				t.Errorf("got status %d but wanted %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestACLDescribe(t *testing.T) {
+	acl := mustNewACL([]requirement{{"group": "users"}, {"group": "admins"}}, []Policy{{
+		Host: "wiki.example.com",
+	}, {
+		Host:               "grafana.example.com",
+		Path:               "/admin",
+		RequiredAttributes: []requirement{{"group": "sre"}},
+		Expression:         `has(mail)`,
+	}})
+
+	got := acl.Describe()
+	want := []string{
+		`grafana.example.com/admin: (group equals "sre") && has(mail)`,
+		`wiki.example.com: allow`,
+		`global: (group equals "users") || (group equals "admins")`,
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("ACL.Describe() = %q, want %q", got, want)
+	}
+}
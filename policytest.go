@@ -0,0 +1,159 @@
+package authorizer
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlsp"
+	"github.com/golang-jwt/jwt/v4"
+	"gopkg.in/yaml.v3"
+)
+
+// PolicyTest is an offline authorization test case. Request to Host and
+// Path made by user with Attributes is expected to be allowed or denied and
+// when allowed to forward Headers, empty header value means header must not
+// be present.
+type PolicyTest struct {
+	Name       string            `yaml:"name"`
+	Attributes samlsp.Attributes `yaml:"attributes"`
+	Host       string            `yaml:"host"`
+	Path       string            `yaml:"path"`
+	Method     string            `yaml:"method"`
+	Allow      bool              `yaml:"allow"`
+	Headers    map[string]string `yaml:"headers"`
+}
+
+// LoadPolicyTests reads list of test cases from YAML or JSON file
+func LoadPolicyTests(name string) ([]PolicyTest, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var tests []PolicyTest
+	d := yaml.NewDecoder(f)
+	d.KnownFields(true)
+	if err := d.Decode(&tests); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return tests, nil
+}
+
+// RunPolicyTests runs tests through Auth handler with sessions holding test
+// attributes, prints results table to w and returns number of failures
+func (s *AuthService) RunPolicyTests(tests []PolicyTest, w io.Writer) int {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "RESULT\tTEST\tURL\tWANT\tGOT")
+
+	failed := 0
+	var details []string
+	for i, tt := range tests {
+		name := tt.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+
+		res, u := s.runPolicyTest(tt)
+		got := res.Code == http.StatusAccepted
+
+		var problems []string
+		if got == tt.Allow {
+			for header, want := range tt.Headers {
+				value := strings.Join(res.Header().Values(header), ", ")
+				if value != want {
+					problems = append(problems, fmt.Sprintf("header %s: want %q, got %q", header, want, value))
+				}
+			}
+		} else if reason := res.Header().Get("X-Auth-Decision"); reason != "" {
+			problems = append(problems, reason)
+		}
+
+		result := "PASS"
+		if got != tt.Allow || len(problems) > 0 {
+			result = "FAIL"
+			failed++
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", result, name, u, verdict(tt.Allow), verdict(got))
+		if len(problems) > 0 {
+			details = append(details, "--- "+name)
+			for _, p := range problems {
+				details = append(details, "    "+p)
+			}
+		}
+	}
+	tw.Flush()
+
+	if len(details) > 0 {
+		fmt.Fprintf(w, "\n%s\n\n", strings.Join(details, "\n"))
+	}
+
+	fmt.Fprintf(w, "%d passed, %d failed\n", len(tests)-failed, failed)
+	return failed
+}
+
+func (s *AuthService) runPolicyTest(tt PolicyTest) (*httptest.ResponseRecorder, string) {
+	st := *s.Settings()
+	st.Explainer = &Explainer{header: true}
+	t := &AuthService{
+		SP:      staticSession{tt.Attributes},
+		M:       s.M,
+		RootURL: s.RootURL,
+		Log:     s.Log,
+	}
+	t.Reload(&st)
+
+	host, path := tt.Host, tt.Path
+	if host == "" {
+		host = "localhost"
+	}
+	if path == "" {
+		path = "/"
+	}
+	u := "https://" + host + path
+
+	req := httptest.NewRequest(http.MethodGet, "/saml/auth", nil)
+	req.Header.Set("X-Original-URL", u)
+	if tt.Method != "" {
+		req.Header.Set("X-Original-Method", tt.Method)
+	}
+	res := httptest.NewRecorder()
+
+	t.Auth(res, req)
+	return res, u
+}
+
+func verdict(allow bool) string {
+	if allow {
+		return "allow"
+	}
+	return "deny"
+}
+
+// staticSession provides session with fixed attributes issued just now, so
+// policies with maxage do not treat it as stale
+type staticSession struct {
+	attributes samlsp.Attributes
+}
+
+func (s staticSession) CreateSession(w http.ResponseWriter, r *http.Request, assertion *saml.Assertion) error {
+	return nil
+}
+
+func (s staticSession) DeleteSession(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func (s staticSession) GetSession(r *http.Request) (samlsp.Session, error) {
+	return samlsp.JWTSessionClaims{
+		StandardClaims: jwt.StandardClaims{IssuedAt: time.Now().Unix()},
+		Attributes:     s.attributes,
+	}, nil
+}
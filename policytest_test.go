@@ -0,0 +1,91 @@
+package authorizer
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/crewjam/saml/samlsp"
+	"go.uber.org/zap"
+)
+
+func TestRunPolicyTestsExample(t *testing.T) {
+	c, err := LoadConfig("testdata/policytest-config.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := NewSettings(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests, err := LoadPolicyTests("testdata/policytest.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &AuthService{Log: zap.NewNop()}
+	s.Reload(st)
+
+	var out bytes.Buffer
+	if failed := s.RunPolicyTests(tests, &out); failed != 0 {
+		t.Errorf("RunPolicyTests() failed %d tests:\n%s", failed, out.String())
+	}
+}
+
+func TestRunPolicyTests(t *testing.T) {
+	s := fakeAuthService(&unknownUser{}, nil)
+	s.Reload(&Settings{
+		ACL: mustNewACL(nil, []Policy{{
+			Host:               "grafana.example.com",
+			RequiredAttributes: []requirement{{"group": "sre"}},
+		}}),
+		Headers: mustNewHeaderMap(HeadersConfig{Allow: []string{"name"}}),
+	})
+
+	tests := []PolicyTest{{
+		Name:       "sre",
+		Host:       "grafana.example.com",
+		Attributes: samlsp.Attributes{"group": {"sre"}, "name": {"Alice"}},
+		Allow:      true,
+		Headers:    map[string]string{"X-Name": "Alice", "X-Secret": ""},
+	}, {
+		Name:       "wrong header",
+		Host:       "grafana.example.com",
+		Attributes: samlsp.Attributes{"group": {"sre"}, "name": {"Bob"}},
+		Allow:      true,
+		Headers:    map[string]string{"X-Name": "Alice"},
+	}, {
+		Name:       "unexpected deny",
+		Host:       "grafana.example.com",
+		Attributes: samlsp.Attributes{"group": {"users"}},
+		Allow:      true,
+	}, {
+		Attributes: samlsp.Attributes{"group": {"users"}},
+		Allow:      true,
+	}}
+
+	var out bytes.Buffer
+	if got, want := s.RunPolicyTests(tests, &out), 2; got != want {
+		t.Errorf("RunPolicyTests() = %d, want %d", got, want)
+	}
+
+	for _, want := range []string{
+		"PASS    sre ",
+		"FAIL    wrong header ",
+		"--- wrong header\n    header X-Name: want \"Alice\", got \"Bob\"",
+		"FAIL    unexpected deny ",
+		`deny; policy="grafana.example.com"; reason="group equals \"sre\" not met, got [\"users\"]"`,
+		"PASS    #4 ",
+		"2 passed, 2 failed",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output does not contain %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestLoadPolicyTestsUnknownField(t *testing.T) {
+	if _, err := LoadPolicyTests("testdata/policytest-config.yaml"); err == nil {
+		t.Error("expected error")
+	}
+}
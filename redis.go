@@ -0,0 +1,369 @@
+package authorizer
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RedisConfig for redis session store, any server speaking Redis protocol
+// works
+type RedisConfig struct {
+	// Addr is host:port of server
+	Addr string `yaml:"addr"`
+	// Username for ACL authentication, empty for password only
+	Username string `yaml:"username"`
+	// Password, prefer AUTHORIZER_SESSION_REDIS_PASSWORD_FILE
+	Password string `yaml:"password"`
+	// DB number selected after connecting
+	DB int `yaml:"db"`
+	// Prefix of session keys, default "authorizer:session:"
+	Prefix string `yaml:"prefix"`
+	// TLS connects with TLS using system roots
+	TLS bool `yaml:"tls"`
+	// Timeout of dial and every command, default 5s
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+const (
+	defaultRedisPrefix  = "authorizer:session:"
+	defaultRedisTimeout = 5 * time.Second
+	maxIdleRedisConns   = 8
+)
+
+func (c *RedisConfig) validate() []string {
+	var errs []string
+	if c.Addr == "" {
+		errs = append(errs, "addr: is required")
+	} else if _, _, err := net.SplitHostPort(c.Addr); err != nil {
+		errs = append(errs, "addr: "+err.Error())
+	}
+	if c.DB < 0 {
+		errs = append(errs, "db: must not be negative")
+	}
+	if c.Timeout < 0 {
+		errs = append(errs, "timeout: must not be negative")
+	}
+	return errs
+}
+
+// RedisStore keeps sessions as JSON values expiring together with session
+// and revocations in sorted set
+type RedisStore struct {
+	config RedisConfig
+
+	mu   sync.Mutex
+	idle []*redisConn
+}
+
+// NewRedisStore returns RedisStore for config, connections are opened on
+// first use
+func NewRedisStore(c RedisConfig) *RedisStore {
+	if c.Prefix == "" {
+		c.Prefix = defaultRedisPrefix
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaultRedisTimeout
+	}
+	return &RedisStore{config: c}
+}
+
+// Put implements SessionStore
+func (s *RedisStore) Put(ctx context.Context, session *ServerSession) error {
+	ttl := time.Until(session.ExpiresAt).Milliseconds()
+	if ttl <= 0 {
+		return s.Delete(ctx, session.ID)
+	}
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	_, err = s.do(ctx, "SET", s.config.Prefix+session.ID, string(data), "PX", strconv.FormatInt(ttl, 10))
+	return err
+}
+
+// Renew implements SessionStore, SET XX leaves deleted session deleted
+func (s *RedisStore) Renew(ctx context.Context, session *ServerSession) error {
+	ttl := time.Until(session.ExpiresAt).Milliseconds()
+	if ttl <= 0 {
+		return s.Delete(ctx, session.ID)
+	}
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	reply, err := s.do(ctx, "SET", s.config.Prefix+session.ID, string(data), "XX", "PX", strconv.FormatInt(ttl, 10))
+	if err != nil {
+		return err
+	}
+	if reply == nil {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// Get implements SessionStore
+func (s *RedisStore) Get(ctx context.Context, id string) (*ServerSession, error) {
+	reply, err := s.do(ctx, "GET", s.config.Prefix+id)
+	if err != nil {
+		return nil, err
+	}
+	data, ok := reply.(string)
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	var session ServerSession
+	if err := json.Unmarshal([]byte(data), &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// Delete implements SessionStore
+func (s *RedisStore) Delete(ctx context.Context, id string) error {
+	_, err := s.do(ctx, "DEL", s.config.Prefix+id)
+	return err
+}
+
+// List implements SessionStore, keys are found with SCAN
+func (s *RedisStore) List(ctx context.Context) ([]*ServerSession, error) {
+	var sessions []*ServerSession
+	cursor := "0"
+	for {
+		reply, err := s.do(ctx, "SCAN", cursor, "MATCH", s.config.Prefix+"*", "COUNT", "100")
+		if err != nil {
+			return nil, err
+		}
+		values, ok := reply.([]interface{})
+		if !ok || len(values) != 2 {
+			return nil, errors.New("redis: malformed SCAN reply")
+		}
+		cursor, _ = values[0].(string)
+		keys, _ := values[1].([]interface{})
+		for _, key := range keys {
+			id := strings.TrimPrefix(fmt.Sprint(key), s.config.Prefix)
+			if !fileSessionID.MatchString(id) {
+				continue
+			}
+			session, err := s.Get(ctx, id)
+			if errors.Is(err, ErrSessionNotFound) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			sessions = append(sessions, session)
+		}
+		if cursor == "0" || cursor == "" {
+			return sessions, nil
+		}
+	}
+}
+
+// revocationsKey is sorted set of revocations scored by expiry time
+func (s *RedisStore) revocationsKey() string {
+	return s.config.Prefix + "revocations"
+}
+
+// Revoke implements RevocationStore
+func (s *RedisStore) Revoke(ctx context.Context, r Revocation) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = s.do(ctx, "ZADD", s.revocationsKey(), strconv.FormatInt(r.Expires.Unix(), 10), string(data))
+	return err
+}
+
+// Revocations implements RevocationStore, expired entries are removed
+func (s *RedisStore) Revocations(ctx context.Context) ([]Revocation, error) {
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	if _, err := s.do(ctx, "ZREMRANGEBYSCORE", s.revocationsKey(), "-inf", "("+now); err != nil {
+		return nil, err
+	}
+	reply, err := s.do(ctx, "ZRANGEBYSCORE", s.revocationsKey(), now, "+inf")
+	if err != nil {
+		return nil, err
+	}
+	values, _ := reply.([]interface{})
+	list := make([]Revocation, 0, len(values))
+	for _, v := range values {
+		var r Revocation
+		if err := json.Unmarshal([]byte(fmt.Sprint(v)), &r); err != nil {
+			return nil, err
+		}
+		list = append(list, r)
+	}
+	return activeRevocations(list, time.Now()), nil
+}
+
+// do sends command on idle or new connection and returns reply, broken
+// connections are dropped
+func (s *RedisStore) do(ctx context.Context, args ...string) (interface{}, error) {
+	c, err := s.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := c.do(ctx, s.config.Timeout, args...)
+	var rerr redisError
+	if err != nil && !errors.As(err, &rerr) {
+		c.Close()
+		return nil, err
+	}
+	s.put(c)
+	return reply, err
+}
+
+func (s *RedisStore) get(ctx context.Context) (*redisConn, error) {
+	s.mu.Lock()
+	if n := len(s.idle); n > 0 {
+		c := s.idle[n-1]
+		s.idle = s.idle[:n-1]
+		s.mu.Unlock()
+		return c, nil
+	}
+	s.mu.Unlock()
+	return s.dial(ctx)
+}
+
+func (s *RedisStore) put(c *redisConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.idle) >= maxIdleRedisConns {
+		c.Close()
+		return
+	}
+	s.idle = append(s.idle, c)
+}
+
+func (s *RedisStore) dial(ctx context.Context) (*redisConn, error) {
+	d := &net.Dialer{Timeout: s.config.Timeout}
+	var conn net.Conn
+	var err error
+	if s.config.TLS {
+		host, _, _ := net.SplitHostPort(s.config.Addr)
+		td := &tls.Dialer{NetDialer: d, Config: &tls.Config{ServerName: host}}
+		conn, err = td.DialContext(ctx, "tcp", s.config.Addr)
+	} else {
+		conn, err = d.DialContext(ctx, "tcp", s.config.Addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+
+	c := &redisConn{Conn: conn, r: bufio.NewReader(conn)}
+	if s.config.Password != "" {
+		args := []string{"AUTH", s.config.Password}
+		if s.config.Username != "" {
+			args = []string{"AUTH", s.config.Username, s.config.Password}
+		}
+		if _, err := c.do(ctx, s.config.Timeout, args...); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if s.config.DB != 0 {
+		if _, err := c.do(ctx, s.config.Timeout, "SELECT", strconv.Itoa(s.config.DB)); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// redisError is error reply of server, connection stays usable
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// redisConn speaks minimal subset of RESP2 protocol
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// do writes command as array of bulk strings and reads reply, nil bulk
+// string is returned as nil
+func (c *redisConn) do(ctx context.Context, timeout time.Duration, args ...string) (interface{}, error) {
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := c.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(arg))+"\r\n"...)
+		buf = append(buf, arg...)
+		buf = append(buf, "\r\n"...)
+	}
+	if _, err := c.Write(buf); err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+func (c *redisConn) read() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("redis: malformed reply")
+	}
+	kind, line := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return nil, redisError(line)
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		values := make([]interface{}, n)
+		var rerr redisError
+		for i := range values {
+			values[i], err = c.read()
+			if errors.As(err, &rerr) {
+				values[i] = rerr
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply type %q", kind)
+}
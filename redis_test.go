@@ -0,0 +1,219 @@
+package authorizer
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRedis serves commands used by RedisStore, expiry is ignored
+type fakeRedis struct {
+	ln       net.Listener
+	password string
+
+	mu       sync.Mutex
+	data     map[string]string
+	sets     map[string]map[string]float64
+	commands []string
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{ln: ln, password: password, data: map[string]string{}, sets: map[string]map[string]float64{}}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(c)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	authed := f.password == ""
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.commands = append(f.commands, args[0])
+		var reply string
+		switch cmd := strings.ToUpper(args[0]); {
+		case cmd == "AUTH":
+			authed = args[len(args)-1] == f.password
+			reply = "+OK\r\n"
+			if !authed {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authed:
+			reply = "-NOAUTH Authentication required.\r\n"
+		case cmd == "SELECT":
+			reply = "+OK\r\n"
+		case cmd == "SET":
+			reply = "+OK\r\n"
+			if _, ok := f.data[args[1]]; !ok && contains(args[3:], "XX") {
+				reply = "$-1\r\n"
+				break
+			}
+			f.data[args[1]] = args[2]
+		case cmd == "GET":
+			v, ok := f.data[args[1]]
+			reply = "$-1\r\n"
+			if ok {
+				reply = fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+			}
+		case cmd == "DEL":
+			_, ok := f.data[args[1]]
+			delete(f.data, args[1])
+			reply = ":0\r\n"
+			if ok {
+				reply = ":1\r\n"
+			}
+		case cmd == "SCAN":
+			var keys []string
+			for key := range f.data {
+				if strings.HasPrefix(key, strings.TrimSuffix(args[3], "*")) {
+					keys = append(keys, key)
+				}
+			}
+			reply = "*2\r\n$1\r\n0\r\n" + bulkArray(keys)
+		case cmd == "ZADD":
+			if f.sets[args[1]] == nil {
+				f.sets[args[1]] = map[string]float64{}
+			}
+			score, _ := strconv.ParseFloat(args[2], 64)
+			f.sets[args[1]][args[3]] = score
+			reply = ":1\r\n"
+		case cmd == "ZREMRANGEBYSCORE", cmd == "ZRANGEBYSCORE":
+			members := []string{}
+			for member, score := range f.sets[args[1]] {
+				if scoreAbove(score, args[2]) && scoreBelow(score, args[3]) {
+					members = append(members, member)
+				}
+			}
+			sort.Slice(members, func(i, j int) bool {
+				return f.sets[args[1]][members[i]] < f.sets[args[1]][members[j]] ||
+					f.sets[args[1]][members[i]] == f.sets[args[1]][members[j]] && members[i] < members[j]
+			})
+			if cmd == "ZRANGEBYSCORE" {
+				reply = bulkArray(members)
+				break
+			}
+			for _, member := range members {
+				delete(f.sets[args[1]], member)
+			}
+			reply = fmt.Sprintf(":%d\r\n", len(members))
+		default:
+			reply = "-ERR unknown command\r\n"
+		}
+		f.mu.Unlock()
+		io.WriteString(c, reply)
+	}
+}
+
+func bulkArray(values []string) string {
+	s := fmt.Sprintf("*%d\r\n", len(values))
+	for _, v := range values {
+		s += fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+	}
+	return s
+}
+
+func scoreAbove(score float64, min string) bool {
+	if min == "-inf" {
+		return true
+	}
+	if strings.HasPrefix(min, "(") {
+		v, _ := strconv.ParseFloat(min[1:], 64)
+		return score > v
+	}
+	v, _ := strconv.ParseFloat(min, 64)
+	return score >= v
+}
+
+func scoreBelow(score float64, max string) bool {
+	if max == "+inf" {
+		return true
+	}
+	if strings.HasPrefix(max, "(") {
+		v, _ := strconv.ParseFloat(max[1:], 64)
+		return score < v
+	}
+	v, _ := strconv.ParseFloat(max, 64)
+	return score <= v
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func TestRedisStore(t *testing.T) {
+	f := newFakeRedis(t, "secret")
+	store := NewRedisStore(RedisConfig{Addr: f.ln.Addr().String(), Password: "secret", DB: 2})
+	testSessionStore(t, store)
+	testRevocationStore(t, store)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.commands[0] != "AUTH" || f.commands[1] != "SELECT" {
+		t.Errorf("connection not set up with AUTH and SELECT: %v", f.commands)
+	}
+	for _, c := range f.commands[2:] {
+		if c == "AUTH" {
+			t.Errorf("connection not reused: %v", f.commands)
+			break
+		}
+	}
+	for key := range f.data {
+		if !strings.HasPrefix(key, defaultRedisPrefix) {
+			t.Errorf("key %s without prefix", key)
+		}
+	}
+}
+
+func TestRedisStoreAuthError(t *testing.T) {
+	f := newFakeRedis(t, "secret")
+	store := NewRedisStore(RedisConfig{Addr: f.ln.Addr().String(), Password: "wrong"})
+	_, err := store.Get(context.Background(), sessionID("alice"))
+	if err == nil || err.Error() != "redis: WRONGPASS invalid password" {
+		t.Errorf("Get() error = %v", err)
+	}
+}
@@ -0,0 +1,218 @@
+package authorizer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlsp"
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultMetadataRefresh is the longest time between IdP metadata
+	// refreshes when metadata does not ask for shorter one
+	defaultMetadataRefresh = time.Hour
+	// minMetadataRefresh keeps short cacheDuration from hammering IdP
+	minMetadataRefresh = time.Minute
+	// metadataRetry is the first delay after failed refresh, it doubles
+	// with every failure up to refresh interval
+	metadataRetry = 10 * time.Second
+)
+
+// nextMetadataRefresh returns when metadata fetched at now should be
+// fetched again: after interval, cacheDuration or half of the time left
+// until validUntil, whichever is first
+func nextMetadataRefresh(md *saml.EntityDescriptor, now time.Time, interval time.Duration) time.Time {
+	if interval <= 0 {
+		interval = defaultMetadataRefresh
+	}
+	if md.CacheDuration > 0 && md.CacheDuration < interval {
+		interval = md.CacheDuration
+	}
+	if !md.ValidUntil.IsZero() {
+		if left := md.ValidUntil.Sub(now) / 2; left < interval {
+			interval = left
+		}
+	}
+	if interval < minMetadataRefresh {
+		interval = minMetadataRefresh
+	}
+	return now.Add(interval)
+}
+
+// metadataBackoff returns delay before retry after failures in a row
+func metadataBackoff(failures int, interval time.Duration) time.Duration {
+	if interval <= 0 {
+		interval = defaultMetadataRefresh
+	}
+	d := metadataRetry
+	for i := 1; i < failures && d < interval; i++ {
+		d *= 2
+	}
+	if d > interval {
+		d = interval
+	}
+	return d
+}
+
+// certificateFingerprints returns SHA-256 fingerprints of IdP signing
+// certificates
+func certificateFingerprints(md *saml.EntityDescriptor) []string {
+	certs, _ := IDPSigningCertificates(md)
+	var fps []string
+	for _, c := range certs {
+		fps = append(fps, certificateFingerprint(c))
+	}
+	return fps
+}
+
+// metadataMiddleware returns middleware of IdP named idp, of service
+// provider when idp is empty
+func (s *AuthService) metadataMiddleware(idp string) (*samlsp.Middleware, error) {
+	if idp == "" {
+		return s.M, nil
+	}
+	if i := s.idpByName(idp); i != nil {
+		return i.M, nil
+	}
+	return nil, fmt.Errorf("unknown identity provider %q", idp)
+}
+
+// refreshIDPMetadata fetches metadata of IdP named idp and replaces the
+// one in use, requests in flight finish with metadata they started with.
+// Change of signing certificates is logged.
+func (s *AuthService) refreshIDPMetadata(ctx context.Context, idp string, fetch func(context.Context) (*saml.EntityDescriptor, error)) (*saml.EntityDescriptor, error) {
+	m, err := s.metadataMiddleware(idp)
+	if err != nil {
+		return nil, err
+	}
+	md, err := fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := IDPSigningCertificates(md); err != nil {
+		return nil, err
+	}
+	if len(md.IDPSSODescriptors) == 0 {
+		return nil, errors.New("metadata has no IDPSSODescriptor")
+	}
+
+	s.idpMu.Lock()
+	old := m.ServiceProvider.IDPMetadata
+	m.ServiceProvider.IDPMetadata = md
+	s.idpMu.Unlock()
+
+	if old == nil {
+		return md, nil
+	}
+	if o, n := certificateFingerprints(old), certificateFingerprints(md); !reflect.DeepEqual(o, n) {
+		s.Log.Warn("IdP signing certificates changed",
+			zap.String("idp", idp),
+			zap.String("entityId", md.EntityID),
+			zap.Strings("old", o),
+			zap.Strings("new", n),
+		)
+	}
+	if old.EntityID != md.EntityID {
+		s.Log.Warn("IdP entity ID changed", zap.String("idp", idp), zap.String("old", old.EntityID), zap.String("new", md.EntityID))
+	}
+	return md, nil
+}
+
+// RefreshIDPMetadata keeps metadata of IdP named idp, or of the only IdP
+// when idp is empty, up to date using fetch. Metadata is fetched again
+// after interval (default 1h) or sooner when its cacheDuration or
+// validUntil ask for it. Failed fetches are retried with exponential
+// backoff and last good metadata stays in use. Runs until ctx is done.
+func (s *AuthService) RefreshIDPMetadata(ctx context.Context, idp string, fetch func(context.Context) (*saml.EntityDescriptor, error), interval time.Duration) {
+	m, err := s.metadataMiddleware(idp)
+	if err != nil {
+		s.Log.Error("IdP metadata refresh", zap.String("idp", idp), zap.Error(err))
+		return
+	}
+	s.idpMu.RLock()
+	md := m.ServiceProvider.IDPMetadata
+	s.idpMu.RUnlock()
+
+	var next time.Time
+	if md != nil {
+		next = nextMetadataRefresh(md, time.Now(), interval)
+	}
+	failures := 0
+	for {
+		t := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+
+		fetched, err := s.refreshIDPMetadata(ctx, idp, fetch)
+		if err != nil {
+			failures++
+			retry := metadataBackoff(failures, interval)
+			fields := []zap.Field{zap.String("idp", idp), zap.Error(err), zap.Int("failures", failures), zap.Duration("retry", retry)}
+			if md != nil && !md.ValidUntil.IsZero() && time.Now().After(md.ValidUntil) {
+				s.Log.Error("IdP metadata refresh failed, metadata in use has expired", fields...)
+			} else {
+				s.Log.Warn("IdP metadata refresh failed, keeping last good metadata", fields...)
+			}
+			next = time.Now().Add(retry)
+			continue
+		}
+		md, failures = fetched, 0
+		next = nextMetadataRefresh(md, time.Now(), interval)
+		s.Log.Debug("IdP metadata refreshed", zap.String("idp", idp), zap.Time("next", next))
+	}
+}
+
+// missingMetadata returns IdPs of service without metadata
+func (s *AuthService) missingMetadata() []string {
+	s.idpMu.RLock()
+	defer s.idpMu.RUnlock()
+
+	label := func(idp string) string {
+		switch {
+		case s.Tenant != "" && idp != "":
+			return s.Tenant + "/" + idp
+		case s.Tenant != "":
+			return s.Tenant
+		case idp != "":
+			return idp
+		}
+		return "default"
+	}
+	var missing []string
+	if len(s.IDPs) == 0 && (s.M == nil || s.M.ServiceProvider.IDPMetadata == nil) {
+		missing = append(missing, label(""))
+	}
+	for _, idp := range s.IDPs {
+		if idp.M.ServiceProvider.IDPMetadata == nil {
+			missing = append(missing, label(idp.Name))
+		}
+	}
+	return missing
+}
+
+// Ready handler reports whether IdP metadata of service provider and its
+// tenants is loaded, users can not sign in until it is
+func (s *AuthService) Ready(w http.ResponseWriter, r *http.Request) {
+	missing := s.missingMetadata()
+	for _, t := range s.Tenants {
+		missing = append(missing, t.S.missingMetadata()...)
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if len(missing) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "IdP metadata not loaded: %s\n", strings.Join(missing, ", "))
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
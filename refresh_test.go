@@ -0,0 +1,200 @@
+package authorizer
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/crewjam/saml"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestNextMetadataRefresh(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		md       saml.EntityDescriptor
+		interval time.Duration
+		want     time.Duration
+	}{{
+		name: "Default",
+		want: time.Hour,
+	}, {
+		name:     "Interval",
+		interval: 10 * time.Minute,
+		want:     10 * time.Minute,
+	}, {
+		name: "CacheDuration",
+		md:   saml.EntityDescriptor{CacheDuration: 15 * time.Minute},
+		want: 15 * time.Minute,
+	}, {
+		name:     "LongCacheDuration",
+		md:       saml.EntityDescriptor{CacheDuration: 24 * time.Hour},
+		interval: 2 * time.Hour,
+		want:     2 * time.Hour,
+	}, {
+		name: "ValidUntil",
+		md:   saml.EntityDescriptor{ValidUntil: now.Add(40 * time.Minute)},
+		want: 20 * time.Minute,
+	}, {
+		name: "Expired",
+		md:   saml.EntityDescriptor{ValidUntil: now.Add(-time.Hour)},
+		want: time.Minute,
+	}, {
+		name: "ShortCacheDuration",
+		md:   saml.EntityDescriptor{CacheDuration: time.Second},
+		want: time.Minute,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nextMetadataRefresh(&tt.md, now, tt.interval).Sub(now); got != tt.want {
+				t.Errorf("nextMetadataRefresh() = now + %v, want now + %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetadataBackoff(t *testing.T) {
+	var got []time.Duration
+	for failures := 1; failures <= 6; failures++ {
+		got = append(got, metadataBackoff(failures, 2*time.Minute))
+	}
+	want := []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second, 80 * time.Second, 2 * time.Minute, 2 * time.Minute}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("metadataBackoff(%d) = %v, want %v", i+1, got[i], want[i])
+		}
+	}
+}
+
+// signedMetadata returns IdP metadata with signing certificate for cn
+func signedMetadata(t *testing.T, cn string) *saml.EntityDescriptor {
+	_, cert := testKeyPair(t, cn)
+	return &saml.EntityDescriptor{
+		EntityID: "https://idp.example.com/metadata",
+		IDPSSODescriptors: []saml.IDPSSODescriptor{{
+			SSODescriptor: saml.SSODescriptor{
+				RoleDescriptor: saml.RoleDescriptor{
+					KeyDescriptors: []saml.KeyDescriptor{keyDescriptor("signing", cert)},
+				},
+			},
+		}},
+	}
+}
+
+func TestRefreshIDPMetadata(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	s := fakeAuthService(&validUser{}, nil)
+	s.Log = zap.New(core)
+	s.M.ServiceProvider.IDPMetadata = signedMetadata(t, "old.idp.example.com")
+
+	// same certificates, nothing is logged
+	same := *s.M.ServiceProvider.IDPMetadata
+	fetch := func(context.Context) (*saml.EntityDescriptor, error) { return &same, nil }
+	if _, err := s.refreshIDPMetadata(context.Background(), "", fetch); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.M.ServiceProvider.IDPMetadata; got != &same {
+		t.Error("metadata was not replaced")
+	}
+	if n := logs.FilterMessage("IdP signing certificates changed").Len(); n != 0 {
+		t.Errorf("got %d certificate change events, want 0", n)
+	}
+
+	// rollover
+	rolled := signedMetadata(t, "new.idp.example.com")
+	fetch = func(context.Context) (*saml.EntityDescriptor, error) { return rolled, nil }
+	if _, err := s.refreshIDPMetadata(context.Background(), "", fetch); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.M.ServiceProvider.IDPMetadata; got != rolled {
+		t.Error("metadata was not replaced")
+	}
+	if n := logs.FilterMessage("IdP signing certificates changed").Len(); n != 1 {
+		t.Errorf("got %d certificate change events, want 1", n)
+	}
+
+	// failures keep last good metadata
+	for _, fetch := range []func(context.Context) (*saml.EntityDescriptor, error){
+		func(context.Context) (*saml.EntityDescriptor, error) { return nil, errors.New("connection refused") },
+		func(context.Context) (*saml.EntityDescriptor, error) { return &saml.EntityDescriptor{}, nil },
+	} {
+		if _, err := s.refreshIDPMetadata(context.Background(), "", fetch); err == nil {
+			t.Error("refreshIDPMetadata() expected error")
+		}
+		if got := s.M.ServiceProvider.IDPMetadata; got != rolled {
+			t.Error("last good metadata was replaced")
+		}
+	}
+
+	if _, err := s.refreshIDPMetadata(context.Background(), "partners", fetch); err == nil {
+		t.Error("refreshIDPMetadata() expected error for unknown IdP")
+	}
+}
+
+func TestRefreshIDPMetadataRun(t *testing.T) {
+	s := fakeAuthService(&validUser{}, nil)
+	s.Log = zap.NewNop()
+	s.M.ServiceProvider.IDPMetadata = nil
+
+	ctx, cancel := context.WithCancel(context.Background())
+	md := signedMetadata(t, "idp.example.com")
+	done := make(chan struct{})
+	go func() {
+		s.RefreshIDPMetadata(ctx, "", func(context.Context) (*saml.EntityDescriptor, error) {
+			cancel()
+			return md, nil
+		}, time.Hour)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("RefreshIDPMetadata did not return after ctx was done")
+	}
+	s.idpMu.RLock()
+	defer s.idpMu.RUnlock()
+	if got := s.M.ServiceProvider.IDPMetadata; got != md {
+		t.Error("missing metadata was not fetched right away")
+	}
+}
+
+func TestReadyHandler(t *testing.T) {
+	s, _ := tenantService()
+	hr := s.Tenants[0].S
+	hr.IDPs = []*IDP{NewIDP(IDPConfig{Name: "workday"}, hr.M, nil)}
+
+	res := httptest.NewRecorder()
+	s.Ready(res, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if got, want := res.Code, http.StatusServiceUnavailable; got != want {
+		t.Errorf("got status %d but wanted %d", got, want)
+	}
+	if got, want := res.Body.String(), "IdP metadata not loaded: hr/workday\n"; got != want {
+		t.Errorf("got body %q, want %q", got, want)
+	}
+
+	hr.IDPs[0].M.ServiceProvider.IDPMetadata = signedMetadata(t, "workday.example.com")
+	res = httptest.NewRecorder()
+	s.Ready(res, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if got, want := res.Code, http.StatusOK; got != want {
+		t.Errorf("got status %d but wanted %d", got, want)
+	}
+}
+
+func TestSigninWithoutMetadata(t *testing.T) {
+	s := fakeAuthService(&unknownUser{}, nil)
+	s.M.ServiceProvider.IDPMetadata = nil
+
+	req := httptest.NewRequest(http.MethodGet, "/saml/signin?rd=https%3A%2F%2Fexample.com%2F", nil)
+	res := httptest.NewRecorder()
+	s.Signin(res, req)
+	if got, want := res.Code, http.StatusServiceUnavailable; got != want {
+		t.Errorf("got status %d but wanted %d", got, want)
+	}
+}
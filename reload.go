@@ -0,0 +1,280 @@
+package authorizer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Settings is the part of configuration that can be changed without
+// restart
+type Settings struct {
+	ACL       *ACL
+	PDP       *PDP
+	Explainer *Explainer
+	Headers   *HeaderMap
+	Aliases   *Aliases
+	Token     *TokenMinter
+	Signer    *HeaderSigner
+	Admin     *Admin
+	// IDPPolicies restrict sessions by IdP name
+	IDPPolicies map[string]*policy
+}
+
+// NewSettings compiles policies, IdP policies, policy decision point,
+// explain, headers, attributes, upstream token, signature and admin config
+func NewSettings(c *Config) (*Settings, error) {
+	// attribute names in policies and claims are renamed like attributes
+	// of sessions
+	aliases, err := NewAliases(c.Attributes)
+	if err != nil {
+		return nil, fmt.Errorf("attributes: %w", err)
+	}
+
+	acl, err := NewACL(Policy{
+		RequiredAttributes: c.RequiredAttributes,
+		Expression:         c.Expression,
+	}, c.Policies)
+	if err != nil {
+		return nil, err
+	}
+	acl.canonical(aliases)
+
+	idpPolicies, err := newIDPPolicies(c.IDPs)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range idpPolicies {
+		p.canonical(aliases)
+	}
+
+	var pdp *PDP
+	if c.PDP != nil {
+		pdp = NewPDP(*c.PDP)
+	}
+
+	explainer, err := NewExplainer(c.Explain)
+	if err != nil {
+		return nil, err
+	}
+	if explainer.admins != nil {
+		canonicalExpr(explainer.admins, aliases)
+	}
+
+	headers, err := NewHeaderMap(c.Headers)
+	if err != nil {
+		return nil, fmt.Errorf("headers: %w", err)
+	}
+
+	var token *TokenMinter
+	if c.JWT != nil {
+		if token, err = NewTokenMinter(*c.JWT, c.URL); err != nil {
+			return nil, fmt.Errorf("jwt: %w", err)
+		}
+		token.canonical(aliases)
+	}
+
+	var signer *HeaderSigner
+	if c.Signature != nil {
+		if signer, err = NewHeaderSigner(*c.Signature); err != nil {
+			return nil, fmt.Errorf("signature: %w", err)
+		}
+	}
+
+	if token != nil {
+		headers.reserve(token.Header())
+	}
+	if signer != nil {
+		headers.reserve(signer.Header())
+	}
+
+	var admin *Admin
+	if c.Admin != nil {
+		if admin, err = NewAdmin(*c.Admin); err != nil {
+			return nil, fmt.Errorf("admin: %w", err)
+		}
+		if admin.users != nil {
+			canonicalExpr(admin.users, aliases)
+		}
+	}
+
+	return &Settings{
+		ACL:       acl,
+		PDP:       pdp,
+		Explainer: explainer,
+		Headers:   headers,
+		Aliases:   aliases,
+		Token:     token,
+		Signer:    signer,
+		Admin:     admin,
+
+		IDPPolicies: idpPolicies,
+	}, nil
+}
+
+// keepPDP replaces policy decision point of st with one of old when both
+// have the same config
+func (st *Settings) keepPDP(old *Settings) {
+	if st.PDP != nil && old.PDP != nil && st.PDP.config == old.PDP.config {
+		st.PDP = old.PDP
+	}
+}
+
+// Settings returns settings currently in use
+func (s *AuthService) Settings() *Settings {
+	if st, ok := s.settings.Load().(*Settings); ok {
+		return st
+	}
+	return &Settings{}
+}
+
+// Reload atomically replaces settings, requests in flight finish with
+// settings they started with
+func (s *AuthService) Reload(st *Settings) {
+	s.settings.Store(st)
+}
+
+// reloadable lists config keys applied by Reload, other keys need restart
+var reloadable = map[string]bool{
+	"requiredattributes": true,
+	"policy":             true,
+	"policies":           true,
+	"pdp":                true,
+	"explain":            true,
+	"headers":            true,
+	"attributes":         true,
+	"jwt":                true,
+	"signature":          true,
+	"admin":              true,
+}
+
+// restartRequired returns keys that differ between c and old and are not
+// reloadable
+func (c *Config) restartRequired(old *Config) []string {
+	var keys []string
+	v, o := reflect.ValueOf(c).Elem(), reflect.ValueOf(old).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		key := v.Type().Field(i).Tag.Get("yaml")
+		if reloadable[key] {
+			continue
+		}
+		a, b := v.Field(i).Interface(), o.Field(i).Interface()
+		// IdP policies are reloaded with settings
+		switch key {
+		case "idps":
+			a, b = withoutPolicies(c.IDPs), withoutPolicies(old.IDPs)
+		case "tenants":
+			a, b = staticTenants(c.Tenants), staticTenants(old.Tenants)
+		}
+		if !reflect.DeepEqual(a, b) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// WatchConfig reloads settings using load when content of config file name
+// changes, checked every interval, or when trigger fires. Invalid config
+// is logged and ignored, current settings keep serving. Content is
+// compared rather than modification time so Kubernetes ConfigMap updates,
+// which swap a symlink, are noticed too. The first check always reloads so
+// changes made after running config was loaded are not missed. Changes to
+// keys that are not reloadable compared to running config are logged once,
+// applied config becomes running config. Runs until ctx is done.
+func (s *AuthService) WatchConfig(ctx context.Context, name string, load func() (*Config, error), running *Config, interval time.Duration, trigger <-chan os.Signal) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		tick = t.C
+	}
+
+	var sum []byte
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick:
+			next := fileSum(name)
+			if bytes.Equal(next, sum) {
+				continue
+			}
+			sum = next
+		case <-trigger:
+			sum = fileSum(name)
+		}
+
+		if c := s.reloadConfig(name, load, running); c != nil {
+			running = c
+		}
+	}
+}
+
+// reloadConfig returns config applied, nil when it was rejected
+func (s *AuthService) reloadConfig(name string, load func() (*Config, error), running *Config) *Config {
+	c, err := load()
+	if err == nil {
+		err = s.reloadTenants(c)
+	}
+	if err != nil {
+		var errs ConfigError
+		if errors.As(err, &errs) {
+			s.Log.Error("config reload rejected", zap.String("file", name), zap.Strings("errors", errs))
+		} else {
+			s.Log.Error("config reload rejected", zap.String("file", name), zap.Error(err))
+		}
+		return nil
+	}
+
+	if keys := c.restartRequired(running); len(keys) > 0 {
+		s.Log.Warn("config changes need restart", zap.String("file", name), zap.Strings("keys", keys))
+	}
+	s.Log.Info("config reloaded", zap.String("file", name))
+	return c
+}
+
+// reloadTenants replaces settings of service and its tenants with
+// settings for c, none are replaced when any is invalid. Tenants missing
+// from c keep their settings until restart. Policy decision point with
+// unchanged config is kept together with its decision cache.
+func (s *AuthService) reloadTenants(c *Config) error {
+	st, err := NewSettings(c)
+	if err != nil {
+		return err
+	}
+	st.keepPDP(s.Settings())
+	tenants := map[*AuthService]*Settings{}
+	for _, t := range s.Tenants {
+		for _, tc := range c.Tenants {
+			if tc.Name != t.Name {
+				continue
+			}
+			if tenants[t.S], err = NewSettings(c.Tenant(tc)); err != nil {
+				return fmt.Errorf("tenant %s: %w", t.Name, err)
+			}
+			tenants[t.S].keepPDP(t.S.Settings())
+		}
+	}
+
+	s.Reload(st)
+	for ts, st := range tenants {
+		ts.Reload(st)
+	}
+	return nil
+}
+
+func fileSum(name string) []byte {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil
+	}
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
@@ -0,0 +1,201 @@
+package authorizer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+const reloadConfigYAML = `
+url: https://auth.example.com
+keyfile: tls.key
+certificatefile: tls.crt
+idpmetadataurl: https://idp.example.com/metadata
+addr: ":8000"
+`
+
+// writeConfigMap writes config the way kubelet updates ConfigMap volumes:
+// files live in timestamped directory and ..data symlink is swapped
+func writeConfigMap(t *testing.T, dir, version, config string) {
+	t.Helper()
+	data := filepath.Join(dir, "..data_"+version)
+	if err := os.Mkdir(data, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(data, "config.yaml"), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tmp := filepath.Join(dir, "..data_tmp")
+	if err := os.Symlink(filepath.Base(data), tmp); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "config.yaml")); os.IsNotExist(err) {
+		if err := os.Symlink("..data/config.yaml", filepath.Join(dir, "config.yaml")); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWatchConfig(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "config.yaml")
+	writeConfigMap(t, dir, "1", reloadConfigYAML+"requiredattributes:\n  - group: users\n")
+
+	running, err := LoadConfig(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := NewSettings(running)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	core, logs := observer.New(zapcore.InfoLevel)
+	s := &AuthService{Log: zap.New(core)}
+	s.Reload(st)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hup := make(chan os.Signal)
+	load := func() (*Config, error) { return LoadConfig(name) }
+	go s.WatchConfig(ctx, name, load, running, 10*time.Millisecond, hup)
+
+	policies := func() []string { return s.Settings().ACL.Describe() }
+
+	// ConfigMap update is picked up
+	writeConfigMap(t, dir, "2", reloadConfigYAML+"requiredattributes:\n  - group: sre\n")
+	waitFor(t, "reload", func() bool {
+		return reflect.DeepEqual(policies(), []string{`global: (group equals "sre")`})
+	})
+
+	// Invalid config is rejected and old settings keep serving
+	writeConfigMap(t, dir, "3", reloadConfigYAML+"requiredattributes:\n  - group regex: \"(\"\n")
+	waitFor(t, "rejected reload", func() bool {
+		return logs.FilterMessage("config reload rejected").Len() == 1
+	})
+	if got, want := policies(), []string{`global: (group equals "sre")`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("policies = %v, want %v", got, want)
+	}
+
+	// Keys that are not reloadable are reported
+	writeConfigMap(t, dir, "4", reloadConfigYAML+"forceauthn: true\n")
+	waitFor(t, "restart warning", func() bool {
+		return logs.FilterMessage("config changes need restart").Len() == 1
+	})
+	warning := logs.FilterMessage("config changes need restart").All()[0]
+	if got, want := warning.ContextMap()["keys"], []interface{}{"forceauthn"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("keys = %v, want %v", got, want)
+	}
+
+	// SIGHUP reloads even if file did not change
+	reloaded := logs.FilterMessage("config reloaded").Len()
+	hup <- os.Interrupt
+	waitFor(t, "forced reload", func() bool {
+		return logs.FilterMessage("config reloaded").Len() == reloaded+1
+	})
+
+	// restart warning is not repeated for changes already reported
+	if n := logs.FilterMessage("config changes need restart").Len(); n != 1 {
+		t.Errorf("got %d restart warnings, want 1", n)
+	}
+}
+
+func TestReloadKeepsPDP(t *testing.T) {
+	c := validConfig()
+	c.PDP = &PDPConfig{URL: "http://opa:8181/v1/data/authz", CacheTTL: time.Minute}
+	st, err := NewSettings(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &AuthService{Log: zap.NewNop()}
+	s.Reload(st)
+	pdp := st.PDP
+
+	c.RequiredAttributes = []requirement{{"group": "sre"}}
+	if err := s.reloadTenants(c); err != nil {
+		t.Fatal(err)
+	}
+	if s.Settings().PDP != pdp {
+		t.Error("PDP with unchanged config was replaced")
+	}
+
+	c.PDP = &PDPConfig{URL: "http://opa:8181/v1/data/authz", CacheTTL: 2 * time.Minute}
+	if err := s.reloadTenants(c); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Settings().PDP; got == pdp || got.CacheTTL != 2*time.Minute {
+		t.Error("PDP with changed config was kept")
+	}
+}
+
+func TestNewSettingsAliasNames(t *testing.T) {
+	c := validConfig()
+	c.IDPs = []IDPConfig{{
+		Name:               "employees",
+		MetadataURL:        "https://idp.example.com/metadata",
+		RequiredAttributes: []requirement{{"memberOf": "staff"}},
+		Policy:             `has(userid)`,
+	}}
+	c.Explain = ExplainConfig{Admins: `isMemberOf == "sre"`}
+	c.Admin = &AdminConfig{Users: `!(emailAddress != "admin@example.com")`}
+	st, err := NewSettings(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct{ got, want string }{
+		{st.IDPPolicies["employees"].describe(), `(groups equals "staff") && has(uid)`},
+		{st.Explainer.admins.String(), `groups == "sre"`},
+		{st.Admin.users.String(), `!(mail != "admin@example.com")`},
+	} {
+		if !strings.Contains(tt.got, tt.want) {
+			t.Errorf("got %s, want %s", tt.got, tt.want)
+		}
+	}
+}
+
+func TestConfigRestartRequired(t *testing.T) {
+	old := validConfig()
+	c := validConfig()
+	c.RequiredAttributes = []requirement{{"group": "sre"}}
+	c.Policies = []Policy{{Host: "example.com"}}
+	c.PDP = &PDPConfig{URL: "http://opa"}
+	if got := c.restartRequired(old); len(got) != 0 {
+		t.Errorf("restartRequired() = %v, want none", got)
+	}
+
+	c.URL = "https://other.example.com"
+	c.Addr = ":9000"
+	if got, want := c.restartRequired(old), []string{"url", "addr"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("restartRequired() = %v, want %v", got, want)
+	}
+}
+
+func TestAuthServiceSettingsDefault(t *testing.T) {
+	s := &AuthService{}
+	if got := s.Settings(); got == nil || got.ACL != nil {
+		t.Errorf("Settings() = %+v, want empty settings", got)
+	}
+}
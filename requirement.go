@@ -0,0 +1,169 @@
+package authorizer
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/crewjam/saml/samlsp"
+)
+
+// requirement maps attribute name to expected value. Name can be followed
+// by an operator, e.g. "mail suffix: @example.com", bare name means equals.
+type requirement map[string]string
+
+// Operators supported in requirement keys
+const (
+	opEquals  = "equals"
+	opGlob    = "glob"
+	opRegex   = "regex"
+	opPrefix  = "prefix"
+	opSuffix  = "suffix"
+	opNotIn   = "not-in"
+	opPresent = "present"
+	opAbsent  = "absent"
+)
+
+// rule is a compiled requirement, all conditions have to be met
+type rule []condition
+
+// condition is a single compiled check of attribute values
+type condition struct {
+	name  string
+	op    string
+	value string
+	match func(values []string) bool
+}
+
+func (c condition) String() string {
+	switch c.op {
+	case opPresent, opAbsent:
+		return c.name + " " + c.op
+	}
+	return c.name + " " + c.op + " " + strconv.Quote(c.value)
+}
+
+func (r rule) String() string {
+	s := make([]string, len(r))
+	for i, c := range r {
+		s[i] = c.String()
+	}
+	return strings.Join(s, " && ")
+}
+
+// explain returns first condition of the rule that is not met
+func (r rule) explain(attributes samlsp.Attributes) string {
+	for _, c := range r {
+		if values := attributes[c.name]; !c.match(values) {
+			return fmt.Sprintf("%s not met, got %q", c, values)
+		}
+	}
+	return ""
+}
+
+// canonical renames attributes of conditions to canonical names
+func (r rule) canonical(a *Aliases) {
+	for i := range r {
+		r[i].name = a.Canonical(r[i].name)
+	}
+}
+
+func compileRequirements(requirements []requirement) ([]rule, error) {
+	if requirements == nil {
+		return nil, nil
+	}
+	rules := make([]rule, len(requirements))
+	for i, r := range requirements {
+		compiled, err := compileRequirement(r)
+		if err != nil {
+			return nil, fmt.Errorf("requirement %d: %w", i, err)
+		}
+		rules[i] = compiled
+	}
+	return rules, nil
+}
+
+func compileRequirement(r requirement) (rule, error) {
+	keys := make([]string, 0, len(r))
+	for key := range r {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	compiled := make(rule, 0, len(keys))
+	for _, key := range keys {
+		c, err := compileCondition(key, r[key])
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+func compileCondition(key, value string) (condition, error) {
+	c := condition{op: opEquals, value: value}
+
+	fields := strings.Fields(key)
+	switch len(fields) {
+	case 1:
+		c.name = fields[0]
+	case 2:
+		c.name, c.op = fields[0], fields[1]
+	default:
+		return c, fmt.Errorf("invalid attribute %q", key)
+	}
+
+	switch c.op {
+	case opEquals:
+		c.match = anyValue(func(v string) bool { return v == value })
+	case opGlob:
+		if _, err := path.Match(value, ""); err != nil {
+			return c, fmt.Errorf("%s: %w", key, err)
+		}
+		c.match = anyValue(func(v string) bool {
+			ok, _ := path.Match(value, v)
+			return ok
+		})
+	case opRegex:
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return c, fmt.Errorf("%s: %w", key, err)
+		}
+		c.match = anyValue(re.MatchString)
+	case opPrefix:
+		c.match = anyValue(func(v string) bool { return strings.HasPrefix(v, value) })
+	case opSuffix:
+		c.match = anyValue(func(v string) bool { return strings.HasSuffix(v, value) })
+	case opNotIn:
+		set := map[string]bool{}
+		for _, v := range strings.Split(value, ",") {
+			set[strings.TrimSpace(v)] = true
+		}
+		in := anyValue(func(v string) bool { return set[v] })
+		c.match = func(values []string) bool { return !in(values) }
+	case opPresent, opAbsent:
+		if value != "" && value != "true" {
+			return c, fmt.Errorf("%s: unexpected value %q", key, value)
+		}
+		present := c.op == opPresent
+		c.match = func(values []string) bool { return (len(values) > 0) == present }
+	default:
+		return c, fmt.Errorf("%s: unknown operator %q", key, c.op)
+	}
+	return c, nil
+}
+
+func anyValue(f func(string) bool) func([]string) bool {
+	return func(values []string) bool {
+		for _, v := range values {
+			if f(v) {
+				return true
+			}
+		}
+		return false
+	}
+}
@@ -0,0 +1,68 @@
+package authorizer
+
+import (
+	"testing"
+
+	"github.com/crewjam/saml/samlsp"
+)
+
+func TestCompileCondition(t *testing.T) {
+	attributes := samlsp.Attributes{
+		"mail":  []string{"alice@corp.com"},
+		"group": []string{"users", "team-sre-admins"},
+	}
+	tests := []struct {
+		name    string
+		key     string
+		value   string
+		want    bool
+		wantErr bool
+	}{
+		{name: "Equals", key: "group", value: "users", want: true},
+		{name: "EqualsExplicit", key: "group equals", value: "admins", want: false},
+		{name: "Glob", key: "mail glob", value: "*@corp.com", want: true},
+		{name: "GlobNoMatch", key: "mail glob", value: "*@corp.org", want: false},
+		{name: "GlobInvalid", key: "mail glob", value: "[", wantErr: true},
+		{name: "Regex", key: "group regex", value: "^team-.*-admins$", want: true},
+		{name: "RegexInvalid", key: "group regex", value: "(", wantErr: true},
+		{name: "Prefix", key: "group prefix", value: "team-", want: true},
+		{name: "Suffix", key: "mail suffix", value: "@corp.com", want: true},
+		{name: "NotIn", key: "group not-in", value: "contractors, vendors", want: true},
+		{name: "NotInMatch", key: "group not-in", value: "contractors,users", want: false},
+		{name: "NotInMissingAttr", key: "role not-in", value: "guest", want: true},
+		{name: "Present", key: "mail present", want: true},
+		{name: "PresentTrue", key: "mail present", value: "true", want: true},
+		{name: "PresentMissing", key: "role present", want: false},
+		{name: "PresentWithValue", key: "mail present", value: "x", wantErr: true},
+		{name: "Absent", key: "role absent", want: true},
+		{name: "AbsentExisting", key: "mail absent", want: false},
+		{name: "UnknownOperator", key: "mail contains", value: "corp", wantErr: true},
+		{name: "TooManyFields", key: "mail is not", value: "corp", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := compileCondition(tt.key, tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("compileCondition() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := c.match(attributes[c.name]); got != tt.want {
+				t.Errorf("condition %s = %v, want %v", c, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRuleString(t *testing.T) {
+	r := mustCompileRequirement(requirement{
+		"mail suffix":  "@corp.com",
+		"group":        "sre",
+		"role present": "",
+	})
+	got, want := r.String(), `group equals "sre" && mail suffix "@corp.com" && role present`
+	if got != want {
+		t.Errorf("rule.String() = %s, want %s", got, want)
+	}
+}
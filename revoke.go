@@ -0,0 +1,216 @@
+package authorizer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/crewjam/saml/samlsp"
+)
+
+// Revocation invalidates sessions of user with NameID, or of everyone when
+// NameID is empty, issued before given time
+type Revocation struct {
+	NameID string    `json:"nameid,omitempty"`
+	Before time.Time `json:"before"`
+	// Expires when all sessions it matches have expired anyway
+	Expires time.Time `json:"expires"`
+}
+
+// matches compares times at precision of issue time, cookie sessions keep
+// it in whole seconds and session signed in again within second of
+// revocation must not match
+func (r Revocation) matches(nameID string, issued time.Time, precision time.Duration) bool {
+	return (r.NameID == "" || r.NameID == nameID) && issued.Before(r.Before.Truncate(precision))
+}
+
+func activeRevocations(list []Revocation, now time.Time) []Revocation {
+	var active []Revocation
+	for _, r := range list {
+		if now.Before(r.Expires) {
+			active = append(active, r)
+		}
+	}
+	return active
+}
+
+// revocationRefresh is how often revocation list is reloaded from store,
+// revocations made by other replicas take effect after this delay
+const revocationRefresh = 5 * time.Second
+
+var errNoSessionStore = errors.New("sessions are kept in cookies and can not be listed")
+
+// Revoker checks sessions against revocation list, it works with stateless
+// cookie sessions and server side sessions
+type Revoker struct {
+	store    RevocationStore
+	sessions SessionStore
+	maxAge   time.Duration
+
+	mu     sync.Mutex
+	list   []Revocation
+	loaded time.Time
+	// revoked counts local revocations, list loaded while one was made
+	// may miss it and is not used
+	revoked int
+
+	now func() time.Time
+}
+
+// NewRevoker returns Revoker with revocation store for config, sessions
+// of provider are listed and deleted when they are kept in SessionStore
+func NewRevoker(c *SessionConfig, sp samlsp.SessionProvider) (*Revoker, error) {
+	store, err := NewRevocationStore(c)
+	if err != nil {
+		return nil, err
+	}
+	r := &Revoker{store: store, now: time.Now}
+	switch p := sp.(type) {
+	case StoreSessionProvider:
+		r.sessions = p.Store
+		r.maxAge = p.MaxAge
+	case CookieSessionProvider:
+		r.maxAge = p.MaxAge
+	case samlsp.CookieSessionProvider:
+		r.maxAge = p.MaxAge
+	}
+	if r.maxAge == 0 {
+		r.maxAge = defaultSessionMaxAge
+	}
+	return r, nil
+}
+
+// sessionInfo returns NameID and issue time of session
+func sessionInfo(session samlsp.Session) (string, time.Time, bool) {
+	switch s := session.(type) {
+	case CookieSession:
+		return s.Subject, time.Unix(s.IssuedAt, 0), true
+	case samlsp.JWTSessionClaims:
+		return s.Subject, time.Unix(s.IssuedAt, 0), true
+	case *ServerSession:
+		return s.NameID, s.CreatedAt, true
+	}
+	return "", time.Time{}, false
+}
+
+// issuePrecision returns precision of issue time returned by sessionInfo,
+// cookies keep it in whole seconds
+func issuePrecision(session samlsp.Session) time.Duration {
+	if _, ok := session.(*ServerSession); ok {
+		return 0
+	}
+	return time.Second
+}
+
+// Revoked reports whether session matches revocation list
+func (r *Revoker) Revoked(ctx context.Context, session samlsp.Session) (bool, error) {
+	nameID, issued, ok := sessionInfo(session)
+	if !ok {
+		return false, nil
+	}
+
+	r.mu.Lock()
+	list, revoked, now := r.list, r.revoked, r.now()
+	refresh := now.Sub(r.loaded) >= revocationRefresh
+	r.mu.Unlock()
+
+	if refresh {
+		loaded, err := r.store.Revocations(ctx)
+		if err != nil {
+			return false, err
+		}
+		r.mu.Lock()
+		if r.revoked == revoked {
+			r.list, r.loaded = loaded, now
+			list = loaded
+		} else {
+			list = r.list
+		}
+		r.mu.Unlock()
+	}
+	for _, rev := range list {
+		if rev.matches(nameID, issued, issuePrecision(session)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Revoke invalidates sessions of user with nameID, or of everyone when
+// nameID is empty, issued before given time; matching server side
+// sessions are deleted
+func (r *Revoker) Revoke(ctx context.Context, nameID string, before time.Time) (Revocation, error) {
+	rev := Revocation{NameID: nameID, Before: before, Expires: before.Add(r.maxAge)}
+	if err := r.store.Revoke(ctx, rev); err != nil {
+		return rev, err
+	}
+	r.mu.Lock()
+	r.list = append(r.list, rev)
+	r.revoked++
+	r.mu.Unlock()
+
+	if r.sessions == nil {
+		return rev, nil
+	}
+	sessions, err := r.sessions.List(ctx)
+	if err != nil {
+		return rev, err
+	}
+	for _, s := range sessions {
+		if rev.matches(s.NameID, s.CreatedAt, 0) {
+			if err := r.sessions.Delete(ctx, s.ID); err != nil {
+				return rev, err
+			}
+		}
+	}
+	return rev, nil
+}
+
+// Logout deletes server side sessions of user with nameID and
+// sessionIndex, all sessions of user when sessionIndex is empty
+func (r *Revoker) Logout(ctx context.Context, nameID, sessionIndex string) error {
+	if r.sessions == nil {
+		return errNoSessionStore
+	}
+	sessions, err := r.sessions.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, s := range sessions {
+		if s.NameID != nameID {
+			continue
+		}
+		if sessionIndex != "" && !contains(s.Attributes[sessionIndexAttribute], sessionIndex) {
+			continue
+		}
+		if err := r.sessions.Delete(ctx, s.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RevokeSession deletes server side session with id
+func (r *Revoker) RevokeSession(ctx context.Context, id string) error {
+	if r.sessions == nil {
+		return errNoSessionStore
+	}
+	if _, err := r.sessions.Get(ctx, id); err != nil {
+		return err
+	}
+	return r.sessions.Delete(ctx, id)
+}
+
+// Sessions returns server side sessions
+func (r *Revoker) Sessions(ctx context.Context) ([]*ServerSession, error) {
+	if r.sessions == nil {
+		return nil, errNoSessionStore
+	}
+	return r.sessions.List(ctx)
+}
+
+// Revocations returns revocations that have not expired
+func (r *Revoker) Revocations(ctx context.Context) ([]Revocation, error) {
+	return r.store.Revocations(ctx)
+}
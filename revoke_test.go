@@ -0,0 +1,166 @@
+package authorizer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/crewjam/saml/samlsp"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func jwtSession(nameID string, issued time.Time) samlsp.JWTSessionClaims {
+	return samlsp.JWTSessionClaims{
+		StandardClaims: jwt.StandardClaims{Subject: nameID, IssuedAt: issued.Unix()},
+		SAMLSession:    true,
+	}
+}
+
+func TestRevokerCookieSessions(t *testing.T) {
+	ctx := context.Background()
+	r, err := NewRevoker(nil, samlsp.CookieSessionProvider{MaxAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Truncate(time.Second)
+
+	alice := jwtSession("alice", now.Add(-time.Minute))
+	bob := jwtSession("bob", now.Add(-time.Minute))
+	if _, err := r.Revoke(ctx, "alice", now); err != nil {
+		t.Fatalf("Revoke() error = %v", err)
+	}
+	// carol signs in again within the same second as revocation
+	if _, err := r.Revoke(ctx, "carol", now.Add(500*time.Millisecond)); err != nil {
+		t.Fatalf("Revoke() error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		session samlsp.Session
+		want    bool
+	}{
+		{"RevokedUser", alice, true},
+		{"OtherUser", bob, false},
+		{"NewSession", jwtSession("alice", now.Add(time.Second)), false},
+		{"NewSessionSameSecond", jwtSession("carol", now.Add(700*time.Millisecond)), false},
+		{"OldSessionSameSecond", jwtSession("carol", now.Add(-time.Second)), true},
+		{"UnknownSession", struct{}{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := r.Revoked(ctx, tt.session)
+			if err != nil || got != tt.want {
+				t.Errorf("Revoked() = %t, %v, want %t", got, err, tt.want)
+			}
+		})
+	}
+
+	if _, err := r.Revoke(ctx, "", now); err != nil {
+		t.Fatalf("Revoke() everyone error = %v", err)
+	}
+	if got, _ := r.Revoked(ctx, bob); !got {
+		t.Errorf("Revoked() = false after revoking everyone")
+	}
+
+	if _, err := r.Sessions(ctx); err != errNoSessionStore {
+		t.Errorf("Sessions() error = %v, want errNoSessionStore", err)
+	}
+}
+
+func TestRevokerSharedStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	now := time.Now()
+	clock := func() time.Time { return now }
+	replica1 := &Revoker{store: store, maxAge: time.Hour, now: clock}
+	replica2 := &Revoker{store: store, maxAge: time.Hour, now: clock}
+
+	alice := jwtSession("alice", now.Add(-time.Minute))
+	if got, _ := replica2.Revoked(ctx, alice); got {
+		t.Fatal("Revoked() = true before revocation")
+	}
+	if _, err := replica1.Revoke(ctx, "alice", now); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, _ := replica2.Revoked(ctx, alice); got {
+		t.Error("Revoked() = true before revocation list refresh")
+	}
+	replica2.now = func() time.Time { return now.Add(revocationRefresh) }
+	if got, _ := replica2.Revoked(ctx, alice); !got {
+		t.Error("Revoked() = false after revocation list refresh")
+	}
+}
+
+// slowRevocations blocks listing of revocations until release is closed
+type slowRevocations struct {
+	RevocationStore
+	listing chan struct{}
+	release chan struct{}
+}
+
+func (s slowRevocations) Revocations(ctx context.Context) ([]Revocation, error) {
+	list, err := s.RevocationStore.Revocations(ctx)
+	select {
+	case <-s.listing:
+	default:
+		close(s.listing)
+	}
+	<-s.release
+	return list, err
+}
+
+func TestRevokerSlowStore(t *testing.T) {
+	ctx := context.Background()
+	store := slowRevocations{NewMemoryStore(), make(chan struct{}), make(chan struct{})}
+	now := time.Now()
+	r := &Revoker{store: store, maxAge: time.Hour, now: func() time.Time { return now }}
+
+	alice := jwtSession("alice", now.Add(-time.Minute))
+	done := make(chan bool)
+	go func() {
+		got, _ := r.Revoked(ctx, alice)
+		done <- got
+	}()
+	<-store.listing
+
+	// lock is not held while list is loaded, revocation made meanwhile is
+	// not replaced by list loaded before it
+	if _, err := r.Revoke(ctx, "alice", now); err != nil {
+		t.Fatal(err)
+	}
+	close(store.release)
+	<-done
+	if got, _ := r.Revoked(ctx, alice); !got {
+		t.Error("Revoked() = false, revocation lost by list loaded concurrently")
+	}
+}
+
+func TestRevokerServerSessions(t *testing.T) {
+	ctx := context.Background()
+	p := StoreSessionProvider{Store: NewMemoryStore(), Name: "token"}
+	r, err := NewRevoker(&SessionConfig{Store: "memory"}, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionCookie(t, p)
+	sessionCookie(t, p)
+
+	sessions, err := r.Sessions(ctx)
+	if err != nil || len(sessions) != 2 {
+		t.Fatalf("Sessions() = %v, %v, want 2 sessions", sessions, err)
+	}
+	if err := r.RevokeSession(ctx, sessions[0].ID); err != nil {
+		t.Errorf("RevokeSession() error = %v", err)
+	}
+	if err := r.RevokeSession(ctx, sessions[0].ID); err != ErrSessionNotFound {
+		t.Errorf("RevokeSession() twice error = %v, want ErrSessionNotFound", err)
+	}
+
+	if _, err := r.Revoke(ctx, "alice@example.com", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if sessions, _ := r.Sessions(ctx); len(sessions) != 0 {
+		t.Errorf("sessions of revoked user left in store: %v", sessions)
+	}
+}
@@ -0,0 +1,447 @@
+package authorizer
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlsp"
+)
+
+// SessionConfig selects where sessions are kept. Default cookie store
+// keeps signed JWT with all attributes in cookie, other stores keep only
+// opaque session ID in cookie.
+type SessionConfig struct {
+	// Store is cookie, memory, file or redis
+	Store string `yaml:"store"`
+	// Revocations is memory, file or redis store of revoked sessions,
+	// default is session store or memory for cookie store
+	Revocations string `yaml:"revocations"`
+	// Dir of file store, shared by replicas on common volume
+	Dir string `yaml:"dir"`
+	// Redis store connection
+	Redis RedisConfig `yaml:"redis"`
+	// MaxLifetime of session since sign in, default 1h; IdP
+	// SessionNotOnOrAfter ends session earlier
+	MaxLifetime time.Duration `yaml:"maxlifetime"`
+	// IdleTimeout ends session when there were no /saml/auth requests for
+	// that long, every request renews it; zero disables
+	IdleTimeout time.Duration `yaml:"idletimeout"`
+}
+
+// defaultSessionMaxAge matches samlsp default
+const defaultSessionMaxAge = time.Hour
+
+func (c *SessionConfig) validate() []string {
+	var errs []string
+	backends := map[string]bool{}
+	switch c.Store {
+	case "", "cookie":
+	case "memory", "file", "redis":
+		backends[c.Store] = true
+	default:
+		errs = append(errs, fmt.Sprintf("store: %q must be cookie, memory, file or redis", c.Store))
+	}
+	switch c.Revocations {
+	case "":
+	case "memory", "file", "redis":
+		backends[c.Revocations] = true
+	default:
+		errs = append(errs, fmt.Sprintf("revocations: %q must be memory, file or redis", c.Revocations))
+	}
+	if backends["file"] && c.Dir == "" {
+		errs = append(errs, "dir: is required for file store")
+	}
+	if backends["redis"] {
+		for _, err := range c.Redis.validate() {
+			errs = append(errs, "redis."+err)
+		}
+	}
+	if c.MaxLifetime < 0 {
+		errs = append(errs, "maxlifetime: must not be negative")
+	}
+	if c.IdleTimeout < 0 {
+		errs = append(errs, "idletimeout: must not be negative")
+	} else if c.IdleTimeout > c.lifetime().maxLifetime {
+		errs = append(errs, "idletimeout: must not exceed maxlifetime")
+	}
+	return errs
+}
+
+// sessionLifetime limits how long sessions last
+type sessionLifetime struct {
+	maxLifetime time.Duration
+	idleTimeout time.Duration
+}
+
+func (c *SessionConfig) lifetime() sessionLifetime {
+	l := sessionLifetime{maxLifetime: defaultSessionMaxAge}
+	if c != nil {
+		if c.MaxLifetime > 0 {
+			l.maxLifetime = c.MaxLifetime
+		}
+		l.idleTimeout = c.IdleTimeout
+	}
+	return l
+}
+
+// deadline returns time session started at now ends regardless of
+// activity, the earliest SessionNotOnOrAfter of assertion is honored
+func (l sessionLifetime) deadline(assertion *saml.Assertion, now time.Time) time.Time {
+	deadline := now.Add(l.maxLifetime)
+	for _, statement := range assertion.AuthnStatements {
+		if t := statement.SessionNotOnOrAfter; t != nil && t.Before(deadline) {
+			deadline = *t
+		}
+	}
+	return deadline
+}
+
+// expires returns expiry of session active at now
+func (l sessionLifetime) expires(now, deadline time.Time) time.Time {
+	if l.idleTimeout > 0 && now.Add(l.idleTimeout).Before(deadline) {
+		return now.Add(l.idleTimeout)
+	}
+	return deadline
+}
+
+// renew returns new expiry of session active at now, false when renewal
+// is not needed because session was renewed recently
+func (l sessionLifetime) renew(expires, deadline, now time.Time) (time.Time, bool) {
+	if l.idleTimeout <= 0 || deadline.IsZero() {
+		return expires, false
+	}
+	interval := renewInterval
+	if interval > l.idleTimeout/2 {
+		interval = l.idleTimeout / 2
+	}
+	// session was created or renewed at expires - idleTimeout
+	if now.Sub(expires.Add(-l.idleTimeout)) < interval {
+		return expires, false
+	}
+	next := l.expires(now, deadline)
+	return next, next.After(expires)
+}
+
+// renewInterval limits how often session is renewed
+const renewInterval = time.Minute
+
+// sessionRenewer is implemented by session providers supporting idle
+// timeout
+type sessionRenewer interface {
+	// RenewSession extends session active now, session cookie may be
+	// updated in response
+	RenewSession(w http.ResponseWriter, r *http.Request, session samlsp.Session) error
+}
+
+// revocations returns kind of revocation store
+func (c *SessionConfig) revocations() string {
+	switch {
+	case c == nil:
+		return "memory"
+	case c.Revocations != "":
+		return c.Revocations
+	case c.Store == "" || c.Store == "cookie":
+		return "memory"
+	}
+	return c.Store
+}
+
+// ErrSessionNotFound is returned by SessionStore for unknown or expired
+// sessions
+var ErrSessionNotFound = errors.New("session not found")
+
+// SessionStore keeps server side sessions, implementations must be safe
+// for concurrent use
+type SessionStore interface {
+	// Put stores session until its expiry time
+	Put(ctx context.Context, s *ServerSession) error
+	// Renew replaces session only when it is still stored, returns
+	// ErrSessionNotFound when it was deleted meanwhile
+	Renew(ctx context.Context, s *ServerSession) error
+	// Get returns session with id or ErrSessionNotFound
+	Get(ctx context.Context, id string) (*ServerSession, error)
+	// Delete removes session with id, unknown id is not an error
+	Delete(ctx context.Context, id string) error
+	// List returns all sessions that have not expired
+	List(ctx context.Context) ([]*ServerSession, error)
+}
+
+// RevocationStore keeps revocation list shared by replicas
+type RevocationStore interface {
+	// Revoke adds revocation kept until it expires
+	Revoke(ctx context.Context, r Revocation) error
+	// Revocations returns revocations that have not expired
+	Revocations(ctx context.Context) ([]Revocation, error)
+}
+
+// backend is implemented by all stores
+type backend interface {
+	SessionStore
+	RevocationStore
+}
+
+func newBackend(kind string, c *SessionConfig) (backend, error) {
+	switch kind {
+	case "memory":
+		return NewMemoryStore(), nil
+	case "file":
+		return NewFileStore(c.Dir)
+	case "redis":
+		return NewRedisStore(c.Redis), nil
+	}
+	return nil, fmt.Errorf("unknown store %q", kind)
+}
+
+// NewSessionStore returns store for config, nil for cookie store
+func NewSessionStore(c *SessionConfig) (SessionStore, error) {
+	if c == nil || c.Store == "" || c.Store == "cookie" {
+		return nil, nil
+	}
+	if errs := c.validate(); len(errs) > 0 {
+		return nil, errors.New(errs[0])
+	}
+	return newBackend(c.Store, c)
+}
+
+// NewRevocationStore returns store of revocation list for config
+func NewRevocationStore(c *SessionConfig) (RevocationStore, error) {
+	if c != nil {
+		if errs := c.validate(); len(errs) > 0 {
+			return nil, errors.New(errs[0])
+		}
+	}
+	return newBackend(c.revocations(), c)
+}
+
+// ServerSession is session kept in SessionStore
+type ServerSession struct {
+	// ID is hash of cookie value so stored sessions can not be replayed
+	ID         string            `json:"id"`
+	NameID     string            `json:"nameid"`
+	Attributes samlsp.Attributes `json:"attributes"`
+	CreatedAt  time.Time         `json:"created"`
+	ExpiresAt  time.Time         `json:"expires"`
+	// Deadline is the latest time session can be renewed to
+	Deadline time.Time `json:"deadline"`
+}
+
+// GetAttributes implements samlsp.SessionWithAttributes
+func (s *ServerSession) GetAttributes() samlsp.Attributes {
+	return s.Attributes
+}
+
+func (s *ServerSession) expired(now time.Time) bool {
+	return !now.Before(s.ExpiresAt)
+}
+
+// sessionID returns store key for cookie value
+func sessionID(cookie string) string {
+	sum := sha256.Sum256([]byte(cookie))
+	return hex.EncodeToString(sum[:])
+}
+
+// StoreSessionProvider is samlsp.SessionProvider keeping sessions in
+// SessionStore, cookie carries only random session ID
+type StoreSessionProvider struct {
+	Store    SessionStore
+	Name     string
+	Domain   string
+	HTTPOnly bool
+	Secure   bool
+	SameSite http.SameSite
+	// Path of session cookie, default /
+	Path string
+	// MaxAge is maximum lifetime of session
+	MaxAge      time.Duration
+	IdleTimeout time.Duration
+}
+
+var (
+	_ samlsp.SessionProvider = StoreSessionProvider{}
+	_ sessionRenewer         = StoreSessionProvider{}
+)
+
+// NewSessionProvider returns provider for config, cookie provider with
+// cookie config applied is used for cookie settings and its JWT codec for
+// cookie store
+func NewSessionProvider(c *SessionConfig, cc *CookieConfig, cookie samlsp.CookieSessionProvider) (samlsp.SessionProvider, error) {
+	store, err := NewSessionStore(c)
+	if err != nil {
+		return nil, err
+	}
+	cookie = cc.apply(cookie)
+	l := c.lifetime()
+	if store == nil {
+		p := NewCookieSessionProvider(cookie, l)
+		p.Path = cc.path()
+		return p, nil
+	}
+	return StoreSessionProvider{
+		Store:       store,
+		Name:        cookie.Name,
+		Domain:      cookie.Domain,
+		HTTPOnly:    cookie.HTTPOnly,
+		Secure:      cookie.Secure,
+		SameSite:    cookie.SameSite,
+		Path:        cc.path(),
+		MaxAge:      l.maxLifetime,
+		IdleTimeout: l.idleTimeout,
+	}, nil
+}
+
+func (p StoreSessionProvider) lifetime() sessionLifetime {
+	l := sessionLifetime{maxLifetime: p.MaxAge, idleTimeout: p.IdleTimeout}
+	if l.maxLifetime == 0 {
+		l.maxLifetime = defaultSessionMaxAge
+	}
+	return l
+}
+
+// CreateSession stores session for assertion and sets session cookie
+func (p StoreSessionProvider) CreateSession(w http.ResponseWriter, r *http.Request, assertion *saml.Assertion) error {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return err
+	}
+	value := base64.RawURLEncoding.EncodeToString(buf)
+
+	l := p.lifetime()
+	now := saml.TimeNow()
+	session := newServerSession(assertion)
+	session.ID = sessionID(value)
+	session.CreatedAt = now
+	session.Deadline = l.deadline(assertion, now)
+	session.ExpiresAt = l.expires(now, session.Deadline)
+	if !session.ExpiresAt.After(now) {
+		return errors.New("session: assertion SessionNotOnOrAfter is in the past")
+	}
+	if err := p.Store.Put(r.Context(), session); err != nil {
+		return err
+	}
+
+	// cookie lives until deadline, store enforces idle timeout
+	http.SetCookie(w, &http.Cookie{
+		Name:     p.Name,
+		Domain:   p.domain(),
+		Value:    value,
+		MaxAge:   int(session.Deadline.Sub(now).Seconds()),
+		HttpOnly: p.HTTPOnly,
+		Secure:   p.Secure || r.URL.Scheme == "https",
+		SameSite: p.SameSite,
+		Path:     p.path(),
+	})
+	return nil
+}
+
+// DeleteSession removes stored session and session cookie
+func (p StoreSessionProvider) DeleteSession(w http.ResponseWriter, r *http.Request) error {
+	cookie, err := r.Cookie(p.Name)
+	if err == http.ErrNoCookie {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := p.Store.Delete(r.Context(), sessionID(cookie.Value)); err != nil {
+		return err
+	}
+
+	cookie.Value = ""
+	cookie.Expires = time.Unix(1, 0)
+	cookie.Path = p.path()
+	cookie.Domain = p.domain()
+	http.SetCookie(w, cookie)
+	return nil
+}
+
+// GetSession returns stored session for session cookie or
+// samlsp.ErrNoSession
+func (p StoreSessionProvider) GetSession(r *http.Request) (samlsp.Session, error) {
+	cookie, err := r.Cookie(p.Name)
+	if err == http.ErrNoCookie {
+		return nil, samlsp.ErrNoSession
+	} else if err != nil {
+		return nil, err
+	}
+
+	session, err := p.Store.Get(r.Context(), sessionID(cookie.Value))
+	if errors.Is(err, ErrSessionNotFound) {
+		return nil, samlsp.ErrNoSession
+	}
+	if err != nil {
+		return nil, err
+	}
+	if session.expired(saml.TimeNow()) {
+		return nil, samlsp.ErrNoSession
+	}
+	return session, nil
+}
+
+// RenewSession extends stored session by idle timeout, cookie is not
+// changed. Session deleted by signout or revocation since it was read
+// stays deleted.
+func (p StoreSessionProvider) RenewSession(w http.ResponseWriter, r *http.Request, session samlsp.Session) error {
+	s, ok := session.(*ServerSession)
+	if !ok {
+		return nil
+	}
+	expires, ok := p.lifetime().renew(s.ExpiresAt, s.Deadline, saml.TimeNow())
+	if !ok {
+		return nil
+	}
+	renewed := *s
+	renewed.ExpiresAt = expires
+	if err := p.Store.Renew(r.Context(), &renewed); err != nil && !errors.Is(err, ErrSessionNotFound) {
+		return err
+	}
+	return nil
+}
+
+// domain returns cookie domain without port
+func (p StoreSessionProvider) domain() string {
+	if domain, _, err := net.SplitHostPort(p.Domain); err == nil {
+		return domain
+	}
+	return p.Domain
+}
+
+// path returns cookie path, / when not set
+func (p StoreSessionProvider) path() string {
+	if p.Path == "" {
+		return "/"
+	}
+	return p.Path
+}
+
+// newServerSession copies NameID, attributes and session indexes from
+// assertion the same way samlsp.JWTSessionCodec does
+func newServerSession(assertion *saml.Assertion) *ServerSession {
+	s := &ServerSession{Attributes: samlsp.Attributes{}}
+	if sub := assertion.Subject; sub != nil && sub.NameID != nil {
+		s.NameID = sub.NameID.Value
+	}
+	for _, statement := range assertion.AttributeStatements {
+		for _, attr := range statement.Attributes {
+			name := attr.FriendlyName
+			if name == "" {
+				name = attr.Name
+			}
+			for _, value := range attr.Values {
+				s.Attributes[name] = append(s.Attributes[name], value.Value)
+			}
+		}
+	}
+	for _, statement := range assertion.AuthnStatements {
+		s.Attributes["SessionIndex"] = append(s.Attributes["SessionIndex"], statement.SessionIndex)
+	}
+	return s
+}
@@ -0,0 +1,277 @@
+package authorizer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlsp"
+)
+
+func testAssertion() *saml.Assertion {
+	return &saml.Assertion{
+		Subject: &saml.Subject{NameID: &saml.NameID{Value: "alice@example.com"}},
+		AttributeStatements: []saml.AttributeStatement{{
+			Attributes: []saml.Attribute{{
+				FriendlyName: "uid",
+				Name:         "urn:oid:0.9.2342.19200300.100.1.1",
+				Values:       []saml.AttributeValue{{Value: "alice"}},
+			}, {
+				Name:   "groups",
+				Values: []saml.AttributeValue{{Value: "sre"}, {Value: "users"}},
+			}},
+		}},
+		AuthnStatements: []saml.AuthnStatement{{SessionIndex: "_idx1"}},
+	}
+}
+
+// sessionCookie creates session and returns request carrying its cookie
+func sessionCookie(t *testing.T, p samlsp.SessionProvider) *http.Request {
+	t.Helper()
+	res := httptest.NewRecorder()
+	if err := p.CreateSession(res, httptest.NewRequest(http.MethodPost, "https://sso.example.com/saml/acs", nil), testAssertion()); err != nil {
+		t.Fatalf("CreateSession() error = %v", err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "https://sso.example.com/saml/auth", nil)
+	for _, c := range res.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	return req
+}
+
+func TestStoreSessionProvider(t *testing.T) {
+	store := NewMemoryStore()
+	p := StoreSessionProvider{Store: store, Name: "token", Domain: "sso.example.com:443", HTTPOnly: true}
+
+	res := httptest.NewRecorder()
+	err := p.CreateSession(res, httptest.NewRequest(http.MethodPost, "https://sso.example.com/saml/acs", nil), testAssertion())
+	if err != nil {
+		t.Fatalf("CreateSession() error = %v", err)
+	}
+	cookies := res.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("got %d cookies, want 1", len(cookies))
+	}
+	c := cookies[0]
+	if c.Name != "token" || c.Domain != "sso.example.com" || !c.HttpOnly || !c.Secure || c.MaxAge != 3600 {
+		t.Errorf("unexpected cookie %v", c)
+	}
+	if len(c.Value) != 43 {
+		t.Errorf("cookie value %q is not opaque session ID", c.Value)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/saml/auth", nil)
+	req.AddCookie(c)
+	session, err := p.GetSession(req)
+	if err != nil {
+		t.Fatalf("GetSession() error = %v", err)
+	}
+	s := session.(*ServerSession)
+	if s.ID == c.Value || s.ID != sessionID(c.Value) {
+		t.Errorf("session stored under %s", s.ID)
+	}
+	if s.NameID != "alice@example.com" {
+		t.Errorf("NameID = %s", s.NameID)
+	}
+	want := samlsp.Attributes{"uid": {"alice"}, "groups": {"sre", "users"}, "SessionIndex": {"_idx1"}}
+	if !reflect.DeepEqual(s.GetAttributes(), want) {
+		t.Errorf("GetAttributes() = %v, want %v", s.GetAttributes(), want)
+	}
+
+	res = httptest.NewRecorder()
+	if err := p.DeleteSession(res, req); err != nil {
+		t.Fatalf("DeleteSession() error = %v", err)
+	}
+	if got := res.Result().Cookies(); len(got) != 1 || got[0].Value != "" {
+		t.Errorf("session cookie not removed: %v", got)
+	}
+	if _, err := p.GetSession(req); err != samlsp.ErrNoSession {
+		t.Errorf("GetSession() after delete error = %v, want ErrNoSession", err)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/saml/auth", nil)
+	req.AddCookie(&http.Cookie{Name: "token", Value: "forged"})
+	if _, err := p.GetSession(req); err != samlsp.ErrNoSession {
+		t.Errorf("GetSession() with unknown ID error = %v, want ErrNoSession", err)
+	}
+}
+
+func TestStoreSessionProviderExpired(t *testing.T) {
+	store := NewMemoryStore()
+	p := StoreSessionProvider{Store: store, Name: "token", MaxAge: time.Minute}
+	req := sessionCookie(t, p)
+
+	store.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	if _, err := p.GetSession(req); err != samlsp.ErrNoSession {
+		t.Errorf("GetSession() error = %v, want ErrNoSession", err)
+	}
+}
+
+func TestNewSessionProvider(t *testing.T) {
+	cookie := samlsp.CookieSessionProvider{Name: "token", Domain: "sso.example.com", MaxAge: time.Hour}
+
+	for _, c := range []*SessionConfig{nil, {}, {Store: "cookie"}} {
+		p, err := NewSessionProvider(c, nil, cookie)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := p.(CookieSessionProvider); !ok {
+			t.Errorf("NewSessionProvider(%v) = %T, want cookie provider", c, p)
+		}
+	}
+
+	p, err := NewSessionProvider(&SessionConfig{Store: "file", Dir: t.TempDir()}, nil, cookie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp, ok := p.(StoreSessionProvider)
+	if !ok {
+		t.Fatalf("NewSessionProvider() = %T, want StoreSessionProvider", p)
+	}
+	if _, ok := sp.Store.(*FileStore); !ok || sp.Name != "token" || sp.MaxAge != time.Hour {
+		t.Errorf("unexpected provider %+v", sp)
+	}
+}
+
+func TestSessionConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		config SessionConfig
+		want   []string
+	}{{
+		name:   "Memory",
+		config: SessionConfig{Store: "memory"},
+	}, {
+		name:   "Unknown",
+		config: SessionConfig{Store: "bolt"},
+		want:   []string{`store: "bolt" must be cookie, memory, file or redis`},
+	}, {
+		name:   "File",
+		config: SessionConfig{Store: "file"},
+		want:   []string{"dir: is required for file store"},
+	}, {
+		name:   "Lifetime",
+		config: SessionConfig{MaxLifetime: 8 * time.Hour, IdleTimeout: 30 * time.Minute},
+	}, {
+		name:   "IdleTimeout",
+		config: SessionConfig{IdleTimeout: 2 * time.Hour},
+		want:   []string{"idletimeout: must not exceed maxlifetime"},
+	}, {
+		name:   "Redis",
+		config: SessionConfig{Store: "redis", Redis: RedisConfig{Addr: "redis", DB: -1}},
+		want:   []string{"redis.addr: address redis: missing port in address", "redis.db: must not be negative"},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.config.validate(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("validate() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSessionLifetime(t *testing.T) {
+	now := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	notOnOrAfter := now.Add(30 * time.Minute)
+	l := sessionLifetime{maxLifetime: time.Hour, idleTimeout: 10 * time.Minute}
+
+	if got, want := l.deadline(testAssertion(), now), now.Add(time.Hour); !got.Equal(want) {
+		t.Errorf("deadline() = %v, want %v", got, want)
+	}
+	a := testAssertion()
+	a.AuthnStatements[0].SessionNotOnOrAfter = &notOnOrAfter
+	deadline := l.deadline(a, now)
+	if !deadline.Equal(notOnOrAfter) {
+		t.Errorf("deadline() = %v, want SessionNotOnOrAfter %v", deadline, notOnOrAfter)
+	}
+
+	tests := []struct {
+		name    string
+		expires time.Time
+		now     time.Time
+		want    time.Time
+		renewed bool
+	}{
+		{"JustRenewed", now.Add(10 * time.Minute), now.Add(30 * time.Second), now.Add(10 * time.Minute), false},
+		{"Renewed", now.Add(10 * time.Minute), now.Add(5 * time.Minute), now.Add(15 * time.Minute), true},
+		{"CappedByDeadline", now.Add(25 * time.Minute), now.Add(24 * time.Minute), deadline, true},
+		{"AtDeadline", deadline, now.Add(29 * time.Minute), deadline, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, renewed := l.renew(tt.expires, deadline, tt.now)
+			if !got.Equal(tt.want) || renewed != tt.renewed {
+				t.Errorf("renew() = %v, %t, want %v, %t", got, renewed, tt.want, tt.renewed)
+			}
+		})
+	}
+
+	if _, renewed := (sessionLifetime{maxLifetime: time.Hour}).renew(now, deadline, now); renewed {
+		t.Error("renew() without idle timeout renewed session")
+	}
+}
+
+func TestStoreSessionProviderIdleTimeout(t *testing.T) {
+	store := NewMemoryStore()
+	p := StoreSessionProvider{Store: store, Name: "token", MaxAge: time.Hour, IdleTimeout: 10 * time.Minute}
+	req := sessionCookie(t, p)
+
+	session, err := p.GetSession(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := session.(*ServerSession)
+	if got := s.ExpiresAt.Sub(s.CreatedAt); got != 10*time.Minute {
+		t.Errorf("session expires after %s, want idle timeout", got)
+	}
+	if got := s.Deadline.Sub(s.CreatedAt); got != time.Hour {
+		t.Errorf("session deadline after %s, want max lifetime", got)
+	}
+
+	defer func() { saml.TimeNow = time.Now }()
+	saml.TimeNow = func() time.Time { return s.CreatedAt.Add(5 * time.Minute) }
+	if err := p.RenewSession(httptest.NewRecorder(), req, session); err != nil {
+		t.Fatal(err)
+	}
+	store.now = func() time.Time { return s.CreatedAt.Add(12 * time.Minute) }
+	renewed, err := store.Get(req.Context(), s.ID)
+	if err != nil {
+		t.Fatalf("renewed session expired: %v", err)
+	}
+	if got := renewed.ExpiresAt.Sub(s.CreatedAt); got != 15*time.Minute {
+		t.Errorf("renewed session expires after %s, want 15m", got)
+	}
+
+	store.now = func() time.Time { return s.CreatedAt.Add(16 * time.Minute) }
+	if _, err := store.Get(req.Context(), s.ID); err != ErrSessionNotFound {
+		t.Errorf("idle session error = %v, want ErrSessionNotFound", err)
+	}
+}
+
+func TestStoreSessionProviderRenewDeleted(t *testing.T) {
+	store := NewMemoryStore()
+	p := StoreSessionProvider{Store: store, Name: "token", MaxAge: time.Hour, IdleTimeout: 10 * time.Minute}
+	req := sessionCookie(t, p)
+
+	session, err := p.GetSession(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := session.(*ServerSession)
+
+	// signout or revocation deletes session between read and renewal
+	if err := store.Delete(req.Context(), s.ID); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { saml.TimeNow = time.Now }()
+	saml.TimeNow = func() time.Time { return s.CreatedAt.Add(5 * time.Minute) }
+	if err := p.RenewSession(httptest.NewRecorder(), req, session); err != nil {
+		t.Fatalf("RenewSession() error = %v", err)
+	}
+	if _, err := store.Get(req.Context(), s.ID); err != ErrSessionNotFound {
+		t.Errorf("Get() after renewal error = %v, want ErrSessionNotFound", err)
+	}
+}
@@ -0,0 +1,339 @@
+package authorizer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often stores remove expired sessions
+const sweepInterval = time.Minute
+
+// MemoryStore keeps sessions in process memory, sessions are lost on
+// restart and not shared by replicas
+type MemoryStore struct {
+	mu          sync.Mutex
+	sessions    map[string]ServerSession
+	revocations []Revocation
+	lastSweep   time.Time
+
+	now func() time.Time
+}
+
+// NewMemoryStore returns empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{sessions: map[string]ServerSession{}, now: time.Now}
+}
+
+// Put implements SessionStore
+func (m *MemoryStore) Put(ctx context.Context, s *ServerSession) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	if now.Sub(m.lastSweep) >= sweepInterval {
+		for id, s := range m.sessions {
+			if s.expired(now) {
+				delete(m.sessions, id)
+			}
+		}
+		m.lastSweep = now
+	}
+	m.sessions[s.ID] = *s
+	return nil
+}
+
+// Renew implements SessionStore
+func (m *MemoryStore) Renew(ctx context.Context, s *ServerSession) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.sessions[s.ID]; !ok {
+		return ErrSessionNotFound
+	}
+	m.sessions[s.ID] = *s
+	return nil
+}
+
+// Get implements SessionStore
+func (m *MemoryStore) Get(ctx context.Context, id string) (*ServerSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.sessions[id]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	if s.expired(m.now()) {
+		delete(m.sessions, id)
+		return nil, ErrSessionNotFound
+	}
+	return &s, nil
+}
+
+// Delete implements SessionStore
+func (m *MemoryStore) Delete(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.sessions, id)
+	return nil
+}
+
+// List implements SessionStore
+func (m *MemoryStore) List(ctx context.Context) ([]*ServerSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	var sessions []*ServerSession
+	for _, s := range m.sessions {
+		if !s.expired(now) {
+			s := s
+			sessions = append(sessions, &s)
+		}
+	}
+	return sessions, nil
+}
+
+// Revoke implements RevocationStore
+func (m *MemoryStore) Revoke(ctx context.Context, r Revocation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.revocations = append(activeRevocations(m.revocations, m.now()), r)
+	return nil
+}
+
+// Revocations implements RevocationStore
+func (m *MemoryStore) Revocations(ctx context.Context) ([]Revocation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.revocations = activeRevocations(m.revocations, m.now())
+	return append([]Revocation(nil), m.revocations...), nil
+}
+
+// FileStore keeps each session in JSON file named after session ID and
+// revocation list in revocations file, directory can be shared by
+// replicas
+type FileStore struct {
+	dir string
+
+	// mu serializes renewals and deletes of sessions, revocation list
+	// updates and sweeps
+	mu        sync.Mutex
+	lastSweep time.Time
+
+	now func() time.Time
+}
+
+var fileSessionID = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// revocationsFile does not match session file pattern
+const revocationsFile = "revocations"
+
+// NewFileStore returns FileStore in dir, dir is created when missing
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir, now: time.Now}, nil
+}
+
+func (f *FileStore) path(id string) (string, error) {
+	if !fileSessionID.MatchString(id) {
+		return "", fmt.Errorf("invalid session id %q", id)
+	}
+	return filepath.Join(f.dir, id+".json"), nil
+}
+
+// Put implements SessionStore, file is replaced atomically
+func (f *FileStore) Put(ctx context.Context, s *ServerSession) error {
+	name, err := f.path(s.ID)
+	if err != nil {
+		return err
+	}
+	f.sweep()
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return f.write(name, data)
+}
+
+// Renew implements SessionStore, renewal racing with delete by other
+// replica sharing directory can still restore the session
+func (f *FileStore) Renew(ctx context.Context, s *ServerSession) error {
+	name, err := f.path(s.ID)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := os.Stat(name); errors.Is(err, fs.ErrNotExist) {
+		return ErrSessionNotFound
+	} else if err != nil {
+		return err
+	}
+	return f.write(name, data)
+}
+
+// write replaces file atomically so readers never see partial content
+func (f *FileStore) write(name string, data []byte) error {
+	tmp, err := os.CreateTemp(f.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+// Get implements SessionStore
+func (f *FileStore) Get(ctx context.Context, id string) (*ServerSession, error) {
+	name, err := f.path(id)
+	if err != nil {
+		return nil, ErrSessionNotFound
+	}
+	s, err := readSessionFile(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.expired(f.now()) {
+		os.Remove(name)
+		return nil, ErrSessionNotFound
+	}
+	return s, nil
+}
+
+// Delete implements SessionStore
+func (f *FileStore) Delete(ctx context.Context, id string) error {
+	name, err := f.path(id)
+	if err != nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := os.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// List implements SessionStore
+func (f *FileStore) List(ctx context.Context) ([]*ServerSession, error) {
+	names, err := filepath.Glob(filepath.Join(f.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	now := f.now()
+	var sessions []*ServerSession
+	for _, name := range names {
+		s, err := readSessionFile(name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !s.expired(now) {
+			sessions = append(sessions, s)
+		}
+	}
+	return sessions, nil
+}
+
+// Revoke implements RevocationStore, concurrent revocations by different
+// replicas may overwrite each other
+func (f *FileStore) Revoke(ctx context.Context, r Revocation) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	list, err := f.readRevocations()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(append(activeRevocations(list, f.now()), r))
+	if err != nil {
+		return err
+	}
+	return f.write(filepath.Join(f.dir, revocationsFile), data)
+}
+
+// Revocations implements RevocationStore
+func (f *FileStore) Revocations(ctx context.Context) ([]Revocation, error) {
+	list, err := f.readRevocations()
+	if err != nil {
+		return nil, err
+	}
+	return activeRevocations(list, f.now()), nil
+}
+
+func (f *FileStore) readRevocations() ([]Revocation, error) {
+	data, err := os.ReadFile(filepath.Join(f.dir, revocationsFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []Revocation
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("%s: %w", revocationsFile, err)
+	}
+	return list, nil
+}
+
+// sweep removes expired session files at most once per sweepInterval
+func (f *FileStore) sweep() {
+	f.mu.Lock()
+	now := f.now()
+	if now.Sub(f.lastSweep) < sweepInterval {
+		f.mu.Unlock()
+		return
+	}
+	f.lastSweep = now
+	f.mu.Unlock()
+
+	names, _ := filepath.Glob(filepath.Join(f.dir, "*.json"))
+	for _, name := range names {
+		if s, err := readSessionFile(name); err == nil && s.expired(now) {
+			os.Remove(name)
+		}
+	}
+}
+
+func readSessionFile(name string) (*ServerSession, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var s ServerSession
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return &s, nil
+}
@@ -0,0 +1,165 @@
+package authorizer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/crewjam/saml/samlsp"
+)
+
+// testSessionStore checks behaviour common to all stores
+func testSessionStore(t *testing.T, store SessionStore) {
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Second)
+	s := &ServerSession{
+		ID:         sessionID("alice"),
+		NameID:     "alice@example.com",
+		Attributes: samlsp.Attributes{"uid": {"alice"}},
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(time.Hour),
+	}
+	expired := &ServerSession{
+		ID:        sessionID("bob"),
+		CreatedAt: now.Add(-2 * time.Hour),
+		ExpiresAt: now.Add(-time.Hour),
+	}
+
+	if err := store.Put(ctx, s); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	if err := store.Put(ctx, expired); err != nil {
+		t.Fatalf("Put() expired error = %v", err)
+	}
+
+	got, err := store.Get(ctx, s.ID)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if !reflect.DeepEqual(got.Attributes, s.Attributes) || got.NameID != s.NameID || !got.ExpiresAt.Equal(s.ExpiresAt) {
+		t.Errorf("Get() = %+v, want %+v", got, s)
+	}
+	if _, err := store.Get(ctx, expired.ID); err != ErrSessionNotFound {
+		t.Errorf("Get() expired error = %v, want ErrSessionNotFound", err)
+	}
+	if _, err := store.Get(ctx, sessionID("unknown")); err != ErrSessionNotFound {
+		t.Errorf("Get() unknown error = %v, want ErrSessionNotFound", err)
+	}
+	list, err := store.List(ctx)
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(list) != 1 || list[0].ID != s.ID {
+		t.Errorf("List() = %v, want only %s", list, s.ID)
+	}
+
+	renewed := *s
+	renewed.ExpiresAt = now.Add(2 * time.Hour)
+	if err := store.Renew(ctx, &renewed); err != nil {
+		t.Fatalf("Renew() error = %v", err)
+	}
+	if got, err := store.Get(ctx, s.ID); err != nil || !got.ExpiresAt.Equal(renewed.ExpiresAt) {
+		t.Errorf("Get() renewed = %v, %v, want expiry %s", got, err, renewed.ExpiresAt)
+	}
+
+	if err := store.Delete(ctx, s.ID); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, err := store.Get(ctx, s.ID); err != ErrSessionNotFound {
+		t.Errorf("Get() deleted error = %v, want ErrSessionNotFound", err)
+	}
+	// renewal of session read before it was deleted does not restore it
+	if err := store.Renew(ctx, &renewed); err != ErrSessionNotFound {
+		t.Errorf("Renew() deleted error = %v, want ErrSessionNotFound", err)
+	}
+	if _, err := store.Get(ctx, s.ID); err != ErrSessionNotFound {
+		t.Errorf("Get() after renewal of deleted session error = %v, want ErrSessionNotFound", err)
+	}
+	if err := store.Delete(ctx, s.ID); err != nil {
+		t.Errorf("Delete() unknown error = %v", err)
+	}
+}
+
+// testRevocationStore checks behaviour common to all revocation stores
+func testRevocationStore(t *testing.T, store RevocationStore) {
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Second)
+	revocations := []Revocation{
+		{NameID: "alice", Before: now, Expires: now.Add(time.Hour)},
+		{Before: now.Add(-2 * time.Hour), Expires: now.Add(-time.Hour)},
+		{Before: now, Expires: now.Add(time.Hour)},
+	}
+	for _, r := range revocations {
+		if err := store.Revoke(ctx, r); err != nil {
+			t.Fatalf("Revoke() error = %v", err)
+		}
+	}
+
+	got, err := store.Revocations(ctx)
+	if err != nil {
+		t.Fatalf("Revocations() error = %v", err)
+	}
+	// order of revocations does not matter
+	sort.Slice(got, func(i, j int) bool { return got[i].NameID > got[j].NameID })
+	want := []Revocation{revocations[0], revocations[2]}
+	if len(got) != len(want) {
+		t.Fatalf("Revocations() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i].NameID != want[i].NameID || !got[i].Before.Equal(want[i].Before) || !got[i].Expires.Equal(want[i].Expires) {
+			t.Errorf("Revocations()[%d] = %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testSessionStore(t, NewMemoryStore())
+	testRevocationStore(t, NewMemoryStore())
+}
+
+func TestFileStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSessionStore(t, store)
+	testRevocationStore(t, store)
+	if err := os.Remove(filepath.Join(dir, revocationsFile)); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := store.Get(context.Background(), "../../etc/passwd"); err != ErrSessionNotFound {
+		t.Errorf("Get() with path error = %v, want ErrSessionNotFound", err)
+	}
+	if names, _ := filepath.Glob(filepath.Join(dir, "*")); len(names) != 0 {
+		t.Errorf("files left in store: %v", names)
+	}
+}
+
+func TestFileStoreSweep(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for _, id := range []string{"a", "b"} {
+		store.Put(context.Background(), &ServerSession{ID: sessionID(id), ExpiresAt: now.Add(time.Minute)})
+	}
+
+	store.now = func() time.Time { return now.Add(2 * time.Minute) }
+	store.Put(context.Background(), &ServerSession{ID: sessionID("c"), ExpiresAt: now.Add(time.Hour)})
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != sessionID("c")+".json" {
+		t.Errorf("expired sessions not removed: %v", entries)
+	}
+}
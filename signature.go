@@ -0,0 +1,103 @@
+package authorizer
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dzeromsk/ingress-saml-authorizer/headersig"
+)
+
+// SignatureConfig enables HMAC signature of identity headers verified by
+// upstream with headersig package
+type SignatureConfig struct {
+	// Secret shared with upstream, at least 32 bytes
+	Secret string `yaml:"secret"`
+	// SecretFile with shared secret, alternative to Secret
+	SecretFile string `yaml:"secretfile"`
+	// Header carrying signature, default headersig.Header
+	Header string `yaml:"header"`
+	// Headers to sign, default headers set from attributes and by policy
+	// decision point; all of them have to be passed to upstream
+	Headers []string `yaml:"headers"`
+}
+
+const minSecretLength = 32
+
+func (c *SignatureConfig) validate() []string {
+	var errs []string
+	switch {
+	case c.Secret == "" && c.SecretFile == "":
+		errs = append(errs, "secret: secret or secretfile is required")
+	case c.Secret != "" && c.SecretFile != "":
+		errs = append(errs, "secret: only one of secret and secretfile can be set")
+	case c.Secret != "" && len(c.Secret) < minSecretLength:
+		errs = append(errs, fmt.Sprintf("secret: must be at least %d bytes", minSecretLength))
+	}
+	if c.Header != "" && !headerName.MatchString(c.Header) {
+		errs = append(errs, fmt.Sprintf("header: %q is not valid header name", c.Header))
+	}
+	for _, h := range c.Headers {
+		if !headerName.MatchString(h) {
+			errs = append(errs, fmt.Sprintf("headers: %q is not valid header name", h))
+		}
+	}
+	return errs
+}
+
+// HeaderSigner adds signature of identity headers to auth responses
+type HeaderSigner struct {
+	secret  []byte
+	header  string
+	headers []string
+
+	now func() time.Time
+}
+
+// NewHeaderSigner reads secret and returns HeaderSigner for config
+func NewHeaderSigner(c SignatureConfig) (*HeaderSigner, error) {
+	if errs := c.validate(); len(errs) > 0 {
+		return nil, errors.New(strings.Join(errs, "; "))
+	}
+
+	secret := c.Secret
+	if c.SecretFile != "" {
+		data, err := os.ReadFile(c.SecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("secretfile: %w", err)
+		}
+		secret = strings.TrimRight(string(data), "\r\n")
+		if len(secret) < minSecretLength {
+			return nil, fmt.Errorf("secretfile: secret must be at least %d bytes", minSecretLength)
+		}
+	}
+
+	s := &HeaderSigner{
+		secret:  []byte(secret),
+		header:  c.Header,
+		headers: c.Headers,
+		now:     time.Now,
+	}
+	if s.header == "" {
+		s.header = headersig.Header
+	}
+	return s, nil
+}
+
+// Header returns name of signature header
+func (s *HeaderSigner) Header() string {
+	return s.header
+}
+
+// set signs headers of h for host, identity lists headers set for user
+// and is used when signed headers are not configured
+func (s *HeaderSigner) set(h http.Header, host string, identity []string) {
+	names := s.headers
+	if names == nil {
+		names = identity
+	}
+	h.Set(s.header, headersig.Sign(s.secret, host, h, names, s.now()))
+}
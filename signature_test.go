@@ -0,0 +1,146 @@
+package authorizer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dzeromsk/ingress-saml-authorizer/headersig"
+)
+
+const testSecret = "0123456789abcdef0123456789abcdef"
+
+func TestAuthHandlerSignature(t *testing.T) {
+	signer, err := NewHeaderSigner(SignatureConfig{Secret: testSecret})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := fakeAuthService(&validUser{}, nil)
+	s.Reload(&Settings{
+		Headers: mustNewHeaderMap(HeadersConfig{
+			Mapping: map[string]string{"mail": "X-Auth-Request-Email", "name": "X-Auth-Request-User"},
+		}),
+		Signer: signer,
+	})
+
+	for _, url := range []string{
+		"https://grafana.example.com/",
+		"https://Grafana.example.com:8443/",
+	} {
+		t.Run(url, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/saml/auth", nil)
+			req.Header.Set("X-Original-URL", url)
+			res := httptest.NewRecorder()
+			s.Auth(res, req)
+
+			if got, want := res.Code, http.StatusAccepted; got != want {
+				t.Fatalf("got status %d but wanted %d", got, want)
+			}
+
+			// NGINX copies auth response headers to upstream request,
+			// Host keeps port
+			upstream := httptest.NewRequest(http.MethodGet, url, nil)
+			for _, name := range []string{"X-Auth-Request-Email", "X-Auth-Request-User", headersig.Header} {
+				upstream.Header.Set(name, res.Header().Get(name))
+			}
+
+			v := &headersig.Verifier{Secrets: [][]byte{[]byte(testSecret)}}
+			signed, err := v.Verify(upstream)
+			if err != nil {
+				t.Fatalf("Verify() error = %v", err)
+			}
+			if want := []string{"x-auth-request-email", "x-auth-request-user"}; !reflect.DeepEqual(signed, want) {
+				t.Errorf("signed headers = %v, want %v", signed, want)
+			}
+		})
+	}
+}
+
+func TestAuthHandlerSignatureRepeatedHeader(t *testing.T) {
+	signer, err := NewHeaderSigner(SignatureConfig{Secret: testSecret})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := fakeAuthService(&validUser{}, nil)
+	s.Reload(&Settings{
+		Headers: mustNewHeaderMap(HeadersConfig{
+			Mapping:    map[string]string{"name": "X-Auth-Request-Identity", "group": "X-Auth-Request-Identity"},
+			Multivalue: "repeat",
+		}),
+		Signer: signer,
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/saml/auth", nil)
+	req.Header.Set("X-Original-URL", "https://grafana.example.com/")
+	res := httptest.NewRecorder()
+	s.Auth(res, req)
+	if got := len(res.Header().Values("X-Auth-Request-Identity")); got != 2 {
+		t.Fatalf("got %d X-Auth-Request-Identity headers, want 2", got)
+	}
+
+	// NGINX joins repeated auth response headers with ", "
+	upstream := httptest.NewRequest(http.MethodGet, "https://grafana.example.com/", nil)
+	upstream.Header.Set("X-Auth-Request-Identity", strings.Join(res.Header().Values("X-Auth-Request-Identity"), ", "))
+	upstream.Header.Set(headersig.Header, res.Header().Get(headersig.Header))
+
+	v := &headersig.Verifier{Secrets: [][]byte{[]byte(testSecret)}}
+	if _, err := v.Verify(upstream); err != nil {
+		t.Errorf("Verify() error = %v", err)
+	}
+}
+
+func TestNewHeaderSigner(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(name, []byte(testSecret+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := NewHeaderSigner(SignatureConfig{
+		SecretFile: name,
+		Header:     "X-Signature",
+		Headers:    []string{"X-User"},
+	})
+	if err != nil {
+		t.Fatalf("NewHeaderSigner() error = %v", err)
+	}
+	signer.now = func() time.Time { return time.Unix(1700000000, 0) }
+
+	h := http.Header{"X-User": {"alice"}, "X-Other": {"x"}}
+	signer.set(h, "example.com", []string{"X-Other"})
+	want := headersig.Sign([]byte(testSecret), "example.com", h, []string{"X-User"}, time.Unix(1700000000, 0))
+	if got := h.Get("X-Signature"); got != want {
+		t.Errorf("signature = %s, want %s", got, want)
+	}
+
+	tests := []struct {
+		name   string
+		config SignatureConfig
+		want   string
+	}{{
+		name:   "NoSecret",
+		config: SignatureConfig{},
+		want:   "secret: secret or secretfile is required",
+	}, {
+		name:   "ShortSecret",
+		config: SignatureConfig{Secret: "short", Header: "X Sig"},
+		want:   `secret: must be at least 32 bytes; header: "X Sig" is not valid header name`,
+	}, {
+		name:   "MissingFile",
+		config: SignatureConfig{SecretFile: "missing"},
+		want:   "secretfile: open missing: no such file or directory",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewHeaderSigner(tt.config)
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("NewHeaderSigner() error = %v, want %s", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,513 @@
+package authorizer
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	_ "crypto/sha1" // rsa-sha1 redirect signatures
+	"crypto/sha256"
+	_ "crypto/sha512" // rsa-sha512 redirect signatures
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlsp"
+	xrv "github.com/mattermost/xml-roundtrip-validator"
+	dsig "github.com/russellhaering/goxmldsig"
+	"go.uber.org/zap"
+)
+
+// sessionIndexAttribute holds SessionIndex of assertion in cookie and
+// server side sessions
+const sessionIndexAttribute = "SessionIndex"
+
+// maxLogoutMessage limits size of inflated HTTP-Redirect messages
+const maxLogoutMessage = 1 << 20
+
+// Signout handler ends session and signs user out of IdP with single
+// logout. It serves three cases:
+//
+//	GET /saml/signout?rd=URL     user signs out, LogoutRequest is sent to IdP
+//	SAMLResponse (GET or POST)  IdP answers our LogoutRequest
+//	SAMLRequest (GET or POST)   IdP initiated logout, LogoutResponse is sent
+//
+// rd and RelayState must point to url host or hosts covered by session
+// cookie domain; without them plain confirmation is shown.
+func (s *AuthService) Signout(w http.ResponseWriter, r *http.Request) {
+	s.idpMu.RLock()
+	defer s.idpMu.RUnlock()
+
+	if err := r.ParseForm(); err != nil {
+		s.httpError(w, r, http.StatusBadRequest)
+		return
+	}
+	switch {
+	case r.Form.Get("SAMLResponse") != "":
+		s.handleLogoutResponse(w, r)
+	case r.Form.Get("SAMLRequest") != "":
+		s.handleLogoutRequest(w, r)
+	default:
+		s.startLogout(w, r)
+	}
+}
+
+func (s *AuthService) startLogout(w http.ResponseWriter, r *http.Request) {
+	rd, ok := s.signoutRedirect(r.Form.Get("rd"))
+	if !ok {
+		s.httpError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	session, err := s.SP.GetSession(r)
+	if err == samlsp.ErrNoSession {
+		s.signedOut(w, r, rd)
+		return
+	}
+	if err != nil {
+		s.httpError(w, r, http.StatusInternalServerError)
+		return
+	}
+	if err := s.SP.DeleteSession(w, r); err != nil {
+		s.Log.Error("signout", zap.Error(err))
+		s.httpError(w, r, http.StatusInternalServerError)
+		return
+	}
+	nameID, _, _ := sessionInfo(session)
+	s.Log.Info("signed out", zap.String("nameId", nameID))
+
+	sp := &s.sessionMiddleware(session).ServiceProvider
+	if nameID == "" || sp.IDPMetadata == nil {
+		s.signedOut(w, r, rd)
+		return
+	}
+	binding := logoutBinding(sp)
+	if binding == "" {
+		s.signedOut(w, r, rd)
+		return
+	}
+
+	// SessionIndex is added before signing
+	unsigned := *sp
+	unsigned.SignatureMethod = ""
+	req, err := unsigned.MakeLogoutRequest(sp.GetSLOBindingLocation(binding), nameID)
+	if err != nil {
+		s.Log.Error("logout request", zap.Error(err))
+		s.signedOut(w, r, rd)
+		return
+	}
+	if sa, ok := session.(samlsp.SessionWithAttributes); ok {
+		if index := sa.GetAttributes().Get(sessionIndexAttribute); index != "" {
+			req.SessionIndex = &saml.SessionIndex{Value: index}
+		}
+	}
+
+	if binding == saml.HTTPRedirectBinding {
+		u := req.Redirect(rd)
+		if err := signRedirect(u, "SAMLRequest", sp); err != nil {
+			s.Log.Error("logout request", zap.Error(err))
+			s.signedOut(w, r, rd)
+			return
+		}
+		http.Redirect(w, r, u.String(), http.StatusFound)
+		return
+	}
+	if sp.SignatureMethod != "" {
+		if err := sp.SignLogoutRequest(req); err != nil {
+			s.Log.Error("logout request", zap.Error(err))
+			s.signedOut(w, r, rd)
+			return
+		}
+	}
+	s.writePostForm(w, "SAMLRequestForm", req.Post(rd))
+}
+
+func (s *AuthService) handleLogoutResponse(w http.ResponseWriter, r *http.Request) {
+	rd, ok := s.signoutRedirect(r.Form.Get("RelayState"))
+	if !ok {
+		s.httpError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	// Session was deleted before LogoutRequest was sent, failure only
+	// means user may still be signed in at IdP
+	var resp saml.LogoutResponse
+	if _, sp, err := s.readLogoutMessage(r, "SAMLResponse", &resp); err != nil {
+		s.Log.Warn("logout response", zap.Error(err))
+	} else if err := checkLogoutMessage(sp, resp.Issuer, resp.Destination, resp.IssueInstant); err != nil {
+		s.Log.Warn("logout response", zap.Error(err))
+	} else if resp.Status.StatusCode.Value != saml.StatusSuccess {
+		s.Log.Warn("logout response", zap.String("status", resp.Status.StatusCode.Value))
+	}
+	s.signedOut(w, r, rd)
+}
+
+func (s *AuthService) handleLogoutRequest(w http.ResponseWriter, r *http.Request) {
+	var req saml.LogoutRequest
+	binding, sp, err := s.readLogoutMessage(r, "SAMLRequest", &req)
+	if err == nil {
+		err = checkLogoutMessage(sp, req.Issuer, req.Destination, req.IssueInstant)
+	}
+	if err == nil && req.NotOnOrAfter != nil && !saml.TimeNow().Before(*req.NotOnOrAfter) {
+		err = errors.New("logout request expired")
+	}
+	if err == nil && (req.NameID == nil || req.NameID.Value == "") {
+		err = errors.New("logout request has no NameID")
+	}
+	if err != nil {
+		s.Log.Warn("logout request", zap.Error(err))
+		s.httpError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	nameID := req.NameID.Value
+	var index string
+	if req.SessionIndex != nil {
+		index = req.SessionIndex.Value
+	}
+	if session, err := s.SP.GetSession(r); err == nil {
+		if id, _, _ := sessionInfo(session); id == nameID {
+			if err := s.SP.DeleteSession(w, r); err != nil {
+				s.Log.Error("logout request", zap.Error(err))
+			}
+		}
+	}
+	if s.Revoker != nil {
+		if err := s.Revoker.Logout(r.Context(), nameID, index); err != nil && !errors.Is(err, errNoSessionStore) {
+			s.Log.Error("logout request", zap.Error(err))
+		}
+	}
+	s.Log.Info("signed out by IdP", zap.String("nameId", nameID), zap.String("sessionIndex", index))
+
+	if sp.GetSLOBindingLocation(binding) == "" {
+		binding = logoutBinding(sp)
+	}
+	if binding == "" {
+		s.signedOut(w, r, "")
+		return
+	}
+	unsigned := *sp
+	unsigned.SignatureMethod = ""
+	resp, err := unsigned.MakeLogoutResponse(sp.GetSLOBindingLocation(binding), req.ID)
+	if err != nil {
+		s.Log.Error("logout response", zap.Error(err))
+		s.httpError(w, r, http.StatusInternalServerError)
+		return
+	}
+	relayState := r.Form.Get("RelayState")
+	if binding == saml.HTTPRedirectBinding {
+		u := resp.Redirect(relayState)
+		if err := signRedirect(u, "SAMLResponse", sp); err != nil {
+			s.Log.Error("logout response", zap.Error(err))
+			s.httpError(w, r, http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, u.String(), http.StatusFound)
+		return
+	}
+	if sp.SignatureMethod != "" {
+		if err := sp.SignLogoutResponse(resp); err != nil {
+			s.Log.Error("logout response", zap.Error(err))
+			s.httpError(w, r, http.StatusInternalServerError)
+			return
+		}
+	}
+	s.writePostForm(w, "SAMLResponseForm", resp.Post(relayState))
+}
+
+// signoutRedirect returns absolute URL for rd, empty rd is valid and
+// means there is nowhere to go
+func (s *AuthService) signoutRedirect(rd string) (string, bool) {
+	if rd == "" {
+		return "", true
+	}
+	u, err := s.RootURL.Parse(rd)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.User != nil {
+		return "", false
+	}
+	host := strings.ToLower(u.Hostname())
+	if host == strings.ToLower(s.RootURL.Hostname()) {
+		return u.String(), true
+	}
+	if domain := sessionCookieDomain(s.SP); domain != "" && domainCovers(domain, host) {
+		return u.String(), true
+	}
+	return "", false
+}
+
+// sessionCookieDomain returns domain of session cookie without port
+func sessionCookieDomain(sp samlsp.SessionProvider) string {
+	var domain string
+	switch p := sp.(type) {
+	case CookieSessionProvider:
+		domain = p.Domain
+	case StoreSessionProvider:
+		domain = p.domain()
+	case samlsp.CookieSessionProvider:
+		domain = p.Domain
+	}
+	if host, _, err := net.SplitHostPort(domain); err == nil {
+		domain = host
+	}
+	return strings.ToLower(strings.TrimPrefix(domain, "."))
+}
+
+func (s *AuthService) signedOut(w http.ResponseWriter, r *http.Request, rd string) {
+	if rd != "" {
+		http.Redirect(w, r, rd, http.StatusFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	s.httpStatus(w, r, http.StatusOK)
+	fmt.Fprintln(w, "Signed out")
+}
+
+// writePostForm writes auto submitted form of HTTP-POST binding, only the
+// submitting script of form is allowed to run
+func (s *AuthService) writePostForm(w http.ResponseWriter, formID string, form []byte) {
+	script := `document.getElementById('SAMLSubmitButton').style.visibility="hidden";` +
+		`document.getElementById('` + formID + `').submit();`
+	sum := sha256.Sum256([]byte(script))
+	w.Header().Set("Content-Security-Policy", "default-src; script-src 'sha256-"+
+		base64.StdEncoding.EncodeToString(sum[:])+"'; referrer no-referrer;")
+	w.Header().Set("Content-Type", "text/html")
+	w.Write([]byte(`<!DOCTYPE html><html><body>`))
+	w.Write(form)
+	w.Write([]byte(`</body></html>`))
+}
+
+// logoutBinding returns binding of IdP SingleLogoutService, redirect is
+// preferred
+func logoutBinding(sp *saml.ServiceProvider) string {
+	for _, binding := range []string{saml.HTTPRedirectBinding, saml.HTTPPostBinding} {
+		if sp.GetSLOBindingLocation(binding) != "" {
+			return binding
+		}
+	}
+	return ""
+}
+
+// readLogoutMessage decodes param of HTTP-Redirect or HTTP-POST binding
+// into v and verifies it is signed by IdP that issued it, returns binding
+// and service provider of that IdP
+func (s *AuthService) readLogoutMessage(r *http.Request, param string, v interface{}) (string, *saml.ServiceProvider, error) {
+	binding := saml.HTTPPostBinding
+	encoded := r.PostForm.Get(param)
+	if q := r.URL.Query().Get(param); q != "" {
+		binding, encoded = saml.HTTPRedirectBinding, q
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", nil, fmt.Errorf("%s: %w", param, err)
+	}
+	if binding == saml.HTTPRedirectBinding {
+		data, err = io.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(data)), maxLogoutMessage))
+		if err != nil {
+			return "", nil, fmt.Errorf("%s: %w", param, err)
+		}
+	}
+	if err := xrv.Validate(bytes.NewReader(data)); err != nil {
+		return "", nil, fmt.Errorf("%s: %w", param, err)
+	}
+
+	// issuer selects certificates signature is checked with
+	var head struct {
+		Issuer string `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+	}
+	if err := xml.Unmarshal(data, &head); err != nil {
+		return "", nil, fmt.Errorf("%s: %w", param, err)
+	}
+	m := s.issuerMiddleware(strings.TrimSpace(head.Issuer))
+	if m == nil {
+		return "", nil, fmt.Errorf("%s: unknown issuer %q", param, head.Issuer)
+	}
+	sp := &m.ServiceProvider
+	if sp.IDPMetadata == nil {
+		return "", nil, errors.New("IdP metadata not loaded")
+	}
+	certs, err := IDPSigningCertificates(sp.IDPMetadata)
+	if err != nil {
+		return "", nil, err
+	}
+
+	switch {
+	case binding == saml.HTTPRedirectBinding && r.URL.Query().Get("Signature") != "":
+		err = verifyRedirectSignature(r.URL.RawQuery, param, certs)
+	default:
+		err = verifyXMLSignature(data, certs)
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("%s: %w", param, err)
+	}
+	if err := xml.Unmarshal(data, v); err != nil {
+		return "", nil, fmt.Errorf("%s: %w", param, err)
+	}
+	return binding, sp, nil
+}
+
+// checkLogoutMessage checks logout message comes from IdP of sp, is meant
+// for us and is recent
+func checkLogoutMessage(sp *saml.ServiceProvider, issuer *saml.Issuer, destination string, issued time.Time) error {
+	if issuer == nil || issuer.Value != sp.IDPMetadata.EntityID {
+		return fmt.Errorf("issuer does not match IdP %q", sp.IDPMetadata.EntityID)
+	}
+	if destination != "" && destination != sp.SloURL.String() {
+		return fmt.Errorf("destination %q does not match %q", destination, sp.SloURL.String())
+	}
+	now := saml.TimeNow()
+	if issued.Add(saml.MaxIssueDelay).Before(now) || issued.After(now.Add(saml.MaxClockSkew)) {
+		return fmt.Errorf("issue instant %s is not recent", issued)
+	}
+	return nil
+}
+
+// verifyXMLSignature checks enveloped signature of root element
+func verifyXMLSignature(data []byte, certs []*x509.Certificate) error {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(data); err != nil {
+		return err
+	}
+	el := doc.Root()
+	if el == nil {
+		return errors.New("empty message")
+	}
+	sig := el.FindElement("./Signature")
+	if sig == nil {
+		return errors.New("message is not signed")
+	}
+	if el.FindElement("./Signature/KeyInfo/X509Data/X509Certificate") != nil {
+		return validateXMLSignature(el, certs)
+	}
+
+	// Signature is checked against metadata certificates when it carries
+	// only key value, validation without certificate in KeyInfo needs
+	// single root so each one is tried
+	if keyInfo := sig.FindElement("KeyInfo"); keyInfo != nil {
+		sig.RemoveChild(keyInfo)
+	}
+	err := errors.New("no signing certificate")
+	for _, cert := range certs {
+		if err = validateXMLSignature(el, []*x509.Certificate{cert}); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// validateXMLSignature checks signature of el against roots, el is not
+// modified
+func validateXMLSignature(el *etree.Element, roots []*x509.Certificate) error {
+	ctx := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{Roots: roots})
+	ctx.IdAttribute = "ID"
+	if saml.Clock != nil {
+		ctx.Clock = saml.Clock
+	}
+	_, err := ctx.Validate(el)
+	return err
+}
+
+var redirectSignatureHashes = map[string]crypto.Hash{
+	dsig.RSASHA1SignatureMethod:   crypto.SHA1,
+	dsig.RSASHA256SignatureMethod: crypto.SHA256,
+	dsig.RSASHA512SignatureMethod: crypto.SHA512,
+}
+
+// redirectSignedQuery returns part of HTTP-Redirect query covered by
+// signature, values stay encoded as received
+func redirectSignedQuery(values map[string]string, param string) string {
+	signed := param + "=" + values[param]
+	if relayState, ok := values["RelayState"]; ok {
+		signed += "&RelayState=" + relayState
+	}
+	return signed + "&SigAlg=" + values["SigAlg"]
+}
+
+// verifyRedirectSignature checks SigAlg and Signature query parameters of
+// HTTP-Redirect binding
+func verifyRedirectSignature(rawQuery, param string, certs []*x509.Certificate) error {
+	values := map[string]string{}
+	for _, kv := range strings.Split(rawQuery, "&") {
+		if i := strings.IndexByte(kv, '='); i > 0 {
+			values[kv[:i]] = kv[i+1:]
+		}
+	}
+	sigAlg, err := url.QueryUnescape(values["SigAlg"])
+	if err != nil {
+		return err
+	}
+	hash, ok := redirectSignatureHashes[sigAlg]
+	if !ok {
+		return fmt.Errorf("unsupported SigAlg %q", sigAlg)
+	}
+	encoded, err := url.QueryUnescape(values["Signature"])
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return err
+	}
+
+	h := hash.New()
+	h.Write([]byte(redirectSignedQuery(values, param)))
+	digest := h.Sum(nil)
+	now := saml.TimeNow()
+	for _, cert := range certs {
+		pub, ok := cert.PublicKey.(*rsa.PublicKey)
+		if !ok || now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+			continue
+		}
+		if rsa.VerifyPKCS1v15(pub, hash, digest, sig) == nil {
+			return nil
+		}
+	}
+	return errors.New("signature does not match IdP signing certificate")
+}
+
+// signRedirect adds SigAlg and Signature of HTTP-Redirect binding to u
+// when sp signs requests
+func signRedirect(u *url.URL, param string, sp *saml.ServiceProvider) error {
+	if sp.SignatureMethod == "" {
+		return nil
+	}
+	hash, ok := redirectSignatureHashes[sp.SignatureMethod]
+	if !ok {
+		return fmt.Errorf("unsupported signature method %q", sp.SignatureMethod)
+	}
+
+	query := u.Query()
+	values := map[string]string{
+		param:    url.QueryEscape(query.Get(param)),
+		"SigAlg": url.QueryEscape(sp.SignatureMethod),
+	}
+	if relayState := query.Get("RelayState"); relayState != "" {
+		values["RelayState"] = url.QueryEscape(relayState)
+	}
+	query.Del(param)
+	query.Del("RelayState")
+	signed := redirectSignedQuery(values, param)
+
+	h := hash.New()
+	h.Write([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, sp.Key, hash, h.Sum(nil))
+	if err != nil {
+		return err
+	}
+	signed += "&Signature=" + url.QueryEscape(base64.StdEncoding.EncodeToString(sig))
+	if rest := query.Encode(); rest != "" {
+		signed = rest + "&" + signed
+	}
+	u.RawQuery = signed
+	return nil
+}
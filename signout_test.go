@@ -0,0 +1,371 @@
+package authorizer
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+const (
+	testIDPEntityID = "https://idp.example.com/metadata"
+	testIDPLogout   = "https://idp.example.com/slo"
+	testSloURL      = "https://sso.example.com/saml/signout"
+)
+
+// signoutService returns service with server side sessions, its SP
+// certificate and IdP signing messages to it
+func signoutService(t *testing.T, binding string) (*AuthService, StoreSessionProvider, *x509.Certificate, *saml.ServiceProvider) {
+	t.Helper()
+	spKey, spCert := testKeyPair(t, "sso.example.com")
+	idpKey, idpCert := testKeyPair(t, "idp.example.com")
+	sloURL, _ := url.Parse(testSloURL)
+
+	p := StoreSessionProvider{Store: NewMemoryStore(), Name: "token", Domain: "example.com"}
+	s := fakeAuthService(p, nil)
+	s.RootURL, _ = url.Parse("https://sso.example.com")
+	s.M.ServiceProvider = saml.ServiceProvider{
+		EntityID:        "https://sso.example.com/saml/metadata",
+		Key:             spKey,
+		Certificate:     spCert,
+		SloURL:          *sloURL,
+		SignatureMethod: dsig.RSASHA256SignatureMethod,
+		IDPMetadata: &saml.EntityDescriptor{
+			EntityID: testIDPEntityID,
+			IDPSSODescriptors: []saml.IDPSSODescriptor{{
+				SSODescriptor: saml.SSODescriptor{
+					RoleDescriptor: saml.RoleDescriptor{
+						KeyDescriptors: []saml.KeyDescriptor{keyDescriptor("signing", idpCert)},
+					},
+					SingleLogoutServices: []saml.Endpoint{{Binding: binding, Location: testIDPLogout}},
+				},
+			}},
+		},
+	}
+	var err error
+	if s.Revoker, err = NewRevoker(&SessionConfig{Store: "memory"}, p); err != nil {
+		t.Fatal(err)
+	}
+
+	// IdP messages are made by service provider acting as IdP
+	idp := &saml.ServiceProvider{
+		EntityID:        testIDPEntityID,
+		Key:             idpKey,
+		Certificate:     idpCert,
+		SignatureMethod: dsig.RSASHA256SignatureMethod,
+		IDPMetadata:     &saml.EntityDescriptor{EntityID: s.M.ServiceProvider.EntityID},
+	}
+	return s, p, spCert, idp
+}
+
+// redirectMessage inflates param of HTTP-Redirect binding URL into v
+func redirectMessage(t *testing.T, u *url.URL, param string, v interface{}) {
+	t.Helper()
+	data, err := base64.StdEncoding.DecodeString(u.Query().Get(param))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = io.ReadAll(flate.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := xml.Unmarshal(data, v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSignoutRedirect(t *testing.T) {
+	s := fakeAuthService(StoreSessionProvider{Name: "token", Domain: ".apps.example.com:443"}, nil)
+	s.RootURL, _ = url.Parse("https://sso.example.com")
+
+	tests := []struct {
+		rd   string
+		want string
+		ok   bool
+	}{
+		{"", "", true},
+		{"/signed-out", "https://sso.example.com/signed-out", true},
+		{"https://SSO.example.com/x", "https://SSO.example.com/x", true},
+		{"https://grafana.apps.example.com/d?x=1", "https://grafana.apps.example.com/d?x=1", true},
+		{"http://apps.example.com/", "http://apps.example.com/", true},
+		{"https://evil.com/", "", false},
+		{"//evil.com/", "", false},
+		{"https://apps.example.com.evil.com/", "", false},
+		{"https://user@grafana.apps.example.com/", "", false},
+		{"javascript:alert(1)", "", false},
+		{"ftp://grafana.apps.example.com/", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := s.signoutRedirect(tt.rd)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("signoutRedirect(%q) = %q, %v, want %q, %v", tt.rd, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestSignoutRedirectBinding(t *testing.T) {
+	s, p, spCert, _ := signoutService(t, saml.HTTPRedirectBinding)
+	req := sessionCookie(t, p)
+	req.URL, _ = url.Parse("/saml/signout?rd=https://grafana.example.com/")
+
+	res := httptest.NewRecorder()
+	s.Signout(res, req)
+
+	if res.Code != http.StatusFound {
+		t.Fatalf("Signout() status = %d, want %d", res.Code, http.StatusFound)
+	}
+	if sessions, _ := s.Revoker.Sessions(req.Context()); len(sessions) != 0 {
+		t.Errorf("session not deleted, %d sessions left", len(sessions))
+	}
+	if cookies := res.Result().Cookies(); len(cookies) != 1 || cookies[0].Value != "" {
+		t.Errorf("session cookie not cleared, got %v", cookies)
+	}
+
+	u, _ := url.Parse(res.Header().Get("Location"))
+	if !strings.HasPrefix(u.String(), testIDPLogout+"?") {
+		t.Fatalf("redirected to %s, want IdP logout", u)
+	}
+	if got := u.Query().Get("RelayState"); got != "https://grafana.example.com/" {
+		t.Errorf("RelayState = %q", got)
+	}
+	if err := verifyRedirectSignature(u.RawQuery, "SAMLRequest", []*x509.Certificate{spCert}); err != nil {
+		t.Errorf("LogoutRequest signature: %v", err)
+	}
+	var logout saml.LogoutRequest
+	redirectMessage(t, u, "SAMLRequest", &logout)
+	if logout.NameID.Value != "alice@example.com" || logout.SessionIndex == nil || logout.SessionIndex.Value != "_idx1" {
+		t.Errorf("unexpected LogoutRequest %+v", logout)
+	}
+	if logout.Destination != testIDPLogout || logout.Signature != nil {
+		t.Errorf("LogoutRequest destination %q, XML signature %v", logout.Destination, logout.Signature)
+	}
+}
+
+func TestSignoutPostBinding(t *testing.T) {
+	s, p, _, _ := signoutService(t, saml.HTTPPostBinding)
+	req := sessionCookie(t, p)
+	req.URL, _ = url.Parse("/saml/signout")
+
+	res := httptest.NewRecorder()
+	s.Signout(res, req)
+
+	body := res.Body.String()
+	if res.Code != http.StatusOK || !strings.Contains(body, `action="`+testIDPLogout+`"`) {
+		t.Fatalf("Signout() = %d %s, want POST form to IdP", res.Code, body)
+	}
+	start := strings.Index(body, "<script>") + len("<script>")
+	end := strings.Index(body, "</script>")
+	sum := sha256.Sum256([]byte(body[start:end]))
+	if csp := res.Header().Get("Content-Security-Policy"); !strings.Contains(csp, base64.StdEncoding.EncodeToString(sum[:])) {
+		t.Errorf("Content-Security-Policy %q does not allow form script", csp)
+	}
+}
+
+func TestSignoutWithoutSession(t *testing.T) {
+	s, _, _, _ := signoutService(t, saml.HTTPRedirectBinding)
+
+	tests := []struct {
+		target   string
+		code     int
+		location string
+	}{
+		{"/saml/signout", http.StatusOK, ""},
+		{"/saml/signout?rd=/bye", http.StatusFound, "https://sso.example.com/bye"},
+		{"/saml/signout?rd=https://evil.com/", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		res := httptest.NewRecorder()
+		s.Signout(res, httptest.NewRequest(http.MethodGet, tt.target, nil))
+		if res.Code != tt.code || res.Header().Get("Location") != tt.location {
+			t.Errorf("Signout(%s) = %d %q, want %d %q", tt.target, res.Code, res.Header().Get("Location"), tt.code, tt.location)
+		}
+	}
+}
+
+func TestSignoutLogoutResponse(t *testing.T) {
+	s, _, _, idp := signoutService(t, saml.HTTPRedirectBinding)
+
+	unsigned := *idp
+	unsigned.SignatureMethod = ""
+	resp, err := unsigned.MakeLogoutResponse(testSloURL, "id-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := resp.Redirect("https://grafana.example.com/")
+	if err := signRedirect(u, "SAMLResponse", idp); err != nil {
+		t.Fatal(err)
+	}
+
+	res := httptest.NewRecorder()
+	s.Signout(res, httptest.NewRequest(http.MethodGet, "/saml/signout?"+u.RawQuery, nil))
+	if res.Code != http.StatusFound || res.Header().Get("Location") != "https://grafana.example.com/" {
+		t.Errorf("Signout() = %d %q, want redirect to RelayState", res.Code, res.Header().Get("Location"))
+	}
+
+	var logout saml.LogoutResponse
+	_, sp, err := s.readLogoutMessage(httptest.NewRequest(http.MethodGet, "/saml/signout?"+u.RawQuery, nil), "SAMLResponse", &logout)
+	if err != nil {
+		t.Fatalf("readLogoutMessage() error = %v", err)
+	}
+	if err := checkLogoutMessage(sp, logout.Issuer, logout.Destination, logout.IssueInstant); err != nil {
+		t.Errorf("checkLogoutMessage() error = %v", err)
+	}
+
+	query := u.Query()
+	query.Set("RelayState", "https://evil.com/")
+	res = httptest.NewRecorder()
+	s.Signout(res, httptest.NewRequest(http.MethodGet, "/saml/signout?"+query.Encode(), nil))
+	if res.Code != http.StatusBadRequest {
+		t.Errorf("Signout() with foreign RelayState = %d, want %d", res.Code, http.StatusBadRequest)
+	}
+}
+
+func TestSignoutIdPInitiated(t *testing.T) {
+	s, p, spCert, idp := signoutService(t, saml.HTTPRedirectBinding)
+
+	// POST binding with XML signature
+	req := sessionCookie(t, p)
+	unsigned := *idp
+	unsigned.SignatureMethod = ""
+	logout, err := unsigned.MakeLogoutRequest(testSloURL, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logout.SessionIndex = &saml.SessionIndex{Value: "_idx1"}
+	if err := idp.SignLogoutRequest(logout); err != nil {
+		t.Fatal(err)
+	}
+	res := httptest.NewRecorder()
+	s.Signout(res, postLogoutRequest(t, logout, "state", req.Cookies()))
+
+	if sessions, _ := s.Revoker.Sessions(req.Context()); len(sessions) != 0 {
+		t.Errorf("session not deleted, %d sessions left", len(sessions))
+	}
+	u, _ := url.Parse(res.Header().Get("Location"))
+	if res.Code != http.StatusFound || !strings.HasPrefix(u.String(), testIDPLogout+"?") {
+		t.Fatalf("Signout() = %d %s, want LogoutResponse redirect", res.Code, u)
+	}
+	if err := verifyRedirectSignature(u.RawQuery, "SAMLResponse", []*x509.Certificate{spCert}); err != nil {
+		t.Errorf("LogoutResponse signature: %v", err)
+	}
+	var resp saml.LogoutResponse
+	redirectMessage(t, u, "SAMLResponse", &resp)
+	if resp.InResponseTo != logout.ID || resp.Status.StatusCode.Value != saml.StatusSuccess || u.Query().Get("RelayState") != "state" {
+		t.Errorf("unexpected LogoutResponse %+v", resp)
+	}
+
+	// HTTP-Redirect binding with query signature
+	sessionCookie(t, p)
+	logout, _ = unsigned.MakeLogoutRequest(testSloURL, "alice@example.com")
+	u = logout.Redirect("")
+	if err := signRedirect(u, "SAMLRequest", idp); err != nil {
+		t.Fatal(err)
+	}
+	res = httptest.NewRecorder()
+	s.Signout(res, httptest.NewRequest(http.MethodGet, "/saml/signout?"+u.RawQuery, nil))
+	if res.Code != http.StatusFound {
+		t.Errorf("Signout() status = %d, want %d", res.Code, http.StatusFound)
+	}
+	if sessions, _ := s.Revoker.Sessions(req.Context()); len(sessions) != 0 {
+		t.Errorf("sessions of user not deleted, %d sessions left", len(sessions))
+	}
+}
+
+func TestSignoutIdPInitiatedInvalid(t *testing.T) {
+	s, p, _, idp := signoutService(t, saml.HTTPRedirectBinding)
+	req := sessionCookie(t, p)
+
+	unsigned := *idp
+	unsigned.SignatureMethod = ""
+	notSigned, _ := unsigned.MakeLogoutRequest(testSloURL, "alice@example.com")
+
+	other := *idp
+	other.EntityID = "https://other.example.com"
+	otherIssuer, _ := other.MakeLogoutRequest(testSloURL, "alice@example.com")
+
+	wrongDestination, _ := idp.MakeLogoutRequest("https://other.example.com/slo", "alice@example.com")
+
+	tampered, _ := idp.MakeLogoutRequest(testSloURL, "alice@example.com")
+	tampered.NameID.Value = "bob@example.com"
+
+	for name, logout := range map[string]*saml.LogoutRequest{
+		"NotSigned":        notSigned,
+		"OtherIssuer":      otherIssuer,
+		"WrongDestination": wrongDestination,
+		"Tampered":         tampered,
+	} {
+		res := httptest.NewRecorder()
+		s.Signout(res, postLogoutRequest(t, logout, "", req.Cookies()))
+		if res.Code != http.StatusBadRequest {
+			t.Errorf("%s: Signout() status = %d, want %d", name, res.Code, http.StatusBadRequest)
+		}
+	}
+	if sessions, _ := s.Revoker.Sessions(req.Context()); len(sessions) != 1 {
+		t.Errorf("invalid logout requests deleted session")
+	}
+}
+
+// postLogoutRequest returns HTTP-POST binding request with logout
+func postLogoutRequest(t *testing.T, logout *saml.LogoutRequest, relayState string, cookies []*http.Cookie) *http.Request {
+	t.Helper()
+	doc := etree.NewDocument()
+	doc.SetRoot(logout.Element())
+	data, err := doc.WriteToBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	form := url.Values{"SAMLRequest": {base64.StdEncoding.EncodeToString(data)}}
+	if relayState != "" {
+		form.Set("RelayState", relayState)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/saml/signout", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	return r
+}
+
+func TestSignoutIdPInitiatedSigningCertificates(t *testing.T) {
+	s, p, _, idp := signoutService(t, saml.HTTPRedirectBinding)
+	// IdP metadata lists next certificate before current one during rollover
+	_, next := testKeyPair(t, "idp.example.com")
+	role := &s.M.ServiceProvider.IDPMetadata.IDPSSODescriptors[0].RoleDescriptor
+	role.KeyDescriptors = append([]saml.KeyDescriptor{keyDescriptor("signing", next)}, role.KeyDescriptors...)
+	req := sessionCookie(t, p)
+
+	unsigned := *idp
+	unsigned.SignatureMethod = ""
+	logout, err := unsigned.MakeLogoutRequest(testSloURL, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := idp.SignLogoutRequest(logout); err != nil {
+		t.Fatal(err)
+	}
+	// signature carries only key value, not certificate
+	if keyInfo := logout.Signature.FindElement("KeyInfo"); keyInfo != nil {
+		logout.Signature.RemoveChild(keyInfo)
+	}
+
+	res := httptest.NewRecorder()
+	s.Signout(res, postLogoutRequest(t, logout, "", req.Cookies()))
+	if res.Code != http.StatusFound {
+		t.Errorf("Signout() status = %d, want %d", res.Code, http.StatusFound)
+	}
+	if sessions, _ := s.Revoker.Sessions(req.Context()); len(sessions) != 0 {
+		t.Errorf("session not deleted, %d sessions left", len(sessions))
+	}
+}
@@ -0,0 +1,216 @@
+package authorizer
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// TenantConfig is service provider with its own entity ID, key pair and
+// IdPs serving requests for its hosts; endpoints are under /saml/<name>/
+// and keys not set are taken from top level config
+type TenantConfig struct {
+	Name string `yaml:"name"`
+	// Hosts served by tenant, exact names or *.domain wildcards
+	Hosts []string `yaml:"hosts"`
+	// EntityID defaults to tenant metadata URL
+	EntityID        string `yaml:"entityid"`
+	KeyFile         string `yaml:"keyfile"`
+	CertificateFile string `yaml:"certificatefile"`
+	IDPMetadataURL  string `yaml:"idpmetadataurl"`
+	IDPMetadataFile string `yaml:"idpmetadatafile"`
+	IDPMetadataXML  string `yaml:"idpmetadataxml"`
+	// IDPMetadataSigning is replaced together with metadata source
+	IDPMetadataSigning *MetadataSigningConfig `yaml:"idpmetadatasigning"`
+	IDPs               []IDPConfig            `yaml:"idps"`
+	// Cookie replaces top level cookie config, session cookie name
+	// defaults to top level name with _<name> suffix
+	Cookie *CookieConfig `yaml:"cookie"`
+}
+
+// tenantEndpoints can not be tenant names, they are top level endpoints
+var tenantEndpoints = map[string]bool{
+	"auth": true, "signin": true, "signout": true, "whoami": true,
+	"explain": true, "admin": true, "acs": true, "metadata": true,
+}
+
+func validateTenants(c *Config) []string {
+	var errs []string
+	add := func(field, format string, args ...interface{}) {
+		errs = append(errs, field+": "+fmt.Sprintf(format, args...))
+	}
+
+	names := map[string]bool{}
+	hosts := map[string]string{}
+	for i, t := range c.Tenants {
+		field := fmt.Sprintf("tenants[%d]", i)
+		switch {
+		case t.Name == "":
+			add(field+".name", "is required")
+		case !idpName.MatchString(t.Name):
+			add(field+".name", "%q must be lowercase letters, digits and dashes", t.Name)
+		case tenantEndpoints[t.Name]:
+			add(field+".name", "%q is reserved for /saml/%s endpoint", t.Name, t.Name)
+		case names[t.Name]:
+			add(field+".name", "duplicate tenant %q", t.Name)
+		}
+		names[t.Name] = true
+
+		if len(t.Hosts) == 0 {
+			add(field+".hosts", "is required")
+		}
+		for _, h := range t.Hosts {
+			h = strings.ToLower(h)
+			if h == "" {
+				add(field+".hosts", "host must not be empty")
+			} else if err := validateHostPattern(h); err != nil {
+				add(field+".hosts", "%v", err)
+			} else if other, ok := hosts[h]; ok {
+				add(field+".hosts", "%s already belongs to %s", h, other)
+			}
+			hosts[h] = t.Name
+		}
+
+		if (t.KeyFile == "") != (t.CertificateFile == "") {
+			add(field, "keyfile and certificatefile must be set together")
+		}
+		sources, merrs := validateMetadataSource(field+".", "idpmetadata", t.IDPMetadataURL, t.IDPMetadataFile, t.IDPMetadataXML, t.IDPMetadataSigning)
+		errs = append(errs, merrs...)
+		if sources > 0 && len(t.IDPs) > 0 {
+			add(field+".idps", "only one of idpmetadataurl, idpmetadatafile, idpmetadataxml and idps can be set")
+		}
+		for _, err := range validateIDPs(t.IDPs) {
+			errs = append(errs, field+"."+err)
+		}
+		if t.Cookie != nil {
+			for _, err := range t.Cookie.validate(c.URL) {
+				errs = append(errs, field+".cookie."+err)
+			}
+		}
+	}
+	return errs
+}
+
+// Tenant returns config of tenant t, top level config with keys set by
+// tenant replaced; session stores are separate from top level ones
+func (c *Config) Tenant(t TenantConfig) *Config {
+	tc := *c
+	tc.Tenants = nil
+	tc.EntityID = t.EntityID
+	if t.KeyFile != "" {
+		tc.KeyFile, tc.CertificateFile = t.KeyFile, t.CertificateFile
+	}
+	if t.IDPMetadataURL != "" || t.IDPMetadataFile != "" || t.IDPMetadataXML != "" || len(t.IDPs) > 0 {
+		tc.IDPMetadataURL, tc.IDPMetadataFile, tc.IDPMetadataXML = t.IDPMetadataURL, t.IDPMetadataFile, t.IDPMetadataXML
+		tc.IDPMetadataSigning = t.IDPMetadataSigning
+		tc.IDPs = t.IDPs
+	}
+
+	cookie := CookieConfig{}
+	if t.Cookie != nil {
+		cookie = *t.Cookie
+	} else if c.Cookie != nil {
+		cookie = *c.Cookie
+		cookie.Name = ""
+	}
+	if cookie.Name == "" {
+		name := "token"
+		if c.Cookie != nil && c.Cookie.Name != "" {
+			name = c.Cookie.Name
+		}
+		cookie.Name = name + "_" + t.Name
+	}
+	tc.Cookie = &cookie
+
+	if c.Session != nil {
+		session := *c.Session
+		if session.Dir != "" {
+			session.Dir = filepath.Join(session.Dir, t.Name)
+		}
+		prefix := session.Redis.Prefix
+		if prefix == "" {
+			prefix = defaultRedisPrefix
+		}
+		session.Redis.Prefix = t.Name + ":" + prefix
+		tc.Session = &session
+	}
+	return &tc
+}
+
+// staticTenants returns tenants with IdP policies cleared, policies are
+// reloadable while the rest needs restart
+func staticTenants(tenants []TenantConfig) []TenantConfig {
+	var static []TenantConfig
+	for _, t := range tenants {
+		t.IDPs = withoutPolicies(t.IDPs)
+		static = append(static, t)
+	}
+	return static
+}
+
+// Tenant is service provider serving requests for its hosts and requests
+// under /saml/<name>/
+type Tenant struct {
+	Name    string
+	S       *AuthService
+	Handler http.Handler
+
+	hosts []string
+}
+
+// NewTenant returns tenant for config served by handler h of service s
+func NewTenant(c TenantConfig, s *AuthService, h http.Handler) *Tenant {
+	t := &Tenant{Name: c.Name, S: s, Handler: h}
+	for _, host := range c.Hosts {
+		t.hosts = append(t.hosts, strings.ToLower(host))
+	}
+	return t
+}
+
+// tenant returns tenant named in path of r or serving host of request, nil
+// for top level service provider. Only auth subrequests are matched by
+// original URL, direct requests can not pick tenant with rd parameter or
+// forwarded headers.
+func (s *AuthService) tenant(r *http.Request) *Tenant {
+	for _, t := range s.Tenants {
+		if strings.HasPrefix(r.URL.Path, "/saml/"+t.Name+"/") {
+			return t
+		}
+	}
+	u := &url.URL{Host: r.Host}
+	if r.URL.Path == "/saml/auth" {
+		u = s.originalURL(r)
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, t := range s.Tenants {
+		for _, pattern := range t.hosts {
+			if matchHost(pattern, host) {
+				return t
+			}
+		}
+	}
+	return nil
+}
+
+// TenantHandler returns handler passing requests of tenants to their
+// handlers and the rest to h
+func (s *AuthService) TenantHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if t := s.tenant(r); t != nil {
+			t.Handler.ServeHTTP(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// endpoint returns path of r relative to /saml/ or /saml/<tenant>/
+func (s *AuthService) endpoint(r *http.Request) string {
+	path := strings.TrimPrefix(r.URL.Path, "/saml/")
+	if s.Tenant != "" {
+		path = strings.TrimPrefix(path, s.Tenant+"/")
+	}
+	return path
+}
@@ -0,0 +1,242 @@
+package authorizer
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestValidateTenants(t *testing.T) {
+	c := validConfig()
+	c.Tenants = []TenantConfig{{
+		Name:  "hr",
+		Hosts: []string{"*.hr.example.com"},
+	}, {
+		Name:           "admin",
+		Hosts:          []string{"*.HR.example.com", "*.*.example.org"},
+		KeyFile:        "finance.key",
+		IDPMetadataURL: "https://idp.example.org/metadata",
+		IDPs:           []IDPConfig{{Name: "partners", MetadataURL: "https://partners.example.org/metadata"}},
+	}, {
+		Name:           "hr",
+		IDPMetadataURL: "idp.example.org",
+		Cookie:         &CookieConfig{Path: "saml"},
+	}}
+	got := validateTenants(c)
+	want := []string{
+		`tenants[1].name: "admin" is reserved for /saml/admin endpoint`,
+		`tenants[1].hosts: *.hr.example.com already belongs to hr`,
+		`tenants[1].hosts: "*.*.example.org" must be host name or *.domain wildcard`,
+		`tenants[1]: keyfile and certificatefile must be set together`,
+		`tenants[1].idps: only one of idpmetadataurl, idpmetadatafile, idpmetadataxml and idps can be set`,
+		`tenants[2].name: duplicate tenant "hr"`,
+		`tenants[2].hosts: is required`,
+		`tenants[2].idpmetadataurl: "idp.example.org" must be http or https URL`,
+		`tenants[2].cookie.path: must start with /`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("validateTenants() = %q, want %q", got, want)
+	}
+}
+
+func TestConfigTenant(t *testing.T) {
+	c := validConfig()
+	c.EntityID = "https://auth.example.com/saml/metadata"
+	c.Session = &SessionConfig{Store: "file", Dir: "/var/lib/authorizer"}
+	c.Cookie = &CookieConfig{Name: "sso", Domain: "example.com"}
+
+	got := c.Tenant(TenantConfig{
+		Name:  "hr",
+		Hosts: []string{"*.hr.example.com"},
+		IDPs:  []IDPConfig{{Name: "workday", MetadataURL: "https://workday.example.com/metadata"}},
+	})
+	want := *c
+	want.EntityID = ""
+	want.IDPMetadataURL = ""
+	want.IDPs = []IDPConfig{{Name: "workday", MetadataURL: "https://workday.example.com/metadata"}}
+	want.Session = &SessionConfig{Store: "file", Dir: "/var/lib/authorizer/hr", Redis: RedisConfig{Prefix: "hr:authorizer:session:"}}
+	want.Cookie = &CookieConfig{Name: "sso_hr", Domain: "example.com"}
+	if !reflect.DeepEqual(got, &want) {
+		t.Errorf("Config.Tenant() = %+v, want %+v", got, &want)
+	}
+	if c.Session.Dir != "/var/lib/authorizer" || c.Cookie.Name != "sso" {
+		t.Error("top level config was modified")
+	}
+
+	got = c.Tenant(TenantConfig{
+		Name:            "finance",
+		EntityID:        "https://finance.example.com/saml",
+		KeyFile:         "finance.key",
+		CertificateFile: "finance.crt",
+		Cookie:          &CookieConfig{Domain: "finance.example.com"},
+	})
+	if got.EntityID != "https://finance.example.com/saml" || got.KeyFile != "finance.key" || got.CertificateFile != "finance.crt" {
+		t.Errorf("Config.Tenant() = %+v, want finance entity id and key pair", got)
+	}
+	if got.IDPMetadataURL != c.IDPMetadataURL {
+		t.Errorf("Config.Tenant() idpmetadataurl = %s, want %s", got.IDPMetadataURL, c.IDPMetadataURL)
+	}
+	if want := (&CookieConfig{Name: "sso_finance", Domain: "finance.example.com"}); !reflect.DeepEqual(got.Cookie, want) {
+		t.Errorf("Config.Tenant() cookie = %+v, want %+v", got.Cookie, want)
+	}
+}
+
+// tenantService returns top level service with hr tenant, handlers write
+// name of service that got the request
+func tenantService() (*AuthService, http.Handler) {
+	named := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, name)
+		})
+	}
+	s := fakeAuthService(&validUser{}, nil)
+	hr := fakeAuthService(&validUser{}, nil)
+	hr.Tenant = "hr"
+	s.Tenants = []*Tenant{NewTenant(TenantConfig{Name: "hr", Hosts: []string{"*.HR.example.com"}}, hr, named("hr"))}
+	return s, s.TenantHandler(named("default"))
+}
+
+func TestTenantHandler(t *testing.T) {
+	_, h := tenantService()
+
+	tests := []struct {
+		name      string
+		target    string
+		host      string
+		header    string
+		forwarded string
+		want      string
+	}{{
+		name:   "Path",
+		target: "/saml/hr/acs",
+		want:   "hr",
+	}, {
+		name:   "PathOfOtherTenant",
+		target: "/saml/hrx/acs",
+		want:   "default",
+	}, {
+		name:   "OriginalURL",
+		target: "/saml/auth",
+		header: "https://wiki.hr.example.com/",
+		want:   "hr",
+	}, {
+		name:   "Host",
+		target: "/saml/signin",
+		host:   "SSO.hr.example.com:8443",
+		want:   "hr",
+	}, {
+		name:   "Redirect",
+		target: "/saml/signin?rd=https%3A%2F%2Fwiki.hr.example.com%2F",
+		want:   "default",
+	}, {
+		name:   "OriginalURLOfDirectRequest",
+		target: "/saml/signin",
+		header: "https://wiki.hr.example.com/",
+		want:   "default",
+	}, {
+		name:      "ForwardedHost",
+		target:    "/saml/signout",
+		forwarded: "wiki.hr.example.com",
+		want:      "default",
+	}, {
+		name:   "OtherHost",
+		target: "/saml/auth",
+		header: "https://grafana.example.com/",
+		want:   "default",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.host != "" {
+				req.Host = tt.host
+			}
+			if tt.header != "" {
+				req.Header.Set("X-Original-URL", tt.header)
+			}
+			if tt.forwarded != "" {
+				req.Header.Set("X-Forwarded-Host", tt.forwarded)
+			}
+			res := httptest.NewRecorder()
+			h.ServeHTTP(res, req)
+			if got := res.Body.String(); got != tt.want {
+				t.Errorf("request served by %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEndpoint(t *testing.T) {
+	s, _ := tenantService()
+	hr := s.Tenants[0].S
+
+	for _, tt := range []struct {
+		s    *AuthService
+		path string
+		want string
+	}{
+		{s, "/saml/admin/sessions", "admin/sessions"},
+		{hr, "/saml/admin/sessions", "admin/sessions"},
+		{hr, "/saml/hr/admin/sessions", "admin/sessions"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		if got := tt.s.endpoint(req); got != tt.want {
+			t.Errorf("endpoint(%s) = %s, want %s", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestReloadTenants(t *testing.T) {
+	s, _ := tenantService()
+	hr := s.Tenants[0].S
+
+	c := validConfig()
+	c.RequiredAttributes = []requirement{{"group": "staff"}}
+	c.Tenants = []TenantConfig{{
+		Name:  "hr",
+		Hosts: []string{"*.hr.example.com"},
+		IDPs: []IDPConfig{{
+			Name:        "workday",
+			MetadataURL: "https://workday.example.com/metadata",
+			Policy:      `group == "hr"`,
+		}},
+	}}
+	if err := s.reloadTenants(c); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := s.Settings().ACL.Describe(); !reflect.DeepEqual(got, hr.Settings().ACL.Describe()) {
+		t.Errorf("tenant policies = %v, want %v", hr.Settings().ACL.Describe(), got)
+	}
+	if got := s.Settings().IDPPolicies; len(got) != 0 {
+		t.Errorf("top level IdP policies = %v, want none", got)
+	}
+	if got := hr.Settings().IDPPolicies["workday"]; got == nil {
+		t.Error("tenant IdP policy was not reloaded")
+	}
+}
+
+func TestConfigRestartRequiredTenants(t *testing.T) {
+	old := validConfig()
+	old.Tenants = []TenantConfig{{
+		Name:  "hr",
+		Hosts: []string{"*.hr.example.com"},
+		IDPs:  []IDPConfig{{Name: "workday", MetadataURL: "https://workday.example.com/metadata"}},
+	}}
+
+	c := *old
+	c.Tenants = []TenantConfig{{
+		Name:  "hr",
+		Hosts: []string{"*.hr.example.com"},
+		IDPs:  []IDPConfig{{Name: "workday", MetadataURL: "https://workday.example.com/metadata", Policy: `group == "hr"`}},
+	}}
+	if got := c.restartRequired(old); len(got) != 0 {
+		t.Errorf("restartRequired() = %v, want none", got)
+	}
+
+	c.Tenants = []TenantConfig{{Name: "hr", Hosts: []string{"*.people.example.com"}}}
+	if got, want := c.restartRequired(old), []string{"tenants"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("restartRequired() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,408 @@
+package authorizer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/crewjam/saml/samlsp"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// TokenConfig enables signed JWT passed to upstream with identity of user
+type TokenConfig struct {
+	// KeyFile with PEM encoded RSA, P-256 ECDSA or Ed25519 private key,
+	// used only for upstream tokens
+	KeyFile string `yaml:"keyfile"`
+	// PublicKeyFiles with PEM encoded public keys or certificates also
+	// published in JWKS, e.g. previous key during rotation
+	PublicKeyFiles []string `yaml:"publickeyfiles"`
+	// Algorithm RS256, ES256 or EdDSA, default depends on key type
+	Algorithm string `yaml:"algorithm"`
+	// Header carrying the token, default Authorization with Bearer scheme
+	Header string `yaml:"header"`
+	// Issuer claim, default service URL
+	Issuer string `yaml:"issuer"`
+	// TTL of token, default 5m
+	TTL time.Duration `yaml:"ttl"`
+	// Claims maps claim name to attribute name, nil means DefaultClaims
+	Claims map[string]string `yaml:"claims"`
+	// ListClaims are always arrays, other claims are strings when
+	// attribute has single value, default groups
+	ListClaims []string `yaml:"listclaims"`
+	// Audiences maps host or *.domain pattern to audience claim, default
+	// is host of original request
+	Audiences map[string]string `yaml:"audiences"`
+}
+
+// DefaultClaims maps standard claims to attributes
+var DefaultClaims = map[string]string{
+	"sub":                "uid",
+	"email":              "mail",
+	"name":               "displayName",
+	"preferred_username": "eduPersonPrincipalName",
+	"groups":             "groups",
+}
+
+// registeredClaims are set by TokenMinter and can not be mapped
+var registeredClaims = map[string]bool{
+	"iss": true, "aud": true, "exp": true, "nbf": true, "iat": true, "jti": true,
+}
+
+// TokenMinter signs upstream tokens
+type TokenMinter struct {
+	key       crypto.Signer
+	kid       string
+	method    jwt.SigningMethod
+	header    string
+	issuer    string
+	ttl       time.Duration
+	claims    map[string]string
+	lists     map[string]bool
+	audiences []audience
+	jwks      []byte
+
+	now func() time.Time
+}
+
+type audience struct {
+	host  string
+	value string
+}
+
+// validate checks config without reading key files
+func (c *TokenConfig) validate() []string {
+	var errs []string
+	add := func(field, format string, args ...interface{}) {
+		errs = append(errs, field+": "+fmt.Sprintf(format, args...))
+	}
+	if c.KeyFile == "" {
+		add("keyfile", "is required")
+	}
+	switch c.Algorithm {
+	case "", "RS256", "ES256", "EdDSA":
+	default:
+		add("algorithm", "%q must be RS256, ES256 or EdDSA", c.Algorithm)
+	}
+	if c.Header != "" && !headerName.MatchString(c.Header) {
+		add("header", "%q is not valid header name", c.Header)
+	}
+	if c.TTL < 0 {
+		add("ttl", "must not be negative")
+	}
+	for _, claim := range sortedKeys(c.Claims) {
+		if claim == "" || c.Claims[claim] == "" {
+			add("claims", "%q: claim and attribute names are required", claim)
+		} else if registeredClaims[claim] {
+			add("claims", "%s is set by authorizer", claim)
+		}
+	}
+	for _, host := range sortedKeys(c.Audiences) {
+		if err := validateHostPattern(host); err != nil {
+			add("audiences", "%v", err)
+		}
+	}
+	return errs
+}
+
+// NewTokenMinter loads keys and returns TokenMinter for config, issuer is
+// used when config does not set one
+func NewTokenMinter(c TokenConfig, issuer string) (*TokenMinter, error) {
+	if errs := c.validate(); len(errs) > 0 {
+		return nil, errors.New(strings.Join(errs, "; "))
+	}
+
+	key, err := loadPrivateKey(c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("keyfile: %w", err)
+	}
+	method, err := signingMethod(key.Public(), c.Algorithm)
+	if err != nil {
+		return nil, fmt.Errorf("keyfile: %w", err)
+	}
+
+	m := &TokenMinter{
+		key:    key,
+		method: method,
+		header: c.Header,
+		issuer: c.Issuer,
+		ttl:    c.TTL,
+		claims: c.Claims,
+		lists:  map[string]bool{},
+		now:    time.Now,
+	}
+	if m.header == "" {
+		m.header = "Authorization"
+	}
+	if m.issuer == "" {
+		m.issuer = issuer
+	}
+	if m.ttl == 0 {
+		m.ttl = 5 * time.Minute
+	}
+	if m.claims == nil {
+		m.claims = DefaultClaims
+	}
+	lists := c.ListClaims
+	if lists == nil {
+		lists = []string{"groups"}
+	}
+	for _, claim := range lists {
+		m.lists[claim] = true
+	}
+	for _, host := range sortedKeys(c.Audiences) {
+		m.audiences = append(m.audiences, audience{host, c.Audiences[host]})
+	}
+	// exact hosts first, then longer wildcards, empty pattern last
+	rank := func(host string) int {
+		switch {
+		case host == "":
+			return 2
+		case strings.HasPrefix(host, "*."):
+			return 1
+		}
+		return 0
+	}
+	sort.SliceStable(m.audiences, func(i, j int) bool {
+		ri, rj := rank(m.audiences[i].host), rank(m.audiences[j].host)
+		if ri != rj {
+			return ri < rj
+		}
+		return len(m.audiences[i].host) > len(m.audiences[j].host)
+	})
+
+	keys := []jwk{newJWK(key.Public(), method.Alg())}
+	m.kid = keys[0].Kid
+	for _, name := range c.PublicKeyFiles {
+		pub, err := loadPublicKey(name)
+		if err != nil {
+			return nil, fmt.Errorf("publickeyfiles: %w", err)
+		}
+		pm, err := signingMethod(pub, "")
+		if err != nil {
+			return nil, fmt.Errorf("publickeyfiles: %s: %w", name, err)
+		}
+		keys = append(keys, newJWK(pub, pm.Alg()))
+	}
+	if m.jwks, err = json.Marshal(map[string][]jwk{"keys": keys}); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Algorithm returns name of signing algorithm
+func (m *TokenMinter) Algorithm() string {
+	return m.method.Alg()
+}
+
+// KeyID returns kid of signing key
+func (m *TokenMinter) KeyID() string {
+	return m.kid
+}
+
+// Header returns name of header carrying token
+func (m *TokenMinter) Header() string {
+	return m.header
+}
+
+func (m *TokenMinter) audience(host string) string {
+	for _, a := range m.audiences {
+		if matchHost(a.host, host) {
+			return a.value
+		}
+	}
+	return host
+}
+
+// canonical renames attributes of claims to canonical names, claims map of
+// config is not modified
+func (m *TokenMinter) canonical(a *Aliases) {
+	claims := make(map[string]string, len(m.claims))
+	for claim, name := range m.claims {
+		claims[claim] = a.Canonical(name)
+	}
+	m.claims = claims
+}
+
+// mint returns signed token for user with attributes accessing host
+func (m *TokenMinter) mint(attributes samlsp.Attributes, host string) (string, error) {
+	now := m.now()
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+
+	claims := jwt.MapClaims{
+		"iss": m.issuer,
+		"aud": m.audience(host),
+		"iat": now.Unix(),
+		"nbf": now.Unix(),
+		"exp": now.Add(m.ttl).Unix(),
+		"jti": base64.RawURLEncoding.EncodeToString(jti),
+	}
+	for claim, name := range m.claims {
+		values := attributes[name]
+		switch {
+		case len(values) == 0:
+		case m.lists[claim]:
+			claims[claim] = values
+		case len(values) == 1:
+			claims[claim] = values[0]
+		default:
+			claims[claim] = values
+		}
+	}
+
+	token := jwt.NewWithClaims(m.method, claims)
+	token.Header["kid"] = m.kid
+	return token.SignedString(m.key)
+}
+
+// set adds token for user to h
+func (m *TokenMinter) set(h http.Header, attributes samlsp.Attributes, host string) error {
+	token, err := m.mint(attributes, host)
+	if err != nil {
+		return err
+	}
+	if http.CanonicalHeaderKey(m.header) == "Authorization" {
+		token = "Bearer " + token
+	}
+	h.Set(m.header, token)
+	return nil
+}
+
+// JWKS handler publishes public keys verifying upstream tokens
+func (s *AuthService) JWKS(w http.ResponseWriter, r *http.Request) {
+	m := s.Settings().Token
+	if m == nil {
+		s.httpError(w, r, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	s.httpStatus(w, r, http.StatusOK)
+	w.Write(m.jwks)
+}
+
+func signingMethod(pub crypto.PublicKey, alg string) (jwt.SigningMethod, error) {
+	var method jwt.SigningMethod
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		method = jwt.SigningMethodRS256
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return nil, errors.New("ecdsa key must use P-256 curve")
+		}
+		method = jwt.SigningMethodES256
+	case ed25519.PublicKey:
+		method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", pub)
+	}
+	if alg != "" && alg != method.Alg() {
+		return nil, fmt.Errorf("algorithm %s does not match %s key", alg, method.Alg())
+	}
+	return method, nil
+}
+
+func loadPrivateKey(name string) (crypto.Signer, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", name)
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("%s: unsupported key type %T", name, key)
+		}
+		return signer, nil
+	}
+	return nil, fmt.Errorf("%s: unsupported PEM block %s", name, block.Type)
+}
+
+func loadPublicKey(name string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", name)
+	}
+	switch block.Type {
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	}
+	return nil, fmt.Errorf("%s: unsupported PEM block %s", name, block.Type)
+}
+
+// jwk is RFC 7517 JSON Web Key
+type jwk struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+func newJWK(pub crypto.PublicKey, alg string) jwk {
+	b64 := base64.RawURLEncoding.EncodeToString
+	k := jwk{Use: "sig", Alg: alg}
+	var thumbprint string
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		k.Kty, k.N, k.E = "RSA", b64(pub.N.Bytes()), b64(big.NewInt(int64(pub.E)).Bytes())
+		thumbprint = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, k.E, k.N)
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		k.Kty, k.Crv = "EC", "P-256"
+		k.X, k.Y = b64(pub.X.FillBytes(make([]byte, size))), b64(pub.Y.FillBytes(make([]byte, size)))
+		thumbprint = fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":%q,"y":%q}`, k.X, k.Y)
+	case ed25519.PublicKey:
+		k.Kty, k.Crv, k.X = "OKP", "Ed25519", b64(pub)
+		thumbprint = fmt.Sprintf(`{"crv":"Ed25519","kty":"OKP","x":%q}`, k.X)
+	}
+	// RFC 7638 thumbprint
+	sum := sha256.Sum256([]byte(thumbprint))
+	k.Kid = b64(sum[:])
+	return k
+}
@@ -0,0 +1,322 @@
+package authorizer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crewjam/saml/samlsp"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// writeKey writes PEM encoded private key to temporary file
+func writeKey(t *testing.T, key crypto.Signer) string {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(name, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func testKeys(t *testing.T) map[string]crypto.Signer {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]crypto.Signer{"RS256": rsaKey, "ES256": ecKey, "EdDSA": edKey}
+}
+
+// jwksKey returns public key from JWKS document
+func jwksKey(t *testing.T, doc []byte, kid string) crypto.PublicKey {
+	t.Helper()
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(doc, &jwks); err != nil {
+		t.Fatal(err)
+	}
+	num := func(s string) *big.Int {
+		b, err := jwt.DecodeSegment(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return new(big.Int).SetBytes(b)
+	}
+	for _, k := range jwks.Keys {
+		if k.Kid != kid {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			return &rsa.PublicKey{N: num(k.N), E: int(num(k.E).Int64())}
+		case "EC":
+			return &ecdsa.PublicKey{Curve: elliptic.P256(), X: num(k.X), Y: num(k.Y)}
+		case "OKP":
+			x, _ := jwt.DecodeSegment(k.X)
+			return ed25519.PublicKey(x)
+		}
+	}
+	t.Fatalf("key %s not found in %s", kid, doc)
+	return nil
+}
+
+func TestTokenMinter(t *testing.T) {
+	attributes := samlsp.Attributes{
+		"uid":         {"alice"},
+		"mail":        {"alice@example.com"},
+		"displayName": {"Alice"},
+		"groups":      {"sre"},
+		"role":        {"admin", "user"},
+	}
+
+	for alg, key := range testKeys(t) {
+		t.Run(alg, func(t *testing.T) {
+			m, err := NewTokenMinter(TokenConfig{
+				KeyFile: writeKey(t, key),
+				Audiences: map[string]string{
+					"grafana.example.com": "grafana",
+					"*.example.com":       "internal",
+				},
+			}, "https://auth.example.com")
+			if err != nil {
+				t.Fatalf("NewTokenMinter() error = %v", err)
+			}
+			if m.Algorithm() != alg {
+				t.Errorf("Algorithm() = %s, want %s", m.Algorithm(), alg)
+			}
+			now := time.Unix(1700000000, 0)
+			m.now = func() time.Time { return now }
+			jwt.TimeFunc = m.now
+			defer func() { jwt.TimeFunc = time.Now }()
+
+			h := http.Header{}
+			if err := m.set(h, attributes, "grafana.example.com"); err != nil {
+				t.Fatalf("set() error = %v", err)
+			}
+			raw := strings.TrimPrefix(h.Get("Authorization"), "Bearer ")
+
+			claims := jwt.MapClaims{}
+			token, err := jwt.ParseWithClaims(raw, claims, func(token *jwt.Token) (interface{}, error) {
+				return jwksKey(t, m.jwks, token.Header["kid"].(string)), nil
+			})
+			if err != nil || !token.Valid {
+				t.Fatalf("jwt.Parse() error = %v", err)
+			}
+			if token.Method.Alg() != alg {
+				t.Errorf("token alg = %s, want %s", token.Method.Alg(), alg)
+			}
+			delete(claims, "jti")
+			want := jwt.MapClaims{
+				"iss":    "https://auth.example.com",
+				"aud":    "grafana",
+				"iat":    float64(now.Unix()),
+				"nbf":    float64(now.Unix()),
+				"exp":    float64(now.Add(5 * time.Minute).Unix()),
+				"sub":    "alice",
+				"email":  "alice@example.com",
+				"name":   "Alice",
+				"groups": []interface{}{"sre"},
+			}
+			if !reflect.DeepEqual(claims, want) {
+				t.Errorf("claims = %v, want %v", claims, want)
+			}
+		})
+	}
+}
+
+func TestTokenMinterClaims(t *testing.T) {
+	m, err := NewTokenMinter(TokenConfig{
+		KeyFile:    writeKey(t, testKeys(t)["ES256"]),
+		Header:     "X-Auth-Token",
+		Issuer:     "authorizer",
+		TTL:        time.Minute,
+		Claims:     map[string]string{"sub": "mail", "roles": "role", "team": "team"},
+		ListClaims: []string{},
+		Audiences:  map[string]string{"*.example.com": "internal", "": "other"},
+	}, "https://auth.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for host, aud := range map[string]string{
+		"wiki.example.com": "internal",
+		"example.org":      "other",
+	} {
+		h := http.Header{}
+		err := m.set(h, samlsp.Attributes{"mail": {"bob@example.com"}, "role": {"admin", "user"}}, host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		claims := jwt.MapClaims{}
+		if _, _, err := new(jwt.Parser).ParseUnverified(h.Get("X-Auth-Token"), claims); err != nil {
+			t.Fatal(err)
+		}
+		if claims["aud"] != aud || claims["iss"] != "authorizer" || claims["sub"] != "bob@example.com" {
+			t.Errorf("claims = %v", claims)
+		}
+		if got, want := claims["roles"], []interface{}{"admin", "user"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("roles = %v, want %v", got, want)
+		}
+		if _, ok := claims["team"]; ok {
+			t.Errorf("unexpected team claim")
+		}
+		if exp, iat := claims["exp"].(float64), claims["iat"].(float64); exp-iat != 60 {
+			t.Errorf("ttl = %v, want 60", exp-iat)
+		}
+	}
+}
+
+func TestTokenMinterCanonical(t *testing.T) {
+	claims := map[string]string{"email": "emailAddress", "team": "team"}
+	m, err := NewTokenMinter(TokenConfig{KeyFile: writeKey(t, testKeys(t)["ES256"]), Claims: claims}, "https://auth.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.canonical(nil)
+	if want := map[string]string{"email": "mail", "team": "team"}; !reflect.DeepEqual(m.claims, want) {
+		t.Errorf("claims = %v, want %v", m.claims, want)
+	}
+	if claims["email"] != "emailAddress" {
+		t.Errorf("claims of config modified: %v", claims)
+	}
+}
+
+func TestNewTokenMinterErrors(t *testing.T) {
+	keys := testKeys(t)
+	tests := []struct {
+		name   string
+		config TokenConfig
+		want   string
+	}{{
+		name:   "Validate",
+		config: TokenConfig{Algorithm: "HS256", Claims: map[string]string{"exp": "expiry"}},
+		want:   `keyfile: is required; algorithm: "HS256" must be RS256, ES256 or EdDSA; claims: exp is set by authorizer`,
+	}, {
+		name:   "AlgorithmMismatch",
+		config: TokenConfig{KeyFile: writeKey(t, keys["RS256"]), Algorithm: "EdDSA"},
+		want:   "keyfile: algorithm EdDSA does not match RS256 key",
+	}, {
+		name:   "MissingKey",
+		config: TokenConfig{KeyFile: "missing.pem"},
+		want:   "keyfile: open missing.pem: no such file or directory",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewTokenMinter(tt.config, "https://auth.example.com")
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("NewTokenMinter() error = %v, want %s", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestJWKSHandler(t *testing.T) {
+	keys := testKeys(t)
+
+	// previous key published for verification during rotation
+	der, err := x509.MarshalPKIXPublicKey(keys["RS256"].Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := filepath.Join(t.TempDir(), "previous.pem")
+	if err := os.WriteFile(previous, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := NewTokenMinter(TokenConfig{
+		KeyFile:        writeKey(t, keys["EdDSA"]),
+		PublicKeyFiles: []string{previous},
+	}, "https://auth.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := fakeAuthService(&validUser{}, nil)
+	req := httptest.NewRequest(http.MethodGet, "/saml/jwks.json", nil)
+	res := httptest.NewRecorder()
+	s.JWKS(res, req)
+	if got, want := res.Code, http.StatusNotFound; got != want {
+		t.Errorf("got status %d but wanted %d", got, want)
+	}
+
+	s.Reload(&Settings{Token: m})
+	res = httptest.NewRecorder()
+	s.JWKS(res, req)
+	if got, want := res.Code, http.StatusOK; got != want {
+		t.Errorf("got status %d but wanted %d", got, want)
+	}
+
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(res.Body.Bytes(), &jwks); err != nil {
+		t.Fatal(err)
+	}
+	if len(jwks.Keys) != 2 || jwks.Keys[0].Kid != m.KeyID() || jwks.Keys[0].Kty != "OKP" || jwks.Keys[1].Alg != "RS256" {
+		t.Errorf("jwks = %s", res.Body.String())
+	}
+}
+
+func TestJWKThumbprint(t *testing.T) {
+	// RFC 7638 section 3.1 example
+	n, _ := jwt.DecodeSegment("0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw")
+	pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: 65537}
+	if got, want := newJWK(pub, "RS256").Kid, "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs"; got != want {
+		t.Errorf("kid = %s, want %s", got, want)
+	}
+}
+
+func TestAuthHandlerToken(t *testing.T) {
+	m, err := NewTokenMinter(TokenConfig{KeyFile: writeKey(t, testKeys(t)["ES256"])}, "https://auth.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := fakeAuthService(&validUser{}, nil)
+	s.Reload(&Settings{Token: m})
+
+	req := httptest.NewRequest(http.MethodGet, "/saml/auth", nil)
+	req.Header.Set("X-Original-URL", "https://grafana.example.com/")
+	res := httptest.NewRecorder()
+	s.Auth(res, req)
+
+	if got, want := res.Code, http.StatusAccepted; got != want {
+		t.Errorf("got status %d but wanted %d", got, want)
+	}
+	claims := jwt.MapClaims{}
+	raw := strings.TrimPrefix(res.Header().Get("Authorization"), "Bearer ")
+	if _, _, err := new(jwt.Parser).ParseUnverified(raw, claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims["aud"] != "grafana.example.com" || claims["email"] != "alice@example.com" {
+		t.Errorf("claims = %v", claims)
+	}
+}